@@ -0,0 +1,179 @@
+package chess_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* How long a session token from /login stays valid */
+var SessionTTL = 24 * time.Hour
+
+const MinPasswordLength = 8
+
+/* A registered player. Usernames follow ValidUser. */
+type Account struct {
+	Username string `json:"username"`
+	/* bcrypt hash of the password */
+	PasswordHash string    `json:"password_hash"`
+	Created      time.Time `json:"created"`
+}
+
+/*
+ * AccountStore holds the registered accounts and writes them to a JSON file
+ * whenever one is added. It is used from the HTTP handlers directly, so it
+ * has its own lock rather than a goroutine.
+ */
+type AccountStore struct {
+	lock     sync.Mutex
+	Path     string
+	Accounts map[string]*Account
+}
+
+/* Loads the accounts in path, starting with none if the file does not exist yet */
+func LoadAccountStore(path string) (*AccountStore, error) {
+	store := &AccountStore{Path: path, Accounts: make(map[string]*Account)}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	accounts := []*Account{}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for _, account := range accounts {
+		store.Accounts[strings.ToLower(account.Username)] = account
+	}
+	return store, nil
+}
+
+/* Writes every account to a temporary file and moves it over the old one */
+func (s *AccountStore) save() error {
+	if s.Path == "" {
+		return nil
+	}
+	accounts := []*Account{}
+	for _, account := range s.Accounts {
+		accounts = append(accounts, account)
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+/* Usernames are unique regardless of case */
+func (s *AccountStore) Register(username string, password string) (*Account, error) {
+	if !ValidUser(username) {
+		return nil, errors.New("Usernames are 1 to 32 letters, digits, '_' or '-'")
+	}
+	if len(password) < MinPasswordLength {
+		return nil, fmt.Errorf("Passwords need at least %d characters", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := strings.ToLower(username)
+	if _, ok := s.Accounts[key]; ok {
+		return nil, errors.New("Username is taken")
+	}
+	account := &Account{Username: username, PasswordHash: string(hash), Created: time.Now()}
+	s.Accounts[key] = account
+	if err := s.save(); err != nil {
+		delete(s.Accounts, key)
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *AccountStore) Get(username string) (*Account, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.Accounts[strings.ToLower(username)]
+	return account, ok
+}
+
+/* The account if the password is right */
+func (s *AccountStore) Authenticate(username string, password string) (*Account, error) {
+	account, ok := s.Get(username)
+	if !ok {
+		/* Same answer either way, so logins do not tell which usernames exist */
+		return nil, errors.New("Wrong username or password")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return nil, errors.New("Wrong username or password")
+	}
+	return account, nil
+}
+
+/* A signed session token for the account, and when it expires */
+func (s *ChessServer) NewSession(account *Account) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(SessionTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Subject:   account.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	})
+	signed, err := token.SignedString(s.SessionKey)
+	return signed, expires, err
+}
+
+/* The username a session token was issued to, if it is valid */
+func (s *ChessServer) ParseSession(token string) (string, error) {
+	claims := &jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("Unexpected signing method")
+		}
+		return s.SessionKey, nil
+	})
+	if err != nil {
+		return "", errors.New("Invalid session")
+	}
+	account, ok := s.Accounts.Get(claims.Subject)
+	if !ok {
+		return "", errors.New("Invalid session")
+	}
+	return account.Username, nil
+}
+
+/*
+ * The logged in user of a request, empty for anonymous players. The session
+ * token goes in an "Authorization: Bearer" header, or in the token query
+ * parameter for websockets, which browsers can not give headers.
+ */
+func (s *ChessServer) Authenticate(c echo.Context) (string, error) {
+	token := c.QueryParam("token")
+	if header := c.Request().Header.Get(echo.HeaderAuthorization); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return "", errors.New("Invalid session")
+		}
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if token == "" {
+		return "", nil
+	}
+	return s.ParseSession(token)
+}
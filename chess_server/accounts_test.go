@@ -0,0 +1,104 @@
+package chess_server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, err := LoadAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Register("Alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Register("aLICE", "battery staple"); err == nil {
+		t.Error("registered a username differing only in case")
+	}
+	if _, err := store.Register("bob", "short"); err == nil {
+		t.Error("registered a short password")
+	}
+	if _, err := store.Register("bob smith", "correct horse"); err == nil {
+		t.Error("registered an invalid username")
+	}
+
+	/* A restart finds the same accounts */
+	reloaded, err := LoadAccountStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*AccountStore{store, reloaded} {
+		account, err := s.Authenticate("alice", "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Username != "Alice" {
+			t.Errorf("logged in as %s, want Alice", account.Username)
+		}
+		if _, err := s.Authenticate("Alice", "Correct horse"); err == nil {
+			t.Error("logged in with the wrong password")
+		}
+		if _, err := s.Authenticate("carol", "correct horse"); err == nil {
+			t.Error("logged in to an account that does not exist")
+		}
+	}
+	if account, _ := reloaded.Get("alice"); account.PasswordHash == "correct horse" {
+		t.Error("password saved in the clear")
+	}
+	if _, err := reloaded.Register("ALICE", "battery staple"); err == nil {
+		t.Error("registered a taken username after a restart")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	var server ChessServer
+	server.Init()
+	server.SessionKey = []byte("session key")
+	account, err := server.Accounts.Register("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := server.NewSession(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := server.ParseSession(token); err != nil || user != "alice" {
+		t.Errorf("session of %q: %v", user, err)
+	}
+
+	now := time.Now()
+	claims := jwt.StandardClaims{Subject: "alice", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.StandardClaims) string {
+		signed, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	expired := claims
+	expired.IssuedAt = now.Add(-2 * SessionTTL).Unix()
+	expired.ExpiresAt = now.Add(-time.Minute).Unix()
+	unknown := claims
+	unknown.Subject = "mallory"
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"another key", sign(jwt.SigningMethodHS256, []byte("other key"), claims)},
+		{"alg none", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims)},
+		{"HS512", sign(jwt.SigningMethodHS512, server.SessionKey, claims)},
+		{"expired", sign(jwt.SigningMethodHS256, server.SessionKey, expired)},
+		{"no account", sign(jwt.SigningMethodHS256, server.SessionKey, unknown)},
+		{"garbage", "not a token"},
+	}
+	for _, test := range tests {
+		if user, err := server.ParseSession(test.token); err == nil {
+			t.Errorf("%s: accepted as %s", test.name, user)
+		}
+	}
+}
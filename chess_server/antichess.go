@@ -0,0 +1,75 @@
+package chess_server
+
+import (
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeAntichess, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		return NewAntichessBoard(options)
+	})
+}
+
+const AntichessFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w - - 0 1"
+
+/*
+ * AntichessBoard is the board of an antichess game, where captures are
+ * compulsory (see AntichessMoves) and the first player to lose all their
+ * pieces or to have no legal move wins.
+ */
+type AntichessBoard struct {
+	positionGame
+}
+
+func NewAntichessBoard(options GameNewUpdate) (*AntichessBoard, error) {
+	start, err := startingPosition(options, AntichessFEN, AntichessMoves)
+	if err != nil {
+		return nil, err
+	}
+	return &AntichessBoard{newPositionGame(start)}, nil
+}
+
+func (b *AntichessBoard) FEN() string {
+	return b.Position.FEN(false)
+}
+
+func (b *AntichessBoard) ApplyMove(move string) error {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return err
+	}
+	b.play(b.Position.Play(m))
+	return nil
+}
+
+func (b *AntichessBoard) Outcome() (chess.Outcome, string) {
+	if b.Decided != chess.NoOutcome {
+		return b.Decided, b.DecidedBy
+	}
+	winner := chess.WhiteWon
+	if b.Position.Turn == chess.Black {
+		winner = chess.BlackWon
+	}
+	/* Only the side to move can have run out of pieces or moves */
+	if !b.Position.hasPieces(b.Position.Turn) && b.Position.kingSquare(b.Position.Turn) < 0 {
+		return winner, "all_pieces_lost"
+	}
+	if len(b.Position.LegalMoves()) == 0 {
+		return winner, "stalemate"
+	}
+	return b.automaticDraw()
+}
+
+/* Running out of time loses, whatever is left on the board */
+func (b *AntichessBoard) HasMatingMaterial(color chess.Color) bool {
+	return true
+}
+
+func (b *AntichessBoard) AddSyncState(update *GameSyncUpdate) {
+}
+
+func (b *AntichessBoard) AddMoveState(update *GameMoveUpdate) {
+}
+
+func (b *AntichessBoard) Setup(options *GameNewUpdate) {
+}
@@ -0,0 +1,250 @@
+package chess_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/notnil/chess"
+)
+
+/* A move as played, kept for the archive */
+type PlayedMove struct {
+	Board int    `json:"board,omitempty"`
+	Color string `json:"color"`
+	UCI   string `json:"uci"`
+	SAN   string `json:"san"`
+	/* Time left on the mover's clock after the move, nil in untimed games */
+	ClockMs *int64 `json:"clock_ms,omitempty"`
+}
+
+/* Who sat where in an archived game */
+type ArchivedPlayer struct {
+	Board    int    `json:"board,omitempty"`
+	Color    string `json:"color"`
+	PlayerId uint64 `json:"player_id"`
+	User     string `json:"user,omitempty"`
+	/* Rating before the game and how it changed, for rated games */
+	Rating int `json:"rating,omitempty"`
+	Change int `json:"change,omitempty"`
+}
+
+/* Everything kept about a finished game */
+type ArchivedGame struct {
+	GameId      uint64 `json:"game_id"`
+	Mode        string `json:"mode"`
+	StartFEN    string `json:"start_fen"`
+	CustomStart bool   `json:"custom_start,omitempty"`
+	/* Chess960 start position number, if the game was not set up from a FEN */
+	StartPosition *int             `json:"start_position,omitempty"`
+	Opening       *OpeningUpdate   `json:"opening,omitempty"`
+	BaseMs        int64            `json:"base_ms"`
+	IncrementMs   int64            `json:"increment_ms"`
+	Clock         ClockMode        `json:"clock,omitempty"`
+	Players       []ArchivedPlayer `json:"players"`
+	Rated         bool             `json:"rated"`
+	Result        string           `json:"result"`
+	Method        string           `json:"method"`
+	Started       time.Time        `json:"started"`
+	Ended         time.Time        `json:"ended"`
+	Moves         []PlayedMove     `json:"moves"`
+}
+
+func (a *ArchivedGame) TimeControl() TimeControl {
+	return TimeControl{
+		Base:      time.Duration(a.BaseMs) * time.Millisecond,
+		Increment: time.Duration(a.IncrementMs) * time.Millisecond,
+		Mode:      a.Clock,
+	}
+}
+
+/* The player at color on board, if the seat exists */
+func (a *ArchivedGame) Player(board int, color chess.Color) (ArchivedPlayer, bool) {
+	for _, player := range a.Players {
+		if player.Board == board && player.Color == color.String() {
+			return player, true
+		}
+	}
+	return ArchivedPlayer{}, false
+}
+
+/*
+ * GameArchive keeps finished games, one JSON line per game appended to a
+ * file, and indexes them by id and player. Games write to it from their own
+ * goroutines, so it has its own lock.
+ */
+type GameArchive struct {
+	lock  sync.Mutex
+	Path  string
+	Games map[uint64]*ArchivedGame
+	/* Ids of the games of each user, oldest first */
+	UserGames map[string][]uint64
+}
+
+/* Loads the games in path, starting with none if the file does not exist yet */
+func LoadGameArchive(path string) (*GameArchive, error) {
+	archive := &GameArchive{
+		Path:      path,
+		Games:     make(map[uint64]*ArchivedGame),
+		UserGames: make(map[string][]uint64),
+	}
+	if path == "" {
+		return archive, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return archive, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		game := &ArchivedGame{}
+		if err := json.Unmarshal(scanner.Bytes(), game); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		archive.index(game)
+	}
+	return archive, scanner.Err()
+}
+
+func (a *GameArchive) index(game *ArchivedGame) {
+	a.Games[game.GameId] = game
+	seen := map[string]bool{}
+	for _, player := range game.Players {
+		if player.User != "" && !seen[player.User] {
+			seen[player.User] = true
+			a.UserGames[player.User] = append(a.UserGames[player.User], game.GameId)
+		}
+	}
+}
+
+/* Writes a finished game to the end of the file and indexes it */
+func (a *GameArchive) Save(game ArchivedGame) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.Games[game.GameId]; ok {
+		return errors.New("Game is already archived")
+	}
+	if a.Path != "" {
+		data, err := json.Marshal(game)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(a.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(append(data, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	a.index(&game)
+	return nil
+}
+
+func (a *GameArchive) Game(gameId uint64) (ArchivedGame, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	game, ok := a.Games[gameId]
+	if !ok {
+		return ArchivedGame{}, false
+	}
+	return *game, true
+}
+
+/* Every archived game user played, oldest first */
+func (a *GameArchive) ByUser(user string) []ArchivedGame {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	games := []ArchivedGame{}
+	for _, gameId := range a.UserGames[user] {
+		games = append(games, *a.Games[gameId])
+	}
+	return games
+}
+
+/* The lowest game id not used by an archived game */
+func (a *GameArchive) NextGameId() uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	next := uint64(0)
+	for gameId := range a.Games {
+		if gameId >= next {
+			next = gameId + 1
+		}
+	}
+	return next
+}
+
+/* The record of the game once it is over */
+func (g *ChessGame) archiveRecord(result GameResultUpdate) ArchivedGame {
+	record := ArchivedGame{
+		GameId:      g.GameId,
+		Mode:        g.Mode,
+		StartFEN:    g.StartFEN,
+		CustomStart: g.CustomStart,
+		BaseMs:      g.Clock.TimeControl.Base.Milliseconds(),
+		IncrementMs: g.Clock.TimeControl.Increment.Milliseconds(),
+		Clock:       g.Clock.TimeControl.Mode,
+		Players:     []ArchivedPlayer{},
+		Rated:       result.RatingChanges != nil,
+		Result:      result.Result,
+		Method:      result.Method,
+		Started:     g.Started,
+		Ended:       time.Now(),
+		Moves:       append([]PlayedMove{}, g.Moves...),
+	}
+	if record.Clock == "" && g.Clock.TimeControl.Timed() {
+		record.Clock = ClockFischer
+	}
+	if g.Bughouse != nil {
+		record.StartFEN = StartingFEN
+	} else {
+		snapshot := GameSyncUpdate{}
+		g.Variant.AddSyncState(&snapshot)
+		record.Opening = snapshot.Opening
+		record.StartPosition = snapshot.StartPosition
+	}
+	for _, seat := range g.Seats {
+		player := ArchivedPlayer{
+			Board:    seat.Board,
+			Color:    seat.Color.String(),
+			PlayerId: seat.PlayerId,
+			User:     g.SeatUser(seat),
+		}
+		if change, ok := result.RatingChanges[seat.Color.String()]; ok {
+			player.Rating = change.Rating - change.Change
+			player.Change = change.Change
+		}
+		record.Players = append(record.Players, player)
+	}
+	return record
+}
+
+/* Stores the game in the archive, once */
+func (g *ChessGame) archive(result GameResultUpdate) {
+	if g.Archive == nil || g.Archived {
+		return
+	}
+	g.Archived = true
+	if err := g.Archive.Save(g.archiveRecord(result)); err != nil {
+		log.Errorf("Could not archive game %d: %s", g.GameId, err)
+	}
+}
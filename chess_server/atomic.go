@@ -0,0 +1,73 @@
+package chess_server
+
+import (
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeAtomic, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		return NewAtomicBoard(options)
+	})
+}
+
+/*
+ * AtomicBoard is the board of an atomic game, where captures blow up the
+ * pieces around them (see AtomicMoves) and blowing up the enemy king wins.
+ */
+type AtomicBoard struct {
+	positionGame
+}
+
+func NewAtomicBoard(options GameNewUpdate) (*AtomicBoard, error) {
+	start, err := startingPosition(options, StartingFEN, AtomicMoves)
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicBoard{newPositionGame(start)}, nil
+}
+
+func (b *AtomicBoard) FEN() string {
+	return b.Position.FEN(false)
+}
+
+func (b *AtomicBoard) ApplyMove(move string) error {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return err
+	}
+	b.play(b.Position.Play(m))
+	return nil
+}
+
+func (b *AtomicBoard) Outcome() (chess.Outcome, string) {
+	if b.Decided != chess.NoOutcome {
+		return b.Decided, b.DecidedBy
+	}
+	if b.Position.kingSquare(chess.White) < 0 {
+		return chess.BlackWon, "explosion"
+	}
+	if b.Position.kingSquare(chess.Black) < 0 {
+		return chess.WhiteWon, "explosion"
+	}
+	if outcome, method := b.mateOutcome(); outcome != chess.NoOutcome {
+		return outcome, method
+	}
+	/* Kings can not capture, so only bare kings on both sides are a dead draw */
+	if !b.HasMatingMaterial(chess.White) && !b.HasMatingMaterial(chess.Black) {
+		return chess.Draw, "insufficient_material"
+	}
+	return b.automaticDraw()
+}
+
+func (b *AtomicBoard) HasMatingMaterial(color chess.Color) bool {
+	return b.Position.hasPieces(color)
+}
+
+func (b *AtomicBoard) AddSyncState(update *GameSyncUpdate) {
+}
+
+func (b *AtomicBoard) AddMoveState(update *GameMoveUpdate) {
+}
+
+func (b *AtomicBoard) Setup(options *GameNewUpdate) {
+}
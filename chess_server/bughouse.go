@@ -0,0 +1,231 @@
+package chess_server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+/* One of the two boards of a bughouse game */
+type BughouseBoard struct {
+	Position      *Position
+	Clock         GameClock
+	WhitePlayerId uint64
+	BlackPlayerId uint64
+}
+
+/*
+ * BughouseMatch holds the two linked boards of a bughouse game. The white
+ * player of board 0 partners the black player of board 1 and vice versa; in
+ * 1v1 bughouse partners are the same player.
+ * Pieces captured on one board go into the pocket of the partner of the
+ * capturing player, and the first board to finish decides the match.
+ */
+type BughouseMatch struct {
+	Boards        [2]*BughouseBoard
+	DecidingBoard int
+}
+
+/* players are white and black of board 0, then white and black of board 1 */
+func NewBughouseMatch(timeControl TimeControl, players [4]uint64) *BughouseMatch {
+	match := &BughouseMatch{}
+	for i := range match.Boards {
+		match.Boards[i] = &BughouseBoard{
+			Position:      NewPosition(),
+			Clock:         NewGameClock(timeControl),
+			WhitePlayerId: players[2*i],
+			BlackPlayerId: players[2*i+1],
+		}
+	}
+	return match
+}
+
+func (m *BughouseMatch) Seats() []Seat {
+	seats := []Seat{}
+	for i, board := range m.Boards {
+		seats = append(seats,
+			Seat{PlayerId: board.WhitePlayerId, Board: i, Color: chess.White},
+			Seat{PlayerId: board.BlackPlayerId, Board: i, Color: chess.Black})
+	}
+	return seats
+}
+
+/*
+ * Outcome of the match when winner wins on board, from the point of view of
+ * board 0: the team of board 0's white player is "white"
+ */
+func teamOutcome(board int, winner chess.Color) chess.Outcome {
+	if (board == 0) == (winner == chess.White) {
+		return chess.WhiteWon
+	}
+	return chess.BlackWon
+}
+
+func (m *BughouseMatch) Pockets() []PocketUpdate {
+	pockets := []PocketUpdate{}
+	for _, board := range m.Boards {
+		pockets = append(pockets, pocketUpdate(board.Position))
+	}
+	return pockets
+}
+
+/* The earliest moment a player on either board runs out of time */
+func (m *BughouseMatch) Deadline() (time.Time, bool) {
+	var earliest time.Time
+	found := false
+	for _, board := range m.Boards {
+		if deadline, ok := board.Clock.Deadline(); ok && (!found || deadline.Before(earliest)) {
+			earliest = deadline
+			found = true
+		}
+	}
+	return earliest, found
+}
+
+func (m *BughouseMatch) SyncUpdate(gameId uint64, mode string) GameSyncUpdate {
+	now := time.Now()
+	boards := []BoardSyncUpdate{}
+	for i, board := range m.Boards {
+		boards = append(boards, BoardSyncUpdate{
+			Board:         i,
+			WhitePlayerId: board.WhitePlayerId,
+			BlackPlayerId: board.BlackPlayerId,
+			FEN:           board.Position.FEN(true),
+			Clock:         board.Clock.Snapshot(now),
+			Turn:          board.Position.Turn.String(),
+			LegalMoves:    legalMovesUCI(board.Position),
+			Check:         board.Position.InCheck(),
+		})
+	}
+	return GameSyncUpdate{
+		GameId:        gameId,
+		Mode:          mode,
+		WhitePlayerId: boards[0].WhitePlayerId,
+		BlackPlayerId: boards[0].BlackPlayerId,
+		FEN:           boards[0].FEN,
+		Clock:         boards[0].Clock,
+		Turn:          boards[0].Turn,
+		LegalMoves:    boards[0].LegalMoves,
+		Check:         boards[0].Check,
+		Pockets:       m.Pockets(),
+		Boards:        boards,
+	}
+}
+
+/* Stops both clocks and describes how the match ended */
+func (m *BughouseMatch) ResultUpdate(outcome chess.Outcome, method string) GameResultUpdate {
+	now := time.Now()
+	for _, board := range m.Boards {
+		board.Clock.Stop(now)
+	}
+	deciding := m.Boards[m.DecidingBoard]
+	return GameResultUpdate{
+		Result: outcome.String(),
+		Method: method,
+		Board:  m.DecidingBoard,
+		FEN:    deciding.Position.FEN(true),
+		Clock:  deciding.Clock.Snapshot(now),
+	}
+}
+
+/*
+ * A player in check with no legal moves is only mated if no piece they could
+ * still receive from their partner would help, i.e. the check could not be
+ * blocked by a drop either.
+ */
+func bughouseMated(pos *Position) bool {
+	if !pos.InCheck() || len(pos.LegalMoves()) > 0 {
+		return false
+	}
+	hypothetical := pos.copy()
+	for _, t := range pocketTypes {
+		hypothetical.Pockets[pos.Turn][t] += 1
+	}
+	return len(hypothetical.LegalMoves()) == 0
+}
+
+/*
+ * A player who is not in check but can neither move nor drop stalemates
+ * their board. Waiting for a piece from the partner could take forever,
+ * so the match is drawn instead.
+ */
+func bughouseStalemated(pos *Position) bool {
+	return !pos.InCheck() && len(pos.LegalMoves()) == 0
+}
+
+func (g *ChessGame) makeBughouseMove(move GameMoveUpdate, now time.Time) error {
+	seat, ok := g.moveSeat(move.PlayerId, move.Board)
+	if !ok {
+		return errors.New("Invalid Player Id or board")
+	}
+	if move.PlayerColor != seat.Color.String() {
+		return errors.New("Invalid Player color")
+	}
+	board := g.Bughouse.Boards[seat.Board]
+	if board.Position.Turn != seat.Color {
+		return errors.New("Player color does not match what's on the server")
+	}
+
+	/* A move that arrives after the flag has fallen does not count */
+	if g.checkFlag(now) {
+		return nil
+	}
+
+	m, err := board.Position.ParseMove(move.Move)
+	if err != nil {
+		return errors.New("Invalid move")
+	}
+	notation := board.Position.Notation(m)
+	captured, promoted := board.Position.Captured(m)
+	g.logAction(move, "move_update", now)
+	board.Position = board.Position.Play(m)
+	if captured != chess.NoPiece {
+		/* The partner gets the piece in the color they play; promoted pieces revert to pawns */
+		t := captured.Type()
+		if promoted {
+			t = chess.Pawn
+		}
+		partnerBoard := g.Bughouse.Boards[1-seat.Board]
+		partnerBoard.Position.Pockets[captured.Color()][t] += 1
+	}
+	board.Clock.Punch(now)
+	g.recordMove(seat.Board, seat.Color, notation.UCI, notation.SAN, board.Clock.Snapshot(now))
+
+	move.Board = seat.Board
+	move.setNotation(notation)
+	move.FEN = board.Position.FEN(true)
+	move.Clock = board.Clock.Snapshot(now)
+	move.Pockets = g.Bughouse.Pockets()
+	g.BroadcastUpdate(move, "move_update")
+
+	if bughouseMated(board.Position) {
+		g.Bughouse.DecidingBoard = seat.Board
+		g.Outcome = teamOutcome(seat.Board, seat.Color)
+		g.Method = "checkmate"
+		g.broadcastResult()
+	} else if bughouseStalemated(board.Position) {
+		g.Bughouse.DecidingBoard = seat.Board
+		g.Outcome = chess.Draw
+		g.Method = "stalemate"
+		g.broadcastResult()
+	}
+	return nil
+}
+
+/* Ends the match if a player on either board has run out of time */
+func (g *ChessGame) checkBughouseFlag(now time.Time) bool {
+	if g.Finished() {
+		return false
+	}
+	for i, board := range g.Bughouse.Boards {
+		if board.Clock.Flagged(now) {
+			g.Bughouse.DecidingBoard = i
+			g.Outcome = teamOutcome(i, board.Clock.Turn.Other())
+			g.Method = "timeout"
+			g.broadcastResult()
+			return true
+		}
+	}
+	return false
+}
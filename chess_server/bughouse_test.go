@@ -0,0 +1,104 @@
+package chess_server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+/* A 1v1 bughouse game: player 0 is white on board 0 and black on board 1 */
+func newTestBughouse(t *testing.T) *ChessGame {
+	t.Helper()
+	var controller ChessGamesController
+	controller.Init()
+	options := GameNewUpdate{Mode: ModeBughouse1v1, TimeControl: TimeControl{Base: time.Minute}}
+	game, err := controller.createGame(0, 0, options, clockStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return game
+}
+
+func TestBughouse1v1Boards(t *testing.T) {
+	game := newTestBughouse(t)
+	now := clockStart
+	moves := []struct {
+		player uint64
+		board  int
+		color  string
+		move   string
+		valid  bool
+	}{
+		{0, 0, "w", "e4", true},
+		/* Board 1 has white to move, which is player 1 */
+		{0, 1, "b", "e5", false},
+		{1, 1, "w", "d4", true},
+		/* Player 1 is black on board 0, so white there is not theirs */
+		{1, 0, "w", "d4", false},
+		{0, 2, "w", "d4", false},
+		{0, 1, "b", "d5", true},
+		{1, 0, "b", "d5", true},
+		{1, 1, "w", "c4", true},
+		/* The pawn taken on board 0 can be dropped by the same player on board 1 */
+		{0, 0, "w", "exd5", true},
+		{0, 1, "b", "P@e6", true},
+	}
+	for _, m := range moves {
+		now = now.Add(time.Second)
+		update := GameMoveUpdate{GameId: game.GameId, PlayerId: m.player, Board: m.board, PlayerColor: m.color, Move: m.move}
+		if err := game.makeMove(update, now); (err == nil) != m.valid {
+			t.Errorf("player %d %s on board %d: %v", m.player, m.move, m.board, err)
+		}
+	}
+	fens := []string{
+		"rnbqkbnr/ppp1pppp/8/3P4/8/8/PPPP1PPP/RNBQKBNR[] b KQkq - 0 2",
+		"rnbqkbnr/ppp1pppp/4p3/3p4/2PP4/8/PP2PPPP/RNBQKBNR[] w KQkq - 1 3",
+	}
+	for i, board := range game.Bughouse.Boards {
+		if got := board.Position.FEN(true); got != fens[i] {
+			t.Errorf("board %d: %s, want %s", i, got, fens[i])
+		}
+	}
+	events, err := game.EventsSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drop, ok := events[len(events)-1].Update.(GameMoveUpdate); !ok || drop.Board != 1 || drop.UCI != "P@e6" {
+		t.Errorf("last move sent as %+v", events[len(events)-1].Update)
+	}
+	if game.Finished() {
+		t.Error("game over")
+	}
+}
+
+func TestBughouseStalemate(t *testing.T) {
+	cases := []struct {
+		name    string
+		fen     string
+		outcome chess.Outcome
+		method  string
+	}{
+		{"nothing to move or drop", "k7/8/1Q6/8/8/8/8/K7[] w - - 0 1", chess.Draw, "stalemate"},
+		{"a piece to drop", "k7/8/1Q6/8/8/8/8/K7[n] w - - 0 1", chess.NoOutcome, ""},
+	}
+	for _, c := range cases {
+		game := newTestBughouse(t)
+		pos, err := ParsePosition(c.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		game.Bughouse.Boards[1].Position = pos
+		/* White on board 1 is player 1 */
+		update := GameMoveUpdate{GameId: game.GameId, PlayerId: 1, Board: 1, PlayerColor: "w", Move: "Kb1"}
+		if err := game.makeMove(update, clockStart.Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if game.Outcome != c.outcome || game.Method != c.method {
+			t.Errorf("%s: %s by %q, want %s by %q", c.name, game.Outcome, game.Method, c.outcome, c.method)
+		}
+		if c.outcome != chess.NoOutcome && game.Bughouse.DecidingBoard != 1 {
+			t.Errorf("%s: decided on board %d", c.name, game.Bughouse.DecidingBoard)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package chess_server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+/* How long a challenge stays open before it expires */
+var ChallengeTTL = 10 * time.Minute
+
+/*
+ * A game offered to whoever opens its token, bypassing the matchmaking
+ * queue. Only the player who made it knows the secret.
+ */
+type Challenge struct {
+	Token   string
+	Secret  string
+	Options GameNewUpdate
+	/* Color of the player who made the challenge */
+	Color   chess.Color
+	Expires time.Time
+	/* Seat of the player who made the challenge, once it is accepted */
+	Accepted *MatchFoundResponse
+	/* Connections of the challenger waiting to hear the outcome */
+	Watchers []chan<- GameUpdate
+}
+
+/* Sent to the challenger when their challenge is accepted */
+type ChallengeAcceptedUpdate struct {
+	Token string             `json:"token"`
+	Match MatchFoundResponse `json:"match"`
+}
+
+/* Sent to the challenger when their challenge is cancelled or expires */
+type ChallengeClosedUpdate struct {
+	Token  string `json:"token"`
+	Reason string `json:"reason"`
+}
+
+/* Sent by the challenger to be told when their challenge is accepted */
+type ChallengeWatchUpdate struct {
+	Token  string `json:"token"`
+	Secret string `json:"secret"`
+}
+
+type ChallengeCreateRequest struct {
+	Options GameNewUpdate
+	Color   chess.Color
+}
+
+type ChallengeAcceptRequest struct {
+	Token string
+	User  string
+}
+
+type ChallengeCancelRequest struct {
+	Token  string
+	Secret string
+}
+
+type ChallengeWatchRequest struct {
+	ChallengeWatchUpdate
+	Stream chan<- GameUpdate
+}
+
+/* Challenge requests are handled by the matchmaking goroutine */
+type ChallengeRequest struct {
+	Update   interface{}
+	Response chan<- interface{}
+}
+
+type ChallengeResponse struct {
+	Challenge Challenge
+	Match     MatchFoundResponse
+	Error     error
+}
+
+func (m *MatchMakingController) challengeRequest(update interface{}) ChallengeResponse {
+	response := make(chan interface{})
+	m.ChallengeRequests <- ChallengeRequest{Update: update, Response: response}
+	return (<-response).(ChallengeResponse)
+}
+
+func (m *MatchMakingController) CreateChallenge(options GameNewUpdate, color chess.Color) (Challenge, error) {
+	response := m.challengeRequest(ChallengeCreateRequest{Options: options, Color: color})
+	return response.Challenge, response.Error
+}
+
+/* Starts the game of a challenge and returns the seat of the player accepting it */
+func (m *MatchMakingController) AcceptChallenge(token string, user string) (MatchFoundResponse, error) {
+	response := m.challengeRequest(ChallengeAcceptRequest{Token: token, User: user})
+	return response.Match, response.Error
+}
+
+func (m *MatchMakingController) CancelChallenge(token string, secret string) error {
+	return m.challengeRequest(ChallengeCancelRequest{Token: token, Secret: secret}).Error
+}
+
+/*
+ * Subscribes stream to the outcome of a challenge: a ChallengeAcceptedUpdate
+ * or a ChallengeClosedUpdate, after which the stream is closed. The stream
+ * needs room for that one update.
+ */
+func (m *MatchMakingController) WatchChallenge(update ChallengeWatchUpdate, stream chan<- GameUpdate) error {
+	return m.challengeRequest(ChallengeWatchRequest{ChallengeWatchUpdate: update, Stream: stream}).Error
+}
+
+func (m *MatchMakingController) handleChallenge(request ChallengeRequest) {
+	var response ChallengeResponse
+	switch update := request.Update.(type) {
+	case ChallengeCreateRequest:
+		response.Challenge, response.Error = m.createChallenge(update)
+	case ChallengeAcceptRequest:
+		response.Match, response.Error = m.acceptChallenge(update.Token, update.User)
+	case ChallengeCancelRequest:
+		response.Error = m.cancelChallenge(update.Token, update.Secret)
+	case ChallengeWatchRequest:
+		response.Error = m.watchChallenge(update)
+	}
+	if request.Response != nil {
+		request.Response <- response
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/* What the server keeps of a token it handed out, so the token is never stored */
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *MatchMakingController) createChallenge(request ChallengeCreateRequest) (Challenge, error) {
+	token, err := randomToken()
+	if err != nil {
+		return Challenge{}, err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return Challenge{}, err
+	}
+	challenge := &Challenge{
+		Token:   token,
+		Secret:  secret,
+		Options: request.Options,
+		Color:   request.Color,
+		Expires: time.Now().Add(ChallengeTTL),
+	}
+	m.Challenges[token] = challenge
+	return *challenge, nil
+}
+
+func (m *MatchMakingController) acceptChallenge(token string, user string) (MatchFoundResponse, error) {
+	challenge, ok := m.Challenges[token]
+	if !ok || challenge.Accepted != nil || !time.Now().Before(challenge.Expires) {
+		return MatchFoundResponse{}, errors.New("No such challenge")
+	}
+	if user != "" && user == challenge.Options.User(challenge.Color) {
+		return MatchFoundResponse{}, errors.New("Can not accept your own challenge")
+	}
+	options := challenge.Options
+	options.SetUser(challenge.Color.Other(), user)
+	game, err := m.NewGameRequests.AddNewGame(options)
+	if err != nil {
+		return MatchFoundResponse{}, fmt.Errorf("Could not start the game: %s", err)
+	}
+	match := game.matchFound(challenge.Color)
+	challenge.Accepted = &match
+	for _, watcher := range challenge.Watchers {
+		watcher <- ChallengeAcceptedUpdate{Token: token, Match: match}
+		close(watcher)
+	}
+	challenge.Watchers = nil
+	return game.matchFound(challenge.Color.Other()), nil
+}
+
+func (m *MatchMakingController) cancelChallenge(token string, secret string) error {
+	challenge, ok := m.Challenges[token]
+	if !ok || challenge.Secret != secret || challenge.Accepted != nil {
+		return errors.New("No such challenge")
+	}
+	m.closeChallenge(token, "cancelled")
+	return nil
+}
+
+func (m *MatchMakingController) watchChallenge(request ChallengeWatchRequest) error {
+	challenge, ok := m.Challenges[request.Token]
+	if !ok || challenge.Secret != request.Secret {
+		return errors.New("No such challenge")
+	}
+	if challenge.Accepted != nil {
+		request.Stream <- ChallengeAcceptedUpdate{Token: request.Token, Match: *challenge.Accepted}
+		close(request.Stream)
+		return nil
+	}
+	challenge.Watchers = append(challenge.Watchers, request.Stream)
+	return nil
+}
+
+/*
+ * Forgets the challenges whose time is up. Accepted challenges are kept until
+ * then too, so a late watcher still hears about the game.
+ */
+func (m *MatchMakingController) expireChallenges(now time.Time) {
+	for token, challenge := range m.Challenges {
+		if !now.Before(challenge.Expires) {
+			m.closeChallenge(token, "expired")
+		}
+	}
+}
+
+/* Forgets a challenge, telling its watchers why if it was still open */
+func (m *MatchMakingController) closeChallenge(token string, reason string) {
+	challenge, ok := m.Challenges[token]
+	if !ok {
+		return
+	}
+	for _, watcher := range challenge.Watchers {
+		watcher <- ChallengeClosedUpdate{Token: token, Reason: reason}
+		close(watcher)
+	}
+	delete(m.Challenges, token)
+}
@@ -0,0 +1,100 @@
+package chess_server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+/* A challenge by alice, playing white, with a connection waiting for its outcome */
+func newTestChallenge(t *testing.T, m *MatchMakingController) (Challenge, chan GameUpdate) {
+	t.Helper()
+	options := GameNewUpdate{Mode: ModeStandard, TimeControl: DefaultTimeControl, WhiteUser: "alice"}
+	challenge, err := m.createChallenge(ChallengeCreateRequest{Options: options, Color: chess.White})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := make(chan GameUpdate, 1)
+	if err := m.watchChallenge(ChallengeWatchRequest{ChallengeWatchUpdate{Token: challenge.Token, Secret: challenge.Secret}, watcher}); err != nil {
+		t.Fatal(err)
+	}
+	return challenge, watcher
+}
+
+func TestChallengeAccept(t *testing.T) {
+	m := newTestMatchMaker()
+	challenge, watcher := newTestChallenge(t, m)
+	if _, err := m.acceptChallenge(challenge.Token, "alice"); err == nil {
+		t.Error("accepted own challenge")
+	}
+	match, err := m.acceptChallenge(challenge.Token, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, ok := (<-watcher).(ChallengeAcceptedUpdate)
+	if !ok || accepted.Match.GameId != match.GameId || accepted.Match.PlayerColor != "w" || match.PlayerColor != "b" {
+		t.Errorf("challenger told %+v, accepter got %+v", accepted, match)
+	}
+	if _, open := <-watcher; open {
+		t.Error("watcher still open")
+	}
+	if _, err := m.acceptChallenge(challenge.Token, "carol"); err == nil {
+		t.Error("accepted a challenge twice")
+	}
+	if err := m.cancelChallenge(challenge.Token, challenge.Secret); err == nil {
+		t.Error("cancelled an accepted challenge")
+	}
+	/* A late watcher still hears about the game until the challenge expires */
+	late := make(chan GameUpdate, 1)
+	if err := m.watchChallenge(ChallengeWatchRequest{ChallengeWatchUpdate{Token: challenge.Token, Secret: challenge.Secret}, late}); err != nil {
+		t.Fatal(err)
+	}
+	if update, ok := (<-late).(ChallengeAcceptedUpdate); !ok || update.Match != accepted.Match {
+		t.Errorf("late watcher told %+v", update)
+	}
+	m.expireChallenges(challenge.Expires)
+	if len(m.Challenges) != 0 {
+		t.Error("accepted challenge kept after it expired")
+	}
+}
+
+func TestChallengeCancel(t *testing.T) {
+	m := newTestMatchMaker()
+	challenge, watcher := newTestChallenge(t, m)
+	if err := m.cancelChallenge(challenge.Token, challenge.Token); err == nil {
+		t.Error("cancelled without the secret")
+	}
+	if err := m.cancelChallenge(challenge.Token, challenge.Secret); err != nil {
+		t.Fatal(err)
+	}
+	if closed, ok := (<-watcher).(ChallengeClosedUpdate); !ok || closed.Reason != "cancelled" {
+		t.Errorf("challenger told %+v", closed)
+	}
+	if _, err := m.acceptChallenge(challenge.Token, "bob"); err == nil {
+		t.Error("accepted a cancelled challenge")
+	}
+}
+
+func TestChallengeExpiry(t *testing.T) {
+	m := newTestMatchMaker()
+	challenge, watcher := newTestChallenge(t, m)
+	m.expireChallenges(challenge.Expires.Add(-time.Second))
+	if len(watcher) != 0 {
+		t.Fatal("challenge expired early")
+	}
+	m.expireChallenges(challenge.Expires)
+	if closed, ok := (<-watcher).(ChallengeClosedUpdate); !ok || closed.Reason != "expired" {
+		t.Errorf("challenger told %+v", closed)
+	}
+	if _, err := m.acceptChallenge(challenge.Token, "bob"); err == nil {
+		t.Error("accepted an expired challenge")
+	}
+
+	/* Past its time a challenge can not be accepted, even before it is cleaned up */
+	challenge, _ = newTestChallenge(t, m)
+	m.Challenges[challenge.Token].Expires = time.Now()
+	if _, err := m.acceptChallenge(challenge.Token, "bob"); err == nil {
+		t.Error("accepted a challenge past its time")
+	}
+}
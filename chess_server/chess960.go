@@ -0,0 +1,168 @@
+package chess_server
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeChess960, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		if options.FEN != "" {
+			return NewCustomChess960Board(options.FEN)
+		}
+		return NewChess960Board(options.StartPosition)
+	})
+}
+
+/* Start position number of regular chess in the Chess960 numbering */
+const StandardStartPosition = 518
+
+/* Asks for a Chess960 start position picked at random */
+const RandomStartPosition = -1
+
+/* Knight placements on the five files left after the bishops and queen, by index */
+var chess960Knights = [10][2]int{{0, 1}, {0, 2}, {0, 3}, {0, 4}, {1, 2}, {1, 3}, {1, 4}, {2, 3}, {2, 4}, {3, 4}}
+
+/*
+ * White's back rank for Chess960 start position n (0-959) using the standard
+ * (Scharnagl) numbering, e.g. "RNBQKBNR" for 518
+ */
+func Chess960BackRank(n int) (string, error) {
+	if n < 0 || n >= 960 {
+		return "", errors.New("Chess960 start position must be between 0 and 959")
+	}
+	rank := [8]byte{}
+	rank[2*(n%4)+1] = 'B'
+	n /= 4
+	rank[2*(n%4)] = 'B'
+	n /= 4
+	/* The remaining pieces go on the empty files from left to right */
+	place := func(index int, piece byte) {
+		for file := range rank {
+			if rank[file] != 0 {
+				continue
+			}
+			if index == 0 {
+				rank[file] = piece
+				return
+			}
+			index -= 1
+		}
+	}
+	place(n%6, 'Q')
+	n /= 6
+	knights := chess960Knights[n]
+	place(knights[1], 'N')
+	place(knights[0], 'N')
+	for _, piece := range []byte{'R', 'K', 'R'} {
+		place(0, piece)
+	}
+	return string(rank[:]), nil
+}
+
+/* The Position of Chess960 start position n */
+func NewChess960Position(n int) (*Position, error) {
+	backRank, err := Chess960BackRank(n)
+	if err != nil {
+		return nil, err
+	}
+	fen := strings.ToLower(backRank) + "/pppppppp/8/8/8/8/PPPPPPPP/" + backRank + " w KQkq - 0 1"
+	pos, err := ParsePosition(fen)
+	if err != nil {
+		return nil, err
+	}
+	pos.Chess960 = true
+	return pos, nil
+}
+
+/* The board of a Chess960 game */
+type Chess960Board struct {
+	positionGame
+	StartPosition int
+}
+
+/* Sets up start position n, or a random one for RandomStartPosition */
+func NewChess960Board(n int) (*Chess960Board, error) {
+	if n == RandomStartPosition {
+		n = rand.Intn(960)
+	}
+	start, err := NewChess960Position(n)
+	if err != nil {
+		return nil, err
+	}
+	return &Chess960Board{
+		positionGame:  newPositionGame(start),
+		StartPosition: n,
+	}, nil
+}
+
+/*
+ * Sets up a game from a position given as FEN, with castling rights in
+ * either KQkq or Shredder notation. It has no start position number.
+ */
+func NewCustomChess960Board(fen string) (*Chess960Board, error) {
+	start, err := startingPosition(GameNewUpdate{FEN: fen}, "", StandardMoves)
+	if err != nil {
+		return nil, err
+	}
+	start.Chess960 = true
+	return &Chess960Board{
+		positionGame:  newPositionGame(start),
+		StartPosition: RandomStartPosition,
+	}, nil
+}
+
+func (b *Chess960Board) FEN() string {
+	return b.Position.FEN(false)
+}
+
+/* Parses a move in SAN or UCI notation and plays it */
+func (b *Chess960Board) ApplyMove(move string) error {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return err
+	}
+	b.play(b.Position.Play(m))
+	return nil
+}
+
+/*
+ * The same automatic endings notnil/chess applies to regular games:
+ * checkmate, stalemate, insufficient material, fivefold repetition and the
+ * seventy-five move rule
+ */
+func (b *Chess960Board) Outcome() (chess.Outcome, string) {
+	if b.Decided != chess.NoOutcome {
+		return b.Decided, b.DecidedBy
+	}
+	if outcome, method := b.mateOutcome(); outcome != chess.NoOutcome {
+		return outcome, method
+	}
+	if b.Position.insufficientMaterial() {
+		return chess.Draw, "insufficient_material"
+	}
+	return b.automaticDraw()
+}
+
+func (b *Chess960Board) HasMatingMaterial(color chess.Color) bool {
+	return hasMatingMaterial(b.Position.Board[:], color)
+}
+
+func (b *Chess960Board) AddSyncState(update *GameSyncUpdate) {
+	if b.StartPosition == RandomStartPosition {
+		return
+	}
+	n := b.StartPosition
+	update.StartPosition = &n
+}
+
+func (b *Chess960Board) AddMoveState(update *GameMoveUpdate) {
+}
+
+/* Rematches are played from the same start position */
+func (b *Chess960Board) Setup(options *GameNewUpdate) {
+	options.StartPosition = b.StartPosition
+}
@@ -0,0 +1,127 @@
+package chess_server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notnil/chess"
+)
+
+/* Reference counts from https://www.chessprogramming.org/Chess960_Perft_Results */
+func TestChess960Perft(t *testing.T) {
+	runPerft(t, []perftCase{
+		{fen: "bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w HFhf - 2 9", nodes: []int{21, 528, 12189, 326672}},
+		{fen: "2nnrbkr/p1qppppp/8/1ppb4/6PP/3PP3/PPP2P2/BQNNRBKR w HEhe - 1 9", nodes: []int{21, 807, 18002, 667366}},
+		{fen: "b1q1rrkb/pppppppp/3nn3/8/P7/1PPP4/4PPPP/BQNNRKRB w GE - 1 9", nodes: []int{20, 479, 10471, 273318}},
+	})
+}
+
+func TestChess960BackRank(t *testing.T) {
+	seen := map[string]bool{}
+	for n := 0; n < 960; n++ {
+		rank, err := Chess960BackRank(n)
+		if err != nil {
+			t.Fatalf("%d: %s", n, err)
+		}
+		seen[rank] = true
+		king, rook1, rook2 := strings.Index(rank, "K"), strings.Index(rank, "R"), strings.LastIndex(rank, "R")
+		bishop1, bishop2 := strings.Index(rank, "B"), strings.LastIndex(rank, "B")
+		if !(rook1 < king && king < rook2) || (bishop1+bishop2)%2 == 0 {
+			t.Errorf("%d: %s has the king outside the rooks or bishops on one color", n, rank)
+		}
+	}
+	if len(seen) != 960 {
+		t.Errorf("%d different back ranks, want 960", len(seen))
+	}
+	for n, want := range map[int]string{0: "BBQNNRKR", 518: "RNBQKBNR", 959: "RKRNNQBB"} {
+		if rank, _ := Chess960BackRank(n); rank != want {
+			t.Errorf("%d: %s, want %s", n, rank, want)
+		}
+	}
+	for _, n := range []int{-2, 960} {
+		if _, err := Chess960BackRank(n); err == nil {
+			t.Errorf("start position %d accepted", n)
+		}
+	}
+}
+
+func TestChess960Castling(t *testing.T) {
+	/* The king on b1 between its rooks, as in start positions like RKNNQBBR */
+	pos, err := ParsePosition("rk5r/pppppppp/8/8/8/8/PPPPPPPP/RK5R w KQkq - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos.Chess960 = true
+	cases := []struct {
+		move string
+		uci  string
+		fen  string
+	}{
+		/* Castling is written as the king taking its own rook and ends on the usual squares */
+		{"O-O", "b1h1", "rk5r/pppppppp/8/8/8/8/PPPPPPPP/R4RK1 b kq - 1 1"},
+		{"O-O-O", "b1a1", "rk5r/pppppppp/8/8/8/8/PPPPPPPP/2KR3R b kq - 1 1"},
+		{"b1h1", "b1h1", "rk5r/pppppppp/8/8/8/8/PPPPPPPP/R4RK1 b kq - 1 1"},
+	}
+	for _, c := range cases {
+		m, err := pos.ParseMove(c.move)
+		if err != nil {
+			t.Errorf("%s: %s", c.move, err)
+			continue
+		}
+		if got := pos.UCI(m); got != c.uci {
+			t.Errorf("%s: UCI %s, want %s", c.move, got, c.uci)
+		}
+		if got := pos.Play(m).FEN(false); got != c.fen {
+			t.Errorf("%s: %s, want %s", c.move, got, c.fen)
+		}
+	}
+}
+
+func TestChess960KingMoveCastling(t *testing.T) {
+	/* In the regular start position castling can be sent in standard UCI */
+	board, err := NewChess960Board(StandardStartPosition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, move := range []string{"e4", "e5", "Nf3", "Nc6", "Bc4", "Bc5", "e1g1"} {
+		if err := board.ApplyMove(move); err != nil {
+			t.Fatalf("%s: %s", move, err)
+		}
+	}
+	if want := "r1bqk1nr/pppp1ppp/2n5/2b1p3/2B1P3/5N2/PPPP1PPP/RNBQ1RK1 b kq - 5 4"; board.FEN() != want {
+		t.Errorf("castled to %s, want %s", board.FEN(), want)
+	}
+
+	/* Where the king can also step to that square, the king move wins */
+	pos, err := ParsePosition("rk5r/pppppppp/8/8/8/8/PPPPPPPP/R4K1R w KQkq - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos.Chess960 = true
+	cases := []struct {
+		move string
+		fen  string
+	}{
+		{"f1g1", "rk5r/pppppppp/8/8/8/8/PPPPPPPP/R5KR b kq - 1 1"},
+		{"f1h1", "rk5r/pppppppp/8/8/8/8/PPPPPPPP/R4RK1 b kq - 1 1"},
+		{"f1c1", "rk5r/pppppppp/8/8/8/8/PPPPPPPP/2KR3R b kq - 1 1"},
+	}
+	for _, c := range cases {
+		m, err := pos.ParseMove(c.move)
+		if err != nil {
+			t.Errorf("%s: %s", c.move, err)
+			continue
+		}
+		if got := pos.Play(m).FEN(false); got != c.fen {
+			t.Errorf("%s: %s, want %s", c.move, got, c.fen)
+		}
+	}
+}
+
+func TestChess960Outcome(t *testing.T) {
+	runOutcomes(t, ModeChess960, []outcomeCase{
+		{"start position plays on", "", []string{"e4", "e5"}, chess.NoOutcome, ""},
+		{"checkmate", "4k3/R7/4K3/8/8/8/8/8 w - - 0 1", []string{"Ra8#"}, chess.WhiteWon, "checkmate"},
+		{"insufficient material", "4k3/8/4K3/8/8/8/8/8 w - - 0 1", nil, chess.Draw, "insufficient_material"},
+	})
+}
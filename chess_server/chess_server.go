@@ -1,7 +1,10 @@
 package chess_server
 
 import (
+	"crypto/rand"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
@@ -14,11 +17,92 @@ type ChessServerBase interface {
 type ChessServer struct {
 	ChessGamesController  ChessGamesController
 	MatchMakingController MatchMakingController
+	Ratings               RatingController
+	Accounts              *AccountStore
+	Archive               *GameArchive
+	/* Signs session tokens */
+	SessionKey []byte
 }
 
 func (s *ChessServer) Init() {
+	s.Accounts, _ = LoadAccountStore("")
+	s.Archive, _ = LoadGameArchive("")
+	s.Ratings.Init()
 	s.ChessGamesController.Init()
+	s.ChessGamesController.Archive = s.Archive
+	s.ChessGamesController.Ratings = &s.Ratings
 	s.MatchMakingController.Init(&s.ChessGamesController.Events)
+	s.MatchMakingController.Ratings = &s.Ratings
+}
+
+/* Loads the starting positions for random opening games. Call before Run */
+func (s *ChessServer) LoadOpenings(path string) error {
+	pool, err := LoadOpeningPool(path)
+	if err != nil {
+		return err
+	}
+	s.ChessGamesController.Openings = pool
+	return nil
+}
+
+/* Loads the registered accounts and keeps new ones in path. Call before Run */
+func (s *ChessServer) LoadAccounts(path string) error {
+	accounts, err := LoadAccountStore(path)
+	if err != nil {
+		return err
+	}
+	s.Accounts = accounts
+	return nil
+}
+
+/* Loads the players' ratings and keeps them up to date in path. Call before Run */
+func (s *ChessServer) LoadRatings(path string) error {
+	return s.Ratings.Load(path)
+}
+
+/*
+ * Loads the finished games kept in path and archives new ones there. Game
+ * ids carry on after the archived ones. Call before Run.
+ */
+func (s *ChessServer) LoadArchive(path string) error {
+	archive, err := LoadGameArchive(path)
+	if err != nil {
+		return err
+	}
+	s.Archive = archive
+	s.ChessGamesController.Archive = archive
+	s.ChessGamesController.NextAvailGameId = archive.NextGameId()
+	return nil
+}
+
+/*
+ * Writes live games to the log in path and restarts the unfinished games
+ * already in it, so a restart does not end them. Call after LoadArchive and
+ * before Run.
+ */
+func (s *ChessServer) LoadGameLog(path string) error {
+	log, records, err := OpenGameLog(path)
+	if err != nil {
+		return err
+	}
+	s.ChessGamesController.Log = log
+	kept := s.ChessGamesController.Recover(records, time.Now())
+	/* Games that are over are no longer needed to recover the others */
+	return log.Rewrite(kept)
+}
+
+/*
+ * Sets the key session tokens are signed with. Without a key of its own the
+ * server makes up one, and sessions do not survive a restart.
+ */
+func (s *ChessServer) SetSessionKey(key string) error {
+	if key != "" {
+		s.SessionKey = []byte(key)
+		return nil
+	}
+	s.SessionKey = make([]byte, 32)
+	_, err := rand.Read(s.SessionKey)
+	return err
 }
 
 type ChessServerContext struct {
@@ -33,6 +117,7 @@ func (s *ChessServer) PlayerLoop(
 		string
 	},
 	wsOut chan<- GameUpdate,
+	user string,
 	logger echo.Logger) {
 
 	clientUpdate, ok := <-wsIn
@@ -44,6 +129,7 @@ func (s *ChessServer) PlayerLoop(
 		return
 	}
 	joinMsg := clientUpdate.GameUpdate.(GamePlayerJoinedUpdate)
+	joinMsg.User = user
 
     /* TODO: Use gameId to get the event stream for the game */
 	gameId := joinMsg.GameId
@@ -56,37 +142,119 @@ func (s *ChessServer) PlayerLoop(
 	} else {
 		logger.Info(fmt.Sprintf("Player %d joined game %d", playerId, gameId))
 	}
-	defer eventsIn.PlayerLeave(GamePlayerLeftUpdate{GameId: gameId, PlayerId: playerId})
+	defer eventsIn.PlayerLeave(GamePlayerLeftUpdate{GameId: gameId, PlayerId: playerId, Stream: eventsOut})
 
 	for {
 		select {
-		case update := <-eventsOut:
-			wsOut <- update.GameUpdate
+		case update, ok := <-eventsOut:
+			if !ok {
+				logger.Info(fmt.Sprintf("Player %d joined game %d on another connection", playerId, gameId))
+				return
+			}
+			wsOut <- inNotation(update.GameUpdate, joinMsg.Notation)
             logger.Info(update.string)
-			if update.string == "result_update" {
+			/*
+			 * Players stay connected after the result so they can agree on a
+			 * rematch, which they then have to join like any other game
+			 */
+			if update.string == "match_found" {
 				return
 			}
 		case clientUpdate, ok := <-wsIn:
 			if !ok {
 				logger.Error(`{"reason": "Failed to receive move from client"}`)
 				return
-			} else if clientUpdate.string == "EOF" {
-				return
-			} else if clientUpdate.string != "move_update" { /* TODO: support updates like resign, draw offer, etc. */
-				logger.Error(fmt.Sprintf("Expected move update, instead received %s", clientUpdate.GameUpdate))
-				return
 			}
-			moveUpdate := clientUpdate.GameUpdate.(GameMoveUpdate)
-			logger.Info(fmt.Sprintf("Player %d entered move %s", playerId, moveUpdate.Move))
+			switch clientUpdate.string {
+			case "EOF":
+				return
+			case "move_update":
+				moveUpdate := clientUpdate.GameUpdate.(GameMoveUpdate)
+				logger.Info(fmt.Sprintf("Player %d entered move %s on board %d", playerId, moveUpdate.Move, moveUpdate.Board))
 
-			if err := eventsIn.MakeMove(moveUpdate); err != nil {
-				logger.Error(fmt.Sprintf("Invalid move %s", err))
+				if err := eventsIn.MakeMove(moveUpdate); err != nil {
+					logger.Error(fmt.Sprintf("Invalid move %s", err))
+					return
+				}
+			/* The game and player are taken from the join, not from what the client claims */
+			case "resign":
+				logger.Info(fmt.Sprintf("Player %d resigned game %d", playerId, gameId))
+				if err := eventsIn.Resign(GameResignUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not resign: %s", err))
+				}
+			case "offer_draw":
+				logger.Info(fmt.Sprintf("Player %d offered a draw in game %d", playerId, gameId))
+				if err := eventsIn.OfferDraw(GameDrawOfferUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not offer draw: %s", err))
+				}
+			case "accept_draw":
+				logger.Info(fmt.Sprintf("Player %d accepted a draw in game %d", playerId, gameId))
+				if err := eventsIn.AcceptDraw(GameDrawAcceptUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not accept draw: %s", err))
+				}
+			case "decline_draw":
+				logger.Info(fmt.Sprintf("Player %d declined a draw in game %d", playerId, gameId))
+				if err := eventsIn.DeclineDraw(GameDrawDeclineUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not decline draw: %s", err))
+				}
+			case "rematch_offer":
+				logger.Info(fmt.Sprintf("Player %d offered a rematch of game %d", playerId, gameId))
+				if err := eventsIn.OfferRematch(GameRematchOfferUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not offer rematch: %s", err))
+				}
+			case "accept_rematch":
+				logger.Info(fmt.Sprintf("Player %d accepted a rematch of game %d", playerId, gameId))
+				if err := eventsIn.AcceptRematch(GameRematchAcceptUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not accept rematch: %s", err))
+				}
+			case "decline_rematch":
+				logger.Info(fmt.Sprintf("Player %d declined a rematch of game %d", playerId, gameId))
+				if err := eventsIn.DeclineRematch(GameRematchDeclineUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not decline rematch: %s", err))
+				}
+			case "takeback_request":
+				logger.Info(fmt.Sprintf("Player %d requested a takeback in game %d", playerId, gameId))
+				if err := eventsIn.RequestTakeback(GameTakebackRequestUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not request takeback: %s", err))
+				}
+			case "accept_takeback":
+				logger.Info(fmt.Sprintf("Player %d accepted a takeback in game %d", playerId, gameId))
+				if err := eventsIn.AcceptTakeback(GameTakebackAcceptUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not accept takeback: %s", err))
+				}
+			case "decline_takeback":
+				logger.Info(fmt.Sprintf("Player %d declined a takeback in game %d", playerId, gameId))
+				if err := eventsIn.DeclineTakeback(GameTakebackDeclineUpdate{GameId: gameId, PlayerId: playerId}); err != nil {
+					logger.Error(fmt.Sprintf("Could not decline takeback: %s", err))
+				}
+			case "events_since":
+				since := clientUpdate.GameUpdate.(GameEventsSinceUpdate).Since
+				if err := s.sendEventsSince(gameControllerChannel, gameId, since, joinMsg.Notation, wsOut); err != nil {
+					logger.Error(fmt.Sprintf("Could not get the events of game %d: %s", gameId, err))
+				}
+			default:
+				logger.Error(fmt.Sprintf("Unexpected update from player: %s", clientUpdate.string))
 				return
 			}
 		}
 	}
 }
 
+/*
+ * Sends a connection the events of a game after since again. Events already
+ * on their way may arrive twice, clients tell them apart by their numbers.
+ */
+func (s *ChessServer) sendEventsSince(gameControllerChannel *ChessGamesControllerChannel, gameId uint64, since uint64, notation string, wsOut chan<- GameUpdate) error {
+	events, err := gameControllerChannel.GameEvents(gameId, since)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		wsOut <- inNotation(event, notation)
+	}
+	return nil
+}
+
 func (s *ChessServer) SpectateLoop(
     gameControllerChannel *ChessGamesControllerChannel,
 	wsIn <-chan struct {
@@ -94,6 +262,7 @@ func (s *ChessServer) SpectateLoop(
 		string
 	},
 	wsOut chan<- GameUpdate,
+	user string,
 	logger echo.Logger) {
 
 	clientUpdate, ok := <-wsIn
@@ -116,10 +285,120 @@ func (s *ChessServer) SpectateLoop(
 	for {
 		select {
 		case update := <-eventsOut:
-			wsOut <- update.GameUpdate
+			wsOut <- inNotation(update.GameUpdate, joinMsg.Notation)
 			if update.string == "result_update" {
 				return
 			}
+		case clientMsg := <-wsIn:
+			/* Unless it is EOF or asks for events ignore */
+			if clientMsg.string == "EOF" {
+				return
+			}
+			if clientMsg.string == "events_since" {
+				since := clientMsg.GameUpdate.(GameEventsSinceUpdate).Since
+				if err := s.sendEventsSince(gameControllerChannel, joinMsg.GameId, since, joinMsg.Notation, wsOut); err != nil {
+					logger.Error(fmt.Sprintf("Could not get the events of game %d: %s", joinMsg.GameId, err))
+				}
+			}
+		}
+	}
+}
+
+/*
+ * Matchmaking without holding up an HTTP request: the first message is a
+ * find_match, after which the player gets queue_update messages until the
+ * match_found or match_timeout. A cancel_match or closing the connection
+ * takes the player out of the queue.
+ */
+func (s *ChessServer) MatchLoop(
+	gameControllerChannel *ChessGamesControllerChannel,
+	wsIn <-chan struct {
+		GameUpdate
+		string
+	},
+	wsOut chan<- GameUpdate,
+	user string,
+	logger echo.Logger) {
+
+	clientUpdate, ok := <-wsIn
+	if !ok {
+		logger.Error("Failed to receive find match update")
+		return
+	} else if clientUpdate.string != "find_match" {
+		logger.Error(fmt.Sprintf("Expected find match update, instead received %s", clientUpdate.GameUpdate))
+		return
+	}
+	matchmaking := &s.MatchMakingController
+	request, err := s.matchRequest(clientUpdate.GameUpdate.(FindMatchRequest), user)
+	if err != nil {
+		wsOut <- MatchErrorResponse{T: "match_error", Message: err.Error()}
+		return
+	}
+	response := make(chan interface{}, 1)
+	progress := make(chan QueueUpdate, 1)
+	request.Response = response
+	request.Progress = progress
+	matchmaking.FindMatch(request)
+	for {
+		select {
+		case update := <-progress:
+			wsOut <- update
+		case update, ok := <-response:
+			if !ok {
+				wsOut <- MatchErrorResponse{T: "match_error", Message: "Could not start the game"}
+				return
+			}
+			wsOut <- update
+			return
+		case clientUpdate := <-wsIn:
+			switch clientUpdate.string {
+			case "EOF", "cancel_match":
+				logger.Info("Player left the matchmaking queue")
+				matchmaking.CancelMatch(response)
+				return
+			default:
+				logger.Error(fmt.Sprintf("Unexpected update while matchmaking: %s", clientUpdate.string))
+			}
+		}
+	}
+}
+
+/*
+ * Tells the player who made a challenge what became of it. The first message
+ * has to be a challenge_watch with the token and secret of the challenge.
+ */
+func (s *ChessServer) ChallengeLoop(
+	gameControllerChannel *ChessGamesControllerChannel,
+	wsIn <-chan struct {
+		GameUpdate
+		string
+	},
+	wsOut chan<- GameUpdate,
+	user string,
+	logger echo.Logger) {
+
+	clientUpdate, ok := <-wsIn
+	if !ok {
+		logger.Error("Failed to receive challenge watch update")
+		return
+	} else if clientUpdate.string != "challenge_watch" {
+		logger.Error(fmt.Sprintf("Expected challenge watch update, instead received %s", clientUpdate.GameUpdate))
+		return
+	}
+	watchMsg := clientUpdate.GameUpdate.(ChallengeWatchUpdate)
+
+	stream := make(chan GameUpdate, 1)
+	if err := s.MatchMakingController.WatchChallenge(watchMsg, stream); err != nil {
+		logger.Error(fmt.Sprintf("Could not watch challenge: %s", err))
+		return
+	}
+	for {
+		select {
+		case update, ok := <-stream:
+			if !ok {
+				return
+			}
+			wsOut <- update
 		case clientMsg := <-wsIn:
 			/* Unless it is EOF ignore */
 			if clientMsg.string == "EOF" {
@@ -129,6 +408,71 @@ func (s *ChessServer) SpectateLoop(
 	}
 }
 
+/*
+ * A lobby connection: shows the open seeks as they come and go and lets the
+ * player post, cancel and accept seeks. Seeks posted here are removed when
+ * the connection closes.
+ */
+func (s *ChessServer) LobbyLoop(
+	gameControllerChannel *ChessGamesControllerChannel,
+	wsIn <-chan struct {
+		GameUpdate
+		string
+	},
+	wsOut chan<- GameUpdate,
+	user string,
+	logger echo.Logger) {
+
+	lobby := &s.MatchMakingController
+	memberId, stream := lobby.JoinLobby()
+	defer lobby.LeaveLobby(memberId)
+	for {
+		select {
+		case update, ok := <-stream:
+			if !ok {
+				logger.Error(fmt.Sprintf("Lobby connection %d fell behind", memberId))
+				return
+			}
+			wsOut <- update
+		case clientUpdate := <-wsIn:
+			var err error
+			switch clientUpdate.string {
+			case "EOF":
+				return
+			case "seek_create":
+				seekUpdate := clientUpdate.GameUpdate.(SeekCreateUpdate)
+				options, color, optionsErr := seekUpdate.gameOptions(user)
+				if optionsErr != nil {
+					err = optionsErr
+					break
+				}
+				_, err = lobby.CreateSeek(memberId, Seek{
+					Options:   options,
+					Color:     color,
+					Rating:    seekUpdate.Rating,
+					RatingMin: seekUpdate.RatingMin,
+					RatingMax: seekUpdate.RatingMax,
+				})
+			case "seek_cancel":
+				err = lobby.CancelSeek(memberId, clientUpdate.GameUpdate.(SeekCancelUpdate).SeekId)
+			case "seek_accept":
+				acceptUpdate := clientUpdate.GameUpdate.(SeekAcceptUpdate)
+				var match MatchFoundResponse
+				match, err = lobby.AcceptSeek(memberId, acceptUpdate.SeekId, user, acceptUpdate.Rating)
+				if err == nil {
+					wsOut <- match
+				}
+			default:
+				logger.Error(fmt.Sprintf("Unexpected update from lobby: %s", clientUpdate.string))
+				return
+			}
+			if err != nil {
+				wsOut <- LobbyErrorUpdate{Message: err.Error()}
+			}
+		}
+	}
+}
+
 func (s *ChessServer) WSHandler(f func(
 	gameController *ChessGamesControllerChannel,
 	wsIn <-chan struct {
@@ -136,8 +480,14 @@ func (s *ChessServer) WSHandler(f func(
 		string
 	},
 	wsOut chan<- GameUpdate,
+	user string,
 	logger echo.Logger)) func(c echo.Context) error {
 	return func(c echo.Context) error {
+		/* Turned away before the upgrade, so the client gets a proper 401 */
+		user, err := s.Authenticate(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		}
 		ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 		if err != nil {
 			return err
@@ -166,7 +516,7 @@ func (s *ChessServer) WSHandler(f func(
 		go wsController.WSWriter(writerSignal)
 
 		/* this function will signal to the reader that the session is finished */
-		f(gameControllerChannel, wsIn, wsOut, cc.Logger())
+		f(gameControllerChannel, wsIn, wsOut, user, cc.Logger())
 		/* signal to writer to finish */
 		writerSignal <- struct{}{}
 		return nil
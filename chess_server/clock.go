@@ -0,0 +1,194 @@
+package chess_server
+
+import (
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+/* How the time bonus of a TimeControl is applied after each move */
+type ClockMode string
+
+const (
+	/* Increment is added to the mover's clock after every move */
+	ClockFischer ClockMode = "fischer"
+	/* The time used for a move is given back, up to Increment */
+	ClockBronstein ClockMode = "bronstein"
+	/* The clock only starts counting down once Increment has elapsed */
+	ClockSimpleDelay ClockMode = "delay"
+)
+
+/*
+ * A TimeControl with a zero Base is untimed. For the delay modes Increment
+ * holds the delay rather than a bonus.
+ */
+type TimeControl struct {
+	Base      time.Duration
+	Increment time.Duration
+	Mode      ClockMode
+}
+
+func (tc TimeControl) Timed() bool {
+	return tc.Base > 0
+}
+
+/* Clock values sent to clients, in milliseconds */
+type ClockUpdate struct {
+	WhiteMs     int64     `json:"white_ms"`
+	BlackMs     int64     `json:"black_ms"`
+	Running     bool      `json:"running"`
+	Turn        string    `json:"turn"`
+	BaseMs      int64     `json:"base_ms"`
+	IncrementMs int64     `json:"increment_ms"`
+	Mode        ClockMode `json:"mode"`
+}
+
+/*
+ * GameClock tracks the remaining time of both sides. It only ever gets
+ * touched from the goroutine running the game, so no locking is needed.
+ * The clock starts running once the first move has been made.
+ */
+type GameClock struct {
+	TimeControl    TimeControl
+	WhiteRemaining time.Duration
+	BlackRemaining time.Duration
+	Running        bool
+	Turn           chess.Color
+	TurnStart      time.Time
+}
+
+func NewGameClock(tc TimeControl) GameClock {
+	if tc.Mode == "" {
+		tc.Mode = ClockFischer
+	}
+	return GameClock{
+		TimeControl:    tc,
+		WhiteRemaining: tc.Base,
+		BlackRemaining: tc.Base,
+		Turn:           chess.White,
+	}
+}
+
+func (c *GameClock) remaining(color chess.Color) *time.Duration {
+	if color == chess.White {
+		return &c.WhiteRemaining
+	}
+	return &c.BlackRemaining
+}
+
+/* Time the side to move has used on the current move, net of any delay */
+func (c *GameClock) charged(now time.Time) time.Duration {
+	elapsed := now.Sub(c.TurnStart)
+	if c.TimeControl.Mode == ClockSimpleDelay {
+		elapsed -= c.TimeControl.Increment
+		if elapsed < 0 {
+			elapsed = 0
+		}
+	}
+	return elapsed
+}
+
+/* Remaining time of color as of now, never negative */
+func (c *GameClock) Remaining(color chess.Color, now time.Time) time.Duration {
+	left := *c.remaining(color)
+	if c.Running && color == c.Turn {
+		left -= c.charged(now)
+	}
+	if left < 0 {
+		left = 0
+	}
+	return left
+}
+
+/* Returns true if the side to move has run out of time */
+func (c *GameClock) Flagged(now time.Time) bool {
+	return c.TimeControl.Timed() && c.Running && c.Remaining(c.Turn, now) <= 0
+}
+
+/* The moment the side to move will run out of time, if the clock is running */
+func (c *GameClock) Deadline() (time.Time, bool) {
+	if !c.TimeControl.Timed() || !c.Running {
+		return time.Time{}, false
+	}
+	deadline := c.TurnStart.Add(*c.remaining(c.Turn))
+	if c.TimeControl.Mode == ClockSimpleDelay {
+		deadline = deadline.Add(c.TimeControl.Increment)
+	}
+	return deadline, true
+}
+
+/*
+ * Punch is called after the side to move has made a move. It charges the
+ * mover for the time used, applies the increment or delay and hands the
+ * clock over to the opponent.
+ */
+func (c *GameClock) Punch(now time.Time) {
+	if !c.TimeControl.Timed() {
+		return
+	}
+	if c.Running {
+		elapsed := now.Sub(c.TurnStart)
+		left := c.remaining(c.Turn)
+		*left -= c.charged(now)
+		switch c.TimeControl.Mode {
+		case ClockFischer:
+			*left += c.TimeControl.Increment
+		case ClockBronstein:
+			if elapsed < c.TimeControl.Increment {
+				*left += elapsed
+			} else {
+				*left += c.TimeControl.Increment
+			}
+		}
+	} else {
+		/* The first move of the game starts the clock */
+		c.Running = true
+	}
+	c.Turn = c.Turn.Other()
+	c.TurnStart = now
+}
+
+/*
+ * Hands the clock to turn after moves have been taken back. The side that was
+ * to move is charged for the time it used, but gets no increment.
+ */
+func (c *GameClock) Rewind(turn chess.Color, now time.Time) {
+	if !c.TimeControl.Timed() {
+		return
+	}
+	if c.Running {
+		*c.remaining(c.Turn) = c.Remaining(c.Turn, now)
+	}
+	c.Turn = turn
+	c.TurnStart = now
+}
+
+/* Moves the start of the current turn later by d, so that time is not charged to anyone */
+func (c *GameClock) Pause(d time.Duration) {
+	if c.Running {
+		c.TurnStart = c.TurnStart.Add(d)
+	}
+}
+
+/* Freezes both clocks, e.g. once the game has ended */
+func (c *GameClock) Stop(now time.Time) {
+	if c.Running {
+		*c.remaining(c.Turn) = c.Remaining(c.Turn, now)
+		c.Running = false
+	}
+}
+
+func (c *GameClock) Snapshot(now time.Time) *ClockUpdate {
+	if !c.TimeControl.Timed() {
+		return nil
+	}
+	return &ClockUpdate{
+		WhiteMs:     c.Remaining(chess.White, now).Milliseconds(),
+		BlackMs:     c.Remaining(chess.Black, now).Milliseconds(),
+		Running:     c.Running,
+		Turn:        c.Turn.String(),
+		BaseMs:      c.TimeControl.Base.Milliseconds(),
+		IncrementMs: c.TimeControl.Increment.Milliseconds(),
+		Mode:        c.TimeControl.Mode,
+	}
+}
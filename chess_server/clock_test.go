@@ -0,0 +1,134 @@
+package chess_server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+var clockStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+/* Plays moves taking the given times, starting with white, and returns the clock */
+func playClock(tc TimeControl, thinking ...time.Duration) (GameClock, time.Time) {
+	clock := NewGameClock(tc)
+	now := clockStart
+	/* White's first move starts the clock */
+	clock.Punch(now)
+	for _, d := range thinking {
+		now = now.Add(d)
+		clock.Punch(now)
+	}
+	return clock, now
+}
+
+func TestClockModes(t *testing.T) {
+	cases := []struct {
+		name     string
+		tc       TimeControl
+		thinking []time.Duration
+		white    time.Duration
+		black    time.Duration
+	}{
+		{
+			name:     "fischer adds the increment after every move",
+			tc:       TimeControl{Base: time.Minute, Increment: 2 * time.Second, Mode: ClockFischer},
+			thinking: []time.Duration{5 * time.Second, 10 * time.Second},
+			white:    time.Minute - 10*time.Second + 2*time.Second,
+			black:    time.Minute - 5*time.Second + 2*time.Second,
+		},
+		{
+			name:     "bronstein gives back the time used",
+			tc:       TimeControl{Base: time.Minute, Increment: 3 * time.Second, Mode: ClockBronstein},
+			thinking: []time.Duration{2 * time.Second, 3 * time.Second},
+			white:    time.Minute,
+			black:    time.Minute,
+		},
+		{
+			name:     "bronstein gives back at most the increment",
+			tc:       TimeControl{Base: time.Minute, Increment: 3 * time.Second, Mode: ClockBronstein},
+			thinking: []time.Duration{10 * time.Second, time.Second},
+			white:    time.Minute,
+			black:    time.Minute - 7*time.Second,
+		},
+		{
+			name:     "simple delay charges nothing within the delay",
+			tc:       TimeControl{Base: time.Minute, Increment: 5 * time.Second, Mode: ClockSimpleDelay},
+			thinking: []time.Duration{4 * time.Second, 8 * time.Second},
+			white:    time.Minute - 3*time.Second,
+			black:    time.Minute,
+		},
+		{
+			name:     "untimed clocks never run",
+			tc:       TimeControl{},
+			thinking: []time.Duration{time.Hour},
+			white:    0,
+			black:    0,
+		},
+	}
+	for _, c := range cases {
+		clock, now := playClock(c.tc, c.thinking...)
+		if got := clock.Remaining(chess.White, now); got != c.white {
+			t.Errorf("%s: white has %s, want %s", c.name, got, c.white)
+		}
+		if got := clock.Remaining(chess.Black, now); got != c.black {
+			t.Errorf("%s: black has %s, want %s", c.name, got, c.black)
+		}
+	}
+}
+
+func TestClockFlagFall(t *testing.T) {
+	cases := []struct {
+		name    string
+		tc      TimeControl
+		elapsed time.Duration
+		flagged bool
+	}{
+		{"fischer before the flag", TimeControl{Base: time.Minute, Mode: ClockFischer}, time.Minute - time.Millisecond, false},
+		{"fischer at the flag", TimeControl{Base: time.Minute, Mode: ClockFischer}, time.Minute, true},
+		{"delay is not counted", TimeControl{Base: time.Minute, Increment: 5 * time.Second, Mode: ClockSimpleDelay}, time.Minute + 4*time.Second, false},
+		{"delay runs out too", TimeControl{Base: time.Minute, Increment: 5 * time.Second, Mode: ClockSimpleDelay}, time.Minute + 5*time.Second, true},
+		{"untimed", TimeControl{}, 24 * time.Hour, false},
+	}
+	for _, c := range cases {
+		clock, now := playClock(c.tc)
+		if got := clock.Flagged(now.Add(c.elapsed)); got != c.flagged {
+			t.Errorf("%s: flagged %t, want %t", c.name, got, c.flagged)
+		}
+		deadline, ok := clock.Deadline()
+		if ok != c.tc.Timed() {
+			t.Errorf("%s: deadline given %t", c.name, ok)
+		}
+		if ok && clock.Flagged(deadline.Add(-time.Millisecond)) {
+			t.Errorf("%s: flagged before the deadline %s", c.name, deadline)
+		}
+		if ok && !clock.Flagged(deadline) {
+			t.Errorf("%s: not flagged at the deadline %s", c.name, deadline)
+		}
+	}
+}
+
+func TestClockWaitsForFirstMove(t *testing.T) {
+	clock := NewGameClock(TimeControl{Base: time.Minute})
+	if clock.Flagged(clockStart.Add(time.Hour)) {
+		t.Error("clock ran before the first move")
+	}
+	if _, ok := clock.Deadline(); ok {
+		t.Error("deadline before the first move")
+	}
+}
+
+func TestClockStopAndPause(t *testing.T) {
+	clock, now := playClock(TimeControl{Base: time.Minute})
+	clock.Pause(10 * time.Second)
+	if got := clock.Remaining(chess.Black, now.Add(10*time.Second)); got != time.Minute {
+		t.Errorf("paused time was charged: %s left", got)
+	}
+	clock.Stop(now.Add(30 * time.Second))
+	if got := clock.Remaining(chess.Black, now.Add(time.Hour)); got != 40*time.Second {
+		t.Errorf("stopped clock has %s left, want 40s", got)
+	}
+	if clock.Flagged(now.Add(time.Hour)) {
+		t.Error("stopped clock flagged")
+	}
+}
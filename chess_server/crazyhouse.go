@@ -0,0 +1,86 @@
+package chess_server
+
+import (
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeCrazyhouse, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		return NewCrazyhouseBoard(options)
+	})
+}
+
+/*
+ * CrazyhouseBoard is the board of a crazyhouse game. Captured pieces change
+ * color and go into the capturer's pocket, from where they can be dropped
+ * instead of making a regular move. Promoted pieces go back to being pawns
+ * when captured.
+ */
+type CrazyhouseBoard struct {
+	positionGame
+}
+
+func NewCrazyhouseBoard(options GameNewUpdate) (*CrazyhouseBoard, error) {
+	start, err := startingPosition(options, StartingFEN, StandardMoves)
+	if err != nil {
+		return nil, err
+	}
+	return &CrazyhouseBoard{newPositionGame(start)}, nil
+}
+
+func (b *CrazyhouseBoard) FEN() string {
+	return b.Position.FEN(true)
+}
+
+/* Parses a move in SAN, UCI or drop notation (N@f3) and plays it */
+func (b *CrazyhouseBoard) ApplyMove(move string) error {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return err
+	}
+	captured, promoted := b.Position.Captured(m)
+	next := b.Position.Play(m)
+	if captured != chess.NoPiece {
+		t := captured.Type()
+		if promoted {
+			t = chess.Pawn
+		}
+		next.Pockets[b.Position.Turn][t] += 1
+	}
+	b.play(next)
+	return nil
+}
+
+/*
+ * Checkmate and stalemate work as in regular chess, with drops counting as
+ * moves. Since material never leaves the game there is no insufficient
+ * material or fifty move rule, but a fivefold repetition is a draw.
+ */
+func (b *CrazyhouseBoard) Outcome() (chess.Outcome, string) {
+	if b.Decided != chess.NoOutcome {
+		return b.Decided, b.DecidedBy
+	}
+	if outcome, method := b.mateOutcome(); outcome != chess.NoOutcome {
+		return outcome, method
+	}
+	if b.repetitions() >= 5 {
+		return chess.Draw, "fivefold_repetition"
+	}
+	return chess.NoOutcome, ""
+}
+
+/* Material never leaves the game, so the opponent can always still mate */
+func (b *CrazyhouseBoard) HasMatingMaterial(color chess.Color) bool {
+	return true
+}
+
+func (b *CrazyhouseBoard) AddSyncState(update *GameSyncUpdate) {
+	update.Pockets = []PocketUpdate{pocketUpdate(b.Position)}
+}
+
+func (b *CrazyhouseBoard) AddMoveState(update *GameMoveUpdate) {
+	update.Pockets = []PocketUpdate{pocketUpdate(b.Position)}
+}
+
+func (b *CrazyhouseBoard) Setup(options *GameNewUpdate) {
+}
@@ -0,0 +1,174 @@
+package chess_server
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+/*
+ * Broadcasts that are not part of the history of a game: snapshots restate
+ * it and countdowns tick every second
+ */
+var transientUpdates = map[string]bool{
+	"snapshot_update":     true,
+	"reconnect_countdown": true,
+}
+
+/* An update broadcast to a game, numbered from 1 in the order they were sent */
+type GameEvent struct {
+	Seq    uint64     `json:"seq"`
+	Type   string     `json:"type"`
+	Time   time.Time  `json:"time"`
+	Update GameUpdate `json:"update"`
+}
+
+/* Events read back from the game log keep their update as raw JSON */
+func (e *GameEvent) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Seq    uint64          `json:"seq"`
+		Type   string          `json:"type"`
+		Time   time.Time       `json:"time"`
+		Update json.RawMessage `json:"update"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	e.Seq, e.Type, e.Time, e.Update = raw.Seq, raw.Type, raw.Time, raw.Update
+	return nil
+}
+
+/* The update of the event as the type it was sent as */
+func (e *GameEvent) Decode() (GameUpdate, error) {
+	data, ok := e.Update.(json.RawMessage)
+	if !ok {
+		return e.Update, nil
+	}
+	update, _, err := UnmarshalUpdate(WSMessage{T: e.Type, Update: data})
+	return update, err
+}
+
+/* Sent by a client to get the events after since again */
+type GameEventsSinceUpdate struct {
+	Since uint64 `json:"since"`
+}
+
+type GameEventsRequest struct {
+	GameId uint64
+	Since  uint64
+}
+
+type GameEventsResponse struct {
+	Events []GameEvent
+	Error  error
+}
+
+/* The events of a live game after since, oldest first */
+func (c *ChessGamesControllerChannel) GameEvents(gameId uint64, since uint64) ([]GameEvent, error) {
+	response := make(chan interface{})
+	c.C <- ChessGamesControllerRequest{Update: GameEventsRequest{GameId: gameId, Since: since}, Response: response}
+	ret := (<-response).(GameEventsResponse)
+	close(response)
+	return ret.Events, ret.Error
+}
+
+func (g *ChessGamesController) gameEvents(gameId uint64, since uint64) ([]GameEvent, error) {
+	game, ok := g.Games[gameId]
+	if !ok {
+		return nil, errors.New("Invalid Game Id")
+	}
+	return game.EventsSince(since)
+}
+
+/* Numbers update and adds it to the events of the game. The caller holds StreamsLock. */
+func (g *ChessGame) recordEvent(update GameUpdate, T string, now time.Time) GameEvent {
+	/* Events keep the name their update has always been sent under */
+	if name, err := messageType(update); err == nil {
+		T = name
+	}
+	event := GameEvent{
+		Seq:    uint64(len(g.EventLog)) + 1,
+		Type:   T,
+		Time:   now,
+		Update: update,
+	}
+	g.EventLog = append(g.EventLog, event)
+	return event
+}
+
+/* Number of the last event so far, 0 before the first */
+func (g *ChessGame) LastSeq() uint64 {
+	g.StreamsLock.Lock()
+	defer g.StreamsLock.Unlock()
+	return uint64(len(g.EventLog))
+}
+
+func (g *ChessGame) EventsSince(since uint64) ([]GameEvent, error) {
+	g.StreamsLock.Lock()
+	defer g.StreamsLock.Unlock()
+	return g.eventsSince(since)
+}
+
+/* Like EventsSince, for callers that hold StreamsLock */
+func (g *ChessGame) eventsSince(since uint64) ([]GameEvent, error) {
+	if since > uint64(len(g.EventLog)) {
+		return nil, errors.New("No such event")
+	}
+	return append([]GameEvent{}, g.EventLog[since:]...), nil
+}
+
+/*
+ * A stream for a connection joining the game, holding the events after since
+ * if the connection gave it. The caller holds StreamsLock.
+ */
+func (g *ChessGame) catchUpStream(since *uint64) chan struct {
+	GameUpdate
+	string
+} {
+	missed := []GameEvent{}
+	if since != nil {
+		/* Joins check since first, and events are never taken away */
+		missed, _ = g.eventsSince(*since)
+	}
+	stream := make(chan struct {
+		GameUpdate
+		string
+	}, 128+len(missed))
+	for _, event := range missed {
+		stream <- struct {
+			GameUpdate
+			string
+		}{event, event.Type}
+	}
+	return stream
+}
+
+/*
+ * Plays a logged action again at the time it was first taken. What followed
+ * from it, like the result, is worked out again.
+ */
+func (g *ChessGame) replayAction(action GameEvent) error {
+	update, err := action.Decode()
+	if err != nil {
+		return err
+	}
+	switch update := update.(type) {
+	case GameMoveUpdate:
+		return g.makeMove(update, action.Time)
+	case GameResignUpdate:
+		return g.resign(update)
+	case GameDrawOfferUpdate:
+		return g.offerDraw(update)
+	case GameDrawAcceptUpdate:
+		return g.acceptDraw(update)
+	case GameDrawDeclineUpdate:
+		return g.declineDraw(update)
+	case GameTakebackRequestUpdate:
+		return g.requestTakeback(update)
+	case GameTakebackAcceptUpdate:
+		return g.acceptTakeback(update, action.Time)
+	case GameTakebackDeclineUpdate:
+		return g.declineTakeback(update)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package chess_server
+
+import (
+	"testing"
+)
+
+func TestEventsKeepMessageTypes(t *testing.T) {
+	var controller ChessGamesController
+	controller.Init()
+	game, err := controller.createGame(0, 0, GameNewUpdate{Mode: ModeStandard}, clockStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	game.BroadcastUpdate(GameSpectatorLeftUpdate{GameId: 0, SpectatorId: 3}, "spectator_left")
+	game.BroadcastUpdate(GameReconnectUpdate{GameId: 0, PlayerId: 1, RemainingMs: 1000}, "reconnect_countdown")
+	game.BroadcastUpdate(GameResignUpdate{GameId: 0, PlayerId: 1}, "resign")
+	events, err := game.EventsSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* Countdowns are not events */
+	if len(events) != 2 {
+		t.Fatalf("%d events, want 2", len(events))
+	}
+	for i, want := range []string{"spectator_left_update", "resign"} {
+		if events[i].Type != want || events[i].Seq != uint64(i+1) {
+			t.Errorf("event %d is %d %s, want %s", i+1, events[i].Seq, events[i].Type, want)
+		}
+	}
+	if _, err := game.EventsSince(3); err == nil {
+		t.Error("events after the last one")
+	}
+}
+
+func TestJoinSnapshotFromGame(t *testing.T) {
+	var controller ChessGamesController
+	controller.Init()
+	game, err := controller.createGame(0, 0, GameNewUpdate{Mode: ModeStandard}, clockStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.Games[0] = game
+	if err := game.newSeatTokens(); err != nil {
+		t.Fatal(err)
+	}
+	join := GamePlayerJoinedUpdate{GameId: 0, PlayerId: 0, Token: game.SeatTokens[0]}
+	_, first, err := controller.playerJoin(join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := controller.playerJoin(join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* The controller leaves the snapshot to the game */
+	if len(second) != 0 {
+		t.Fatalf("%d updates before the game sent the snapshot", len(second))
+	}
+	if _, open := <-first; open {
+		t.Fatal("replaced stream still open")
+	}
+	game.startStream(GameStreamRequest{GameId: 0, PlayerId: 0, Stream: first}, clockStart)
+	game.startStream(GameStreamRequest{GameId: 0, PlayerId: 0, Stream: second}, clockStart)
+	if game.PlayerStreams[0] != second {
+		t.Fatal("stream not added after the snapshot")
+	}
+	game.BroadcastUpdate(GameResignUpdate{GameId: 0, PlayerId: 1}, "resign")
+	for _, want := range []string{"snapshot_update", "resign"} {
+		if update := <-second; update.string != want {
+			t.Errorf("got %s, want %s", update.string, want)
+		}
+	}
+
+	spectatorId, _, spectator, err := controller.spectatorJoin(GameSpectatorJoinUpdate{GameId: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !game.connected() || len(spectator) != 0 {
+		t.Fatal("spectator not waiting for the snapshot")
+	}
+	game.startStream(GameStreamRequest{GameId: 0, SpectatorId: spectatorId, Spectator: true, Stream: spectator}, clockStart)
+	if update := <-spectator; update.string != "snapshot_update" || update.GameUpdate.(GameSyncUpdate).Seq != game.LastSeq() {
+		t.Errorf("spectator got %s, want the snapshot after event %d", update.string, game.LastSeq())
+	}
+}
@@ -1,10 +1,14 @@
 package chess_server
 
 import (
+	"crypto/subtle"
 	"errors"
 	"strings"
+	"sync"
+	"time"
     "fmt"
 	"github.com/notnil/chess"
+	"github.com/labstack/gommon/log"
 )
 
 // WS messages
@@ -13,30 +17,258 @@ type GameUpdate interface {
 }
 
 type GameNewUpdate struct {
+	Mode          string
+	TimeControl   TimeControl
+	/* Random opening games pick one from the pool if this is not set */
+	Opening       *Opening
+	/* Chess960 start position number, or RandomStartPosition */
+	StartPosition int
+	/* Position to start from instead of the variant's own, for custom games */
+	FEN           string
+	/* Names the players are rated under, two player games between named players are rated */
+	WhiteUser     string
+	BlackUser     string
 }
 
+/* Names the player of color as the one rated for it */
+func (u *GameNewUpdate) SetUser(color chess.Color, user string) {
+	if color == chess.White {
+		u.WhiteUser = user
+	} else {
+		u.BlackUser = user
+	}
+}
+
+func (u GameNewUpdate) User(color chess.Color) string {
+	if color == chess.White {
+		return u.WhiteUser
+	}
+	return u.BlackUser
+}
+
+/* Pieces in hand keyed by FEN letter, upper case for white */
+type PocketUpdate map[string]int
+
+func pocketUpdate(pos *Position) PocketUpdate {
+	pocket := PocketUpdate{}
+	for _, color := range []chess.Color{chess.White, chess.Black} {
+		for _, t := range pocketTypes {
+			if n := pos.Pockets[color][t]; n > 0 {
+				pocket[fenLetter(makePiece(t, color))] = n
+			}
+		}
+	}
+	return pocket
+}
+
+/* State of one board of a multi-board game */
+type BoardSyncUpdate struct {
+	Board         int          `json:"board"`
+	WhitePlayerId uint64       `json:"white_player_id"`
+	BlackPlayerId uint64       `json:"black_player_id"`
+	FEN           string       `json:"fen"`
+	Clock         *ClockUpdate `json:"clock,omitempty"`
+	Turn          string       `json:"turn"`
+	/* Legal moves in UCI, none once the game is over */
+	LegalMoves    []string     `json:"legal_moves"`
+	Check         bool         `json:"check"`
+}
+
+/* A seat of a game and whether its player is there */
+type PlayerStatus struct {
+	PlayerId  uint64 `json:"player_id"`
+	Board     int    `json:"board,omitempty"`
+	Color     string `json:"color"`
+	User      string `json:"user,omitempty"`
+	Connected bool   `json:"connected"`
+	/* Time a player who dropped out has left to come back */
+	ReconnectMs *int64 `json:"reconnect_ms,omitempty"`
+}
+
+/*
+ * The top level player ids, FEN and clock always describe board 0. Games
+ * with more than one board list all of them in Boards.
+ */
 type GameSyncUpdate struct {
 	GameId        uint64 `json:"game_id"`
+	Mode          string `json:"mode"`
 	WhitePlayerId uint64 `json:"white_player_id"`
 	BlackPlayerId uint64 `json:"black_player_id"`
+	WhiteUser     string `json:"white_user,omitempty"`
+	BlackUser     string `json:"black_user,omitempty"`
 	FEN           string `json:"fen"`
+	/* Position the game started from */
+	StartFEN      string `json:"start_fen,omitempty"`
+	Clock         *ClockUpdate `json:"clock,omitempty"`
+	/* Side to move, its legal moves in UCI (none once the game is over) and whether it is in check */
+	Turn          string   `json:"turn"`
+	LegalMoves    []string `json:"legal_moves"`
+	Check         bool     `json:"check"`
+	/* Every move played since StartFEN, on all boards */
+	Moves         []PlayedMove   `json:"moves"`
+	Players       []PlayerStatus `json:"players"`
+	Pockets       []PocketUpdate    `json:"pockets,omitempty"`
+	Boards        []BoardSyncUpdate `json:"boards,omitempty"`
+	Opening       *OpeningUpdate    `json:"opening,omitempty"`
+	/* Chess960 start position number */
+	StartPosition *int              `json:"start_position,omitempty"`
+	/* Three-check: checks given so far, keyed by color */
+	Checks        map[string]int    `json:"checks,omitempty"`
+	/* Number of the last event the snapshot takes into account */
+	Seq           uint64            `json:"seq"`
 }
 
 type GameMoveUpdate struct {
 	GameId      uint64 `json:"game_id"`
+	Board       int    `json:"board"`
+	/*
+	 * Clients may send moves in UCI, SAN or LAN. The server sends them on in
+	 * the notation each connection asked for, UCI unless it asked otherwise,
+	 * and always adds the UCI and SAN.
+	 */
 	Move        string `json:"move"`
+	UCI         string `json:"uci,omitempty"`
+	SAN         string `json:"san,omitempty"`
+	LAN         string `json:"lan,omitempty"`
 	PlayerId    uint64 `json:"player_id"`
 	PlayerColor string `json:"player_color"`
 	FEN         string `json:"fen"`
+	Clock       *ClockUpdate `json:"clock,omitempty"`
+	/* Pockets of every board, indexed by board */
+	Pockets     []PocketUpdate `json:"pockets,omitempty"`
+	/* Three-check: checks given so far, keyed by color */
+	Checks      map[string]int `json:"checks,omitempty"`
 }
 
 func (u GameMoveUpdate) Type() string {
 	return "move_update"
 }
 
+/* Notations a client can ask to get moves in */
+const (
+	NotationUCI = "uci"
+	NotationSAN = "san"
+	NotationLAN = "lan"
+)
+
+func validNotation(notation string) bool {
+	switch notation {
+	case "", NotationUCI, NotationSAN, NotationLAN:
+		return true
+	}
+	return false
+}
+
+/* Writes a move that was played in canonical UCI, with the other notations alongside */
+func (u *GameMoveUpdate) setNotation(notation MoveNotation) {
+	u.Move = notation.UCI
+	u.UCI, u.SAN, u.LAN = notation.UCI, notation.SAN, notation.LAN
+}
+
+/*
+ * The update as a connection that asked for notation gets it. Only moves
+ * change; moves logged before the server knew all notations keep theirs.
+ */
+func inNotation(update GameUpdate, notation string) GameUpdate {
+	switch update := update.(type) {
+	case GameMoveUpdate:
+		switch {
+		case notation == NotationSAN && update.SAN != "":
+			update.Move = update.SAN
+		case notation == NotationLAN && update.LAN != "":
+			update.Move = update.LAN
+		}
+		return update
+	case GameEvent:
+		if decoded, err := update.Decode(); err == nil {
+			if move, ok := decoded.(GameMoveUpdate); ok {
+				update.Update = inNotation(move, notation)
+			}
+		}
+		return update
+	}
+	return update
+}
+
+type GameResignUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+type GameDrawOfferUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+type GameDrawAcceptUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+type GameDrawDeclineUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+type GameTakebackRequestUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+type GameTakebackAcceptUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+type GameTakebackDeclineUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+/*
+ * For bughouse the result is given from the point of view of board 0, i.e.
+ * "1-0" means the white player of board 0 and their partner won. Board is
+ * the board the game was decided on.
+ */
+type GameRematchOfferUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+type GameRematchAcceptUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+type GameRematchDeclineUpdate struct {
+	GameId   uint64 `json:"game_id"`
+	PlayerId uint64 `json:"player_id"`
+}
+
+/* Tells everyone in a finished game where the rematch is being played */
+type GameRematchUpdate struct {
+	GameId    uint64 `json:"game_id"`
+	NewGameId uint64 `json:"new_game_id"`
+}
+
+/*
+ * Sent every second while a player who dropped out of an unfinished game can
+ * still come back
+ */
+type GameReconnectUpdate struct {
+	GameId      uint64 `json:"game_id"`
+	PlayerId    uint64 `json:"player_id"`
+	RemainingMs int64  `json:"remaining_ms"`
+}
+
 type GameResultUpdate struct {
-	Result string `json:"result"`
-	FEN    string `json:"fen"`
+	Result string       `json:"result"`
+	Method string       `json:"method"`
+	Board  int          `json:"board"`
+	FEN    string       `json:"fen"`
+	Clock  *ClockUpdate `json:"clock,omitempty"`
+	/* New ratings of rated games, keyed by color */
+	RatingChanges map[string]RatingChange `json:"rating_changes,omitempty"`
 }
 
 func (u GameResultUpdate) Type() string {
@@ -57,9 +289,13 @@ func (c *ChessGamesControllerChannel) PlayerJoin(update GamePlayerJoinedUpdate)
 }, error) {
 	response := make(chan interface{})
 	c.C <- ChessGamesControllerRequest{Update: update, Response: response}
-	ret := <-response
+	ret := (<-response).(PlayerJoinResponse)
 	close(response)
-	return ret.(PlayerJoinResponse).EventsIn, ret.(PlayerJoinResponse).EventsOut, ret.(PlayerJoinResponse).Error
+	if ret.Error == nil && update.Since == nil {
+		/* The game builds the snapshot itself, so the clock is only read on its goroutine */
+		ret.EventsIn.C <- ChessGamesControllerRequest{Update: GameStreamRequest{GameId: update.GameId, PlayerId: update.PlayerId, Stream: ret.EventsOut}}
+	}
+	return ret.EventsIn, ret.EventsOut, ret.Error
 }
 
 func (c *ChessGameChannel) PlayerLeave(update GamePlayerLeftUpdate) {
@@ -74,9 +310,12 @@ func (c *ChessGamesControllerChannel) SpectatorJoin(update GameSpectatorJoinUpda
 }, error) {
 	response := make(chan interface{})
 	c.C <- ChessGamesControllerRequest{Update: update, Response: response}
-	ret := <-response
+	ret := (<-response).(SpectatorJoinResponse)
 	close(response)
-	return ret.(SpectatorJoinResponse).SpectatorId, ret.(SpectatorJoinResponse).EventsIn, ret.(SpectatorJoinResponse).EventsOut, ret.(SpectatorJoinResponse).Error
+	if ret.Error == nil && update.Since == nil {
+		ret.EventsIn.C <- ChessGamesControllerRequest{Update: GameStreamRequest{GameId: update.GameId, SpectatorId: ret.SpectatorId, Spectator: true, Stream: ret.EventsOut}}
+	}
+	return ret.SpectatorId, ret.EventsIn, ret.EventsOut, ret.Error
 }
 
 func (c *ChessGameChannel) SpectatorLeave(update GameSpectatorLeftUpdate) {
@@ -90,6 +329,51 @@ type ChessGameChannel struct {
 }
 
 func (c *ChessGameChannel) MakeMove(update GameMoveUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) Resign(update GameResignUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) OfferDraw(update GameDrawOfferUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) AcceptDraw(update GameDrawAcceptUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) DeclineDraw(update GameDrawDeclineUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) RequestTakeback(update GameTakebackRequestUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) AcceptTakeback(update GameTakebackAcceptUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) DeclineTakeback(update GameTakebackDeclineUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) OfferRematch(update GameRematchOfferUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) AcceptRematch(update GameRematchAcceptUpdate) error {
+	return c.request(update)
+}
+
+func (c *ChessGameChannel) DeclineRematch(update GameRematchDeclineUpdate) error {
+	return c.request(update)
+}
+
+/* Sends an update to the game and waits for it to be accepted or rejected */
+func (c *ChessGameChannel) request(update GameUpdate) error {
 	response := make(chan interface{})
 	c.C <- ChessGamesControllerRequest{Update: update, Response: response}
 	err := <-response
@@ -117,6 +401,29 @@ type ChessGamesController struct {
 	NextAvailGameId      uint64
 	NextAvailPlayerId    uint64
 	NextAvailSpectatorId uint64
+	/* Starting positions for random opening games, nil if none were loaded */
+	Openings             *OpeningPool
+	/* Where games between named players report their results */
+	Ratings              *RatingController
+	/* How long players who drop out of a game have to come back, 0 to wait forever */
+	ReconnectGrace       time.Duration
+	/* Where finished games are kept */
+	Archive              *GameArchive
+	/* Where live games are written so they survive a restart, nil to keep them in memory only */
+	Log                  *GameLog
+}
+
+/* Default time players have to reconnect before they forfeit */
+const DefaultReconnectGrace = time.Minute
+
+/* Games abandoned before this many half moves are aborted instead of forfeited */
+const AbortPlies = 2
+
+/* A place at a board in a game */
+type Seat struct {
+	PlayerId uint64
+	Board    int
+	Color    chess.Color
 }
 
 /*
@@ -125,33 +432,97 @@ type ChessGamesController struct {
  */
 type ChessGame struct {
 	GameId            uint64
-	GameState         *chess.Game
+	Mode              string
+	/* Rules and board of single board games, nil for bughouse */
+	Variant           Variant
+	/* FEN the game started from and whether it was set up by the players */
+	StartFEN          string
+	CustomStart       bool
 	WhitePlayerId     uint64
 	BlackPlayerId     uint64
+	/* Names the players are rated under, if any */
+	WhiteUser         string
+	BlackUser         string
+	Ratings           *RatingController
+	RatingsReported   bool
+	Archive           *GameArchive
+	Archived          bool
+	/* Where the moves are written as they are made, nil while the game is replayed */
+	Log               *GameLog
+	Started           time.Time
+	/* Moves the players made so far, on every board */
+	Moves             []PlayedMove
+	Clock             GameClock
+	Seats             []Seat
+	/*
+	 * Secret each player has to show to take their seats, by player id. Only
+	 * the player matched to the seat is told it. A game rebuilt from the log
+	 * only has the hashes.
+	 */
+	SeatTokens        map[uint64]string
+	SeatTokenHashes   map[uint64]string
+
+	/* Both boards of a bughouse game, nil for other modes */
+	Bughouse          *BughouseMatch
+
+	/*
+	 * Set when the game is decided by something other than the position on
+	 * the board, like running out of time or a resignation
+	 */
+	Outcome           chess.Outcome
+	Method            string
+	/* Called off without a result, e.g. abandoned before both sides moved */
+	Aborted           bool
+
+	/* Color of the player with an outstanding draw offer, if any */
+	DrawOfferedBy     chess.Color
+
+	/* Number of unanswered takeback requests per color */
+	PendingTakebacks  map[chess.Color]int
+
+	/* Color of the player who asked for a rematch once the game is over */
+	RematchOfferedBy  chess.Color
 
     Events            ChessGameChannel
     
     /* Used to signal to the controller thread to delete this game */
     ControllerRequests *ChessGamesControllerChannel
 
-	WhitePlayerStream chan struct {
+	/*
+	 * Players and spectators join through the controller goroutine while the
+	 * game goroutine broadcasts, so the streams are guarded by StreamsLock
+	 */
+	StreamsLock       sync.Mutex
+	PlayerStreams     map[uint64]chan struct {
 		GameUpdate
 		string
 	}
-	BlackPlayerStream chan struct {
+	PlayerConnected   map[uint64]bool
+	/* Set once the game has stopped, after which joins are turned away */
+	Closed            bool
+	/* Streams of players who joined but have not been sent the game yet */
+	JoiningStreams    map[uint64]chan struct {
 		GameUpdate
 		string
 	}
-	WhitePlayerConnected bool
-	BlackPlayerConnected bool
+	/*
+	 * When each player who dropped out of the unfinished game forfeits if they
+	 * do not come back, and when the next countdown is due
+	 */
+	ReconnectGrace    time.Duration
+	Disconnected      map[uint64]time.Time
+	NextCountdown     time.Time
 	SpectatorStreams     map[uint64]chan struct {
 		GameUpdate
 		string
 	}
+	/* Everything broadcast so far, see GameEvent */
+	EventLog          []GameEvent
 }
 
 func (g *ChessGamesController) Init() {
 	g.Games = make(map[uint64]*ChessGame)
+	g.ReconnectGrace = DefaultReconnectGrace
 	g.Events.C = make(chan ChessGamesControllerRequest)
 }
 
@@ -165,6 +536,11 @@ type SpectatorJoinResponse struct {
 	Error error
 }
 
+type GameNewResponse struct {
+	Game  *ChessGame
+	Error error
+}
+
 type PlayerJoinResponse struct {
     EventsIn *ChessGameChannel
 	EventsOut chan struct {
@@ -181,18 +557,24 @@ func (g *ChessGamesController) Run() {
 		response := request.Response
 		switch update.(type) {
 		case GameNewUpdate:
-			response <- g.addNewGame()
+			newUpdate := update.(GameNewUpdate)
+			game, err := g.addNewGame(newUpdate)
+			response <- GameNewResponse{Game: game, Error: err}
 		case GamePlayerJoinedUpdate:
 			playerJoinedUpdate := update.(GamePlayerJoinedUpdate)
-			eventsIn, eventsOut, err := g.playerJoin(playerJoinedUpdate.GameId, playerJoinedUpdate.PlayerId)
+			eventsIn, eventsOut, err := g.playerJoin(playerJoinedUpdate)
             response <- PlayerJoinResponse{EventsIn: eventsIn, EventsOut: eventsOut, Error: err}	
 		case GameSpectatorJoinUpdate:
 			spectatorJoinUpdate := update.(GameSpectatorJoinUpdate)
-			spectatorId, eventsIn, eventsOut, err := g.spectatorJoin(spectatorJoinUpdate.GameId)
+			spectatorId, eventsIn, eventsOut, err := g.spectatorJoin(spectatorJoinUpdate)
             response <- SpectatorJoinResponse{SpectatorId: spectatorId, EventsIn: eventsIn, EventsOut: eventsOut, Error: err}	
         case GameDeleteRequest:
             deleteRequest := update.(GameDeleteRequest)
             g.deleteGame(deleteRequest.GameId)
+		case GameEventsRequest:
+			eventsRequest := update.(GameEventsRequest)
+			events, err := g.gameEvents(eventsRequest.GameId, eventsRequest.Since)
+			response <- GameEventsResponse{Events: events, Error: err}
 		default:
             /* log error ? */
 			continue
@@ -200,12 +582,12 @@ func (g *ChessGamesController) Run() {
 	}
 }
 
-func (c *ChessGamesControllerChannel) AddNewGame() *ChessGame {
+func (c *ChessGamesControllerChannel) AddNewGame(options GameNewUpdate) (*ChessGame, error) {
 	response := make(chan interface{})
-	c.C <- ChessGamesControllerRequest{Update: GameNewUpdate{}, Response: response}
-	game := <-response
+	c.C <- ChessGamesControllerRequest{Update: options, Response: response}
+	newGame := (<-response).(GameNewResponse)
 	close(response)
-	return game.(*ChessGame)
+	return newGame.Game, newGame.Error
 }
 
 func (c *ChessGamesControllerChannel) DeleteNewGame(gameId uint64) {
@@ -214,20 +596,88 @@ func (c *ChessGamesControllerChannel) DeleteNewGame(gameId uint64) {
 
 func (g *ChessGame) Run() {
     fmt.Println("Starting game")
-    for !g.Finished() || g.WhitePlayerConnected && g.BlackPlayerConnected || len(g.SpectatorStreams) > 0 {
-        request := <-g.Events.C
+    for g.live() {
+        /* Wake up when the side to move runs out of time, even if nobody sends anything */
+        var flagTimer *time.Timer
+        var flagFall <-chan time.Time
+        if deadline, ok := g.deadline(); ok && !g.Finished() {
+            flagTimer = time.NewTimer(time.Until(deadline))
+            flagFall = flagTimer.C
+        }
+        /* Likewise for the countdown of players who dropped out */
+        var reconnectTimer *time.Timer
+        var reconnectDue <-chan time.Time
+        if deadline, ok := g.reconnectDeadline(time.Now()); ok {
+            reconnectTimer = time.NewTimer(time.Until(deadline))
+            reconnectDue = reconnectTimer.C
+        }
+        var request ChessGamesControllerRequest
+        select {
+        case request = <-g.Events.C:
+            if flagTimer != nil {
+                flagTimer.Stop()
+            }
+            if reconnectTimer != nil {
+                reconnectTimer.Stop()
+            }
+        case <-flagFall:
+            if reconnectTimer != nil {
+                reconnectTimer.Stop()
+            }
+            g.checkFlag(time.Now())
+            continue
+        case <-reconnectDue:
+            if flagTimer != nil {
+                flagTimer.Stop()
+            }
+            g.checkReconnects(time.Now())
+            continue
+        }
         update := request.Update
         response := request.Response
         switch update.(type) {
         case GameMoveUpdate:
 		    moveUpdate := update.(GameMoveUpdate)
-		    response <- g.makeMove(moveUpdate)
+		    response <- g.makeMove(moveUpdate, time.Now())
+        case GameResignUpdate:
+            resignUpdate := update.(GameResignUpdate)
+            response <- g.resign(resignUpdate)
+        case GameDrawOfferUpdate:
+            drawOfferUpdate := update.(GameDrawOfferUpdate)
+            response <- g.offerDraw(drawOfferUpdate)
+        case GameDrawAcceptUpdate:
+            drawAcceptUpdate := update.(GameDrawAcceptUpdate)
+            response <- g.acceptDraw(drawAcceptUpdate)
+        case GameDrawDeclineUpdate:
+            drawDeclineUpdate := update.(GameDrawDeclineUpdate)
+            response <- g.declineDraw(drawDeclineUpdate)
+        case GameTakebackRequestUpdate:
+            takebackRequestUpdate := update.(GameTakebackRequestUpdate)
+            response <- g.requestTakeback(takebackRequestUpdate)
+        case GameTakebackAcceptUpdate:
+            takebackAcceptUpdate := update.(GameTakebackAcceptUpdate)
+            response <- g.acceptTakeback(takebackAcceptUpdate, time.Now())
+        case GameTakebackDeclineUpdate:
+            takebackDeclineUpdate := update.(GameTakebackDeclineUpdate)
+            response <- g.declineTakeback(takebackDeclineUpdate)
+        case GameRematchOfferUpdate:
+            rematchOfferUpdate := update.(GameRematchOfferUpdate)
+            response <- g.offerRematch(rematchOfferUpdate)
+        case GameRematchAcceptUpdate:
+            rematchAcceptUpdate := update.(GameRematchAcceptUpdate)
+            response <- g.acceptRematch(rematchAcceptUpdate)
+        case GameRematchDeclineUpdate:
+            rematchDeclineUpdate := update.(GameRematchDeclineUpdate)
+            response <- g.declineRematch(rematchDeclineUpdate)
         case GamePlayerLeftUpdate:
 			playerLeftUpdate := update.(GamePlayerLeftUpdate)
-			g.playerLeave(playerLeftUpdate.GameId, playerLeftUpdate.PlayerId)
+			g.playerLeave(playerLeftUpdate)
         case GameSpectatorLeftUpdate:
 			spectatorLeftUpdate := update.(GameSpectatorLeftUpdate)
 			g.spectatorLeave(spectatorLeftUpdate.GameId, spectatorLeftUpdate.SpectatorId)	
+        case GameStreamRequest:
+            streamRequest := update.(GameStreamRequest)
+            g.startStream(streamRequest, time.Now())
         default:
             /* log error ? */
             continue
@@ -239,18 +689,85 @@ func (g *ChessGame) Run() {
 }
 
 func (g *ChessGamesController) GetGameSyncUpdate(gameId uint64) GameSyncUpdate {
-	game := g.Games[gameId]
-	return GameSyncUpdate{
-		GameId:        gameId,
-		WhitePlayerId: game.WhitePlayerId,
-		BlackPlayerId: game.BlackPlayerId,
-		FEN:           g.GetFEN(gameId),
+	return g.Games[gameId].SyncUpdate()
+}
+
+/* Everything a client needs to show the game as it is now */
+func (g *ChessGame) SyncUpdate() GameSyncUpdate {
+	now := time.Now()
+	var update GameSyncUpdate
+	if g.Bughouse != nil {
+		update = g.Bughouse.SyncUpdate(g.GameId, g.Mode)
+		update.StartFEN = StartingFEN
+	} else {
+		update = GameSyncUpdate{
+			GameId:        g.GameId,
+			Mode:          g.Mode,
+			WhitePlayerId: g.WhitePlayerId,
+			BlackPlayerId: g.BlackPlayerId,
+			WhiteUser:     g.WhiteUser,
+			BlackUser:     g.BlackUser,
+			FEN:           g.FEN(),
+			StartFEN:      g.StartFEN,
+			Clock:         g.Clock.Snapshot(now),
+			Turn:          g.turn().String(),
+			LegalMoves:    g.Variant.LegalMoves(),
+			Check:         g.Variant.InCheck(),
+		}
+		g.Variant.AddSyncState(&update)
+	}
+	if g.Finished() {
+		update.LegalMoves = []string{}
+		for i := range update.Boards {
+			update.Boards[i].LegalMoves = []string{}
+		}
 	}
+	update.Moves = append([]PlayedMove{}, g.Moves...)
+	g.StreamsLock.Lock()
+	update.Players = g.playerStatus(now)
+	update.Seq = uint64(len(g.EventLog))
+	g.StreamsLock.Unlock()
+	return update
+}
+
+/* Who sits in every seat and whether they are connected. The caller holds StreamsLock. */
+func (g *ChessGame) playerStatus(now time.Time) []PlayerStatus {
+	players := []PlayerStatus{}
+	for _, seat := range g.Seats {
+		status := PlayerStatus{
+			PlayerId:  seat.PlayerId,
+			Board:     seat.Board,
+			Color:     seat.Color.String(),
+			User:      g.SeatUser(seat),
+			Connected: g.PlayerConnected[seat.PlayerId],
+		}
+		if deadline, ok := g.Disconnected[seat.PlayerId]; ok {
+			remaining := deadline.Sub(now).Milliseconds()
+			if remaining < 0 {
+				remaining = 0
+			}
+			status.ReconnectMs = &remaining
+		}
+		players = append(players, status)
+	}
+	return players
 }
 
 func (g *ChessGamesController) GetFEN(gameId uint64) string {
-	game := g.Games[gameId]
-	return game.GameState.FEN()
+	return g.Games[gameId].FEN()
+}
+
+/* FEN of board 0 */
+func (g *ChessGame) FEN() string {
+	if g.Bughouse != nil {
+		return g.Bughouse.Boards[0].Position.FEN(true)
+	}
+	return g.Variant.FEN()
+}
+
+/* Side to move of a single board game */
+func (g *ChessGame) turn() chess.Color {
+	return g.Variant.Turn()
 }
 
 func (g *ChessGamesController) GetPlayerStream(gameId uint64, playerId uint64) (chan struct {
@@ -258,13 +775,12 @@ func (g *ChessGamesController) GetPlayerStream(gameId uint64, playerId uint64) (
 	string
 }, error) {
 	game := g.Games[gameId]
-	if playerId == game.WhitePlayerId {
-		return game.WhitePlayerStream, nil
-	} else if playerId == game.BlackPlayerId {
-		return game.BlackPlayerStream, nil
-	} else {
+	if _, ok := game.seat(playerId); !ok {
 		return nil, errors.New("Invalid Player Id")
 	}
+	game.StreamsLock.Lock()
+	defer game.StreamsLock.Unlock()
+	return game.PlayerStreams[playerId], nil
 }
 
 func (g *ChessGamesController) GetSpectatorStream(gameId uint64, spectatorId uint64) (chan struct {
@@ -272,6 +788,8 @@ func (g *ChessGamesController) GetSpectatorStream(gameId uint64, spectatorId uin
 	string
 }, error) {
 	game := g.Games[gameId]
+	game.StreamsLock.Lock()
+	defer game.StreamsLock.Unlock()
 	stream, ok := game.SpectatorStreams[spectatorId]
 	if !ok {
 		return nil, errors.New("Invalid Spectator Id")
@@ -282,84 +800,328 @@ func (g *ChessGamesController) GetSpectatorStream(gameId uint64, spectatorId uin
 type GamePlayerJoinedUpdate struct {
 	GameId   uint64 `json:"game_id"`
 	PlayerId uint64 `json:"player_id"`
+	/* Seat token from match_found, never sent on to the other players */
+	Token string `json:"token,omitempty"`
+	/* Account of the connection joining, set by the server from its session */
+	User string `json:"user,omitempty"`
+	/*
+	 * Number of the last event a reconnecting client has seen. If given, the
+	 * connection gets the events after it instead of a snapshot.
+	 */
+	Since *uint64 `json:"since,omitempty"`
+	/* Notation the connection wants moves in: uci (the default), san or lan */
+	Notation string `json:"notation,omitempty"`
 }
 
 type GamePlayerLeftUpdate struct {
 	GameId   uint64 `json:"game_id"`
 	PlayerId uint64 `json:"player_id"`
+	/* Stream of the connection leaving, so an old connection can not end a newer one */
+	Stream chan struct {
+		GameUpdate
+		string
+	} `json:"-"`
 }
 
-func (g *ChessGamesController) playerJoin(gameId uint64, playerId uint64) (*ChessGameChannel, chan struct {
+func (g *ChessGamesController) playerJoin(update GamePlayerJoinedUpdate) (*ChessGameChannel, chan struct {
 	GameUpdate
 	string
 }, error) {
-	game := g.Games[gameId]
-    /* TODO: Check if game is live */
-	if playerId != game.WhitePlayerId && playerId != game.BlackPlayerId {
+	gameId, playerId, user := update.GameId, update.PlayerId, update.User
+	game, ok := g.Games[gameId]
+	if !ok {
+		return nil, nil, errors.New("Invalid Game Id")
+	}
+	seat, ok := game.seat(playerId)
+	if !ok {
 		return nil, nil, errors.New("Invalid Player Id")
 	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(update.Token)), []byte(game.SeatTokenHashes[playerId])) != 1 {
+		return nil, nil, errors.New("Invalid seat token")
+	}
+	/* Seats of registered players can only be taken by their account */
+	if owner := game.SeatUser(seat); owner != "" && owner != user {
+		return nil, nil, errors.New("Seat belongs to another player")
+	}
+	if update.Since != nil && *update.Since > game.LastSeq() {
+		return nil, nil, errors.New("No such event")
+	}
+	if !validNotation(update.Notation) {
+		return nil, nil, errors.New("Unknown notation")
+	}
+	game.StreamsLock.Lock()
+	if game.Closed {
+		game.StreamsLock.Unlock()
+		return nil, nil, errors.New("Game is over")
+	}
+	/* A player coming back on a new connection replaces the old one */
+	if old, ok := game.PlayerStreams[playerId]; ok {
+		close(old)
+		delete(game.PlayerStreams, playerId)
+	}
+	if old, ok := game.JoiningStreams[playerId]; ok {
+		close(old)
+		delete(game.JoiningStreams, playerId)
+	}
+	/* From here on the game waits for the player to leave before it stops */
+	delete(game.Disconnected, playerId)
+	game.PlayerConnected[playerId] = true
+	game.StreamsLock.Unlock()
 	playerJoinedUpdate := GamePlayerJoinedUpdate{
 		GameId:   gameId,
 		PlayerId: playerId,
+		User:     user,
 	}
 	game.BroadcastUpdate(playerJoinedUpdate, "player_joined_update")
-	snapshot := GameSyncUpdate{
-		GameId: gameId,
-		FEN:    g.GetFEN(gameId),
+	game.StreamsLock.Lock()
+	defer game.StreamsLock.Unlock()
+	stream := game.catchUpStream(update.Since)
+	if update.Since == nil {
+		/* Registered by the game once it has sent the snapshot, see startStream */
+		game.JoiningStreams[playerId] = stream
+	} else {
+		game.PlayerStreams[playerId] = stream
 	}
-	if playerId == game.WhitePlayerId {
-		game.WhitePlayerConnected = true
-		game.WhitePlayerStream = make(chan struct {
-			GameUpdate
-			string
-		}, 128)
-		game.WhitePlayerStream <- struct {
-			GameUpdate
-			string
-		}{snapshot, "snapshot_update"}
-		return &game.Events, game.WhitePlayerStream, nil
-	} else if playerId == game.BlackPlayerId {
-		game.BlackPlayerConnected = true
-		game.BlackPlayerStream = make(chan struct {
-			GameUpdate
-			string
-		}, 128)
-		game.BlackPlayerStream <- struct {
-			GameUpdate
-			string
-		}{snapshot, "snapshot_update"}
-		return &game.Events, game.BlackPlayerStream, nil
+	return &game.Events, stream, nil
+}
+
+/*
+ * Asks the game to send a snapshot down a stream that joined without a seq,
+ * and to add the stream to the game after it
+ */
+type GameStreamRequest struct {
+	GameId      uint64
+	PlayerId    uint64
+	SpectatorId uint64
+	Spectator   bool
+	Stream      chan struct {
+		GameUpdate
+		string
+	}
+}
+
+/*
+ * Sends the game as it is now down a newly joined stream. The snapshot and
+ * the registration happen under one lock, so the stream gets every update
+ * after the snapshot and none before it.
+ */
+func (g *ChessGame) startStream(request GameStreamRequest, now time.Time) {
+	if request.GameId != g.GameId {
+		return
+	}
+	snapshot := g.SyncUpdate()
+	g.StreamsLock.Lock()
+	defer g.StreamsLock.Unlock()
+	if request.Spectator {
+		/* The spectator left before the snapshot was sent */
+		if stream, ok := g.SpectatorStreams[request.SpectatorId]; !ok || stream != nil {
+			return
+		}
+	} else if g.JoiningStreams[request.PlayerId] != request.Stream {
+		/* Replaced by a later connection, which closed this stream */
+		return
+	}
+	snapshot.Seq = uint64(len(g.EventLog))
+	snapshot.Players = g.playerStatus(now)
+	request.Stream <- struct {
+		GameUpdate
+		string
+	}{snapshot, "snapshot_update"}
+	if request.Spectator {
+		g.SpectatorStreams[request.SpectatorId] = request.Stream
 	} else {
-		return nil, nil, errors.New("Unreachable")
+		delete(g.JoiningStreams, request.PlayerId)
+		g.PlayerStreams[request.PlayerId] = request.Stream
 	}
 }
 
-func (g *ChessGame) playerLeave(gameId uint64, playerId uint64) error {
+func (g *ChessGame) playerLeave(update GamePlayerLeftUpdate) error {
     fmt.Println("player left")
+	gameId, playerId := update.GameId, update.PlayerId
     if (gameId != g.GameId) {
         return errors.New("Invalid Game Id")
     }
-	if playerId != g.WhitePlayerId && playerId != g.BlackPlayerId {
+	if _, ok := g.seat(playerId); !ok {
 		return errors.New("Invalid Player Id")
 	}
 	playerLeftUpdate := GamePlayerLeftUpdate{
 		GameId:   gameId,
 		PlayerId: playerId,
 	}
-	if playerId == g.WhitePlayerId {
-		close(g.WhitePlayerStream)
-		g.WhitePlayerStream = nil
-		g.WhitePlayerConnected = false
-	} else {
-		close(g.BlackPlayerStream)
-		g.BlackPlayerStream = nil
-		g.BlackPlayerConnected = false
+	now := time.Now()
+	g.StreamsLock.Lock()
+	stream, ok := g.PlayerStreams[playerId]
+	if !ok || stream != update.Stream {
+		/* The player has already reconnected */
+		g.StreamsLock.Unlock()
+		return nil
 	}
+	close(stream)
+	delete(g.PlayerStreams, playerId)
+	g.PlayerConnected[playerId] = false
+	waiting := !g.Finished() && g.ReconnectGrace > 0
+	if waiting {
+		g.Disconnected[playerId] = now.Add(g.ReconnectGrace)
+		g.NextCountdown = now.Add(time.Second)
+	}
+	g.StreamsLock.Unlock()
 	g.BroadcastUpdate(playerLeftUpdate, "player_left_update")	
-
+	if waiting {
+		g.BroadcastUpdate(GameReconnectUpdate{
+			GameId:      gameId,
+			PlayerId:    playerId,
+			RemainingMs: g.ReconnectGrace.Milliseconds(),
+		}, "reconnect_countdown")
+	}
 	return nil
 }
 
+/*
+ * The next moment the countdown of a player who dropped out has to be sent
+ * or their time to come back runs out, if anyone is away. Players whose time
+ * ran out before now are looked at again with the next countdown.
+ */
+func (g *ChessGame) reconnectDeadline(now time.Time) (time.Time, bool) {
+	if g.Finished() {
+		return time.Time{}, false
+	}
+	g.StreamsLock.Lock()
+	defer g.StreamsLock.Unlock()
+	if len(g.Disconnected) == 0 {
+		return time.Time{}, false
+	}
+	next := g.NextCountdown
+	for _, deadline := range g.Disconnected {
+		if deadline.Before(next) && deadline.After(now) {
+			next = deadline
+		}
+	}
+	return next, true
+}
+
+/* Whether a player on the other side of seat is connected to the game */
+func (g *ChessGame) opponentConnected(seat Seat) bool {
+	team := teamOutcome(seat.Board, seat.Color)
+	for _, other := range g.Seats {
+		if teamOutcome(other.Board, other.Color) != team && g.PlayerConnected[other.PlayerId] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Sends the countdown of players who are away and forfeits the game for the
+ * first one whose time to come back has run out while an opponent is still
+ * there. When every player's time has run out the game ends without a winner.
+ */
+func (g *ChessGame) checkReconnects(now time.Time) {
+	if g.Finished() {
+		return
+	}
+	countdowns := []GameReconnectUpdate{}
+	var abandoned *uint64
+	expired := 0
+	g.StreamsLock.Lock()
+	countdownDue := !now.Before(g.NextCountdown)
+	if countdownDue {
+		g.NextCountdown = now.Add(time.Second)
+	}
+	for playerId, deadline := range g.Disconnected {
+		playerId := playerId
+		if !now.Before(deadline) {
+			expired += 1
+			seat, _ := g.seat(playerId)
+			if g.opponentConnected(seat) && (abandoned == nil || playerId < *abandoned) {
+				abandoned = &playerId
+			}
+		} else if countdownDue {
+			countdowns = append(countdowns, GameReconnectUpdate{
+				GameId:      g.GameId,
+				PlayerId:    playerId,
+				RemainingMs: deadline.Sub(now).Milliseconds(),
+			})
+		}
+	}
+	everyone := expired == len(g.PlayerSeats())
+	g.StreamsLock.Unlock()
+	if abandoned != nil {
+		g.abandon(*abandoned)
+		return
+	}
+	if everyone {
+		g.abandonAll()
+		return
+	}
+	for _, countdown := range countdowns {
+		g.BroadcastUpdate(countdown, "reconnect_countdown")
+	}
+}
+
+/* Number of half moves played, on the board with the fewest in bughouse */
+func (g *ChessGame) plies() int {
+	if g.Bughouse == nil {
+		plies, _ := g.Variant.Plies()
+		return plies
+	}
+	fewest := -1
+	for _, board := range g.Bughouse.Boards {
+		plies := 2*(board.Position.FullMove-1)
+		if board.Position.Turn == chess.Black {
+			plies += 1
+		}
+		if fewest < 0 || plies < fewest {
+			fewest = plies
+		}
+	}
+	return fewest
+}
+
+/*
+ * Ends the game for a player who did not come back in time: they lose, or
+ * the game is aborted if it had hardly started
+ */
+func (g *ChessGame) abandon(playerId uint64) {
+	seat, _ := g.seat(playerId)
+	g.StreamsLock.Lock()
+	g.Disconnected = make(map[uint64]time.Time)
+	g.StreamsLock.Unlock()
+	if g.plies() < AbortPlies {
+		g.Aborted = true
+		g.Method = "aborted"
+	} else if g.Bughouse != nil {
+		g.Bughouse.DecidingBoard = seat.Board
+		g.Outcome = teamOutcome(seat.Board, seat.Color.Other())
+		g.Method = "abandonment"
+	} else {
+		if seat.Color == chess.White {
+			g.Outcome = chess.BlackWon
+		} else {
+			g.Outcome = chess.WhiteWon
+		}
+		g.Method = "abandonment"
+	}
+	g.broadcastResult()
+}
+
+/*
+ * Ends the game when nobody came back in time: it is aborted if it had
+ * hardly started and drawn otherwise
+ */
+func (g *ChessGame) abandonAll() {
+	g.StreamsLock.Lock()
+	g.Disconnected = make(map[uint64]time.Time)
+	g.StreamsLock.Unlock()
+	if g.plies() < AbortPlies {
+		g.Aborted = true
+		g.Method = "aborted"
+	} else {
+		g.Outcome = chess.Draw
+		g.Method = "abandonment"
+	}
+	g.broadcastResult()
+}
+
 type GameSpectatorJoinedUpdate struct {
 	GameId      uint64 `json:"game_id"`
 	SpectatorId uint64 `json:"spectator_id"`
@@ -367,6 +1129,9 @@ type GameSpectatorJoinedUpdate struct {
 
 type GameSpectatorJoinUpdate struct {
 	GameId uint64 `json:"game_id"`
+	/* Number of the last event seen and notation of the moves, as for players */
+	Since    *uint64 `json:"since,omitempty"`
+	Notation string  `json:"notation,omitempty"`
 }
 
 type GameSpectatorLeftUpdate struct {
@@ -378,34 +1143,41 @@ type GameDeleteRequest struct {
     GameId      uint64
 }
 
-func (g *ChessGamesController) spectatorJoin(gameId uint64) (uint64, *ChessGameChannel, chan struct {
+func (g *ChessGamesController) spectatorJoin(update GameSpectatorJoinUpdate) (uint64, *ChessGameChannel, chan struct {
 	GameUpdate
 	string
 }, error) {
-	spectatorId := g.NextAvailSpectatorId
-	g.NextAvailSpectatorId += 1
+	gameId := update.GameId
 	game, ok := g.Games[gameId]
 	if !ok {
 		return 0, nil, nil, errors.New("Invalid GameId")
 	}
-	spectatorStream := make(chan struct {
-		GameUpdate
-		string
-	}, 128)
-	game.SpectatorStreams[spectatorId] = spectatorStream
+	if update.Since != nil && *update.Since > game.LastSeq() {
+		return 0, nil, nil, errors.New("No such event")
+	}
+	if !validNotation(update.Notation) {
+		return 0, nil, nil, errors.New("Unknown notation")
+	}
+	game.StreamsLock.Lock()
+	if game.Closed {
+		game.StreamsLock.Unlock()
+		return 0, nil, nil, errors.New("Game is over")
+	}
+	spectatorId := g.NextAvailSpectatorId
+	g.NextAvailSpectatorId += 1
+	spectatorStream := game.catchUpStream(update.Since)
+	if update.Since == nil {
+		/* Holds the spectator's place until the game sends the snapshot, see startStream */
+		game.SpectatorStreams[spectatorId] = nil
+	} else {
+		game.SpectatorStreams[spectatorId] = spectatorStream
+	}
+	game.StreamsLock.Unlock()
 	spectatorJoinedUpdate := GameSpectatorJoinedUpdate{
 		GameId:      gameId,
 		SpectatorId: spectatorId,
 	}
 	game.BroadcastUpdate(spectatorJoinedUpdate, "spectator_joined_update")
-	snapshot := GameSyncUpdate{
-		GameId: gameId,
-		FEN:    g.GetFEN(gameId),
-	}
-	spectatorStream <- struct {
-		GameUpdate
-		string
-	}{snapshot, "snapshot_update"}
 	return spectatorId, &game.Events, spectatorStream, nil
 }
 
@@ -413,8 +1185,12 @@ func (g *ChessGame) spectatorLeave(gameId uint64, spectatorId uint64) {
     if (gameId != g.GameId) {
         /* TODO: return error */
     }
-	close(g.SpectatorStreams[spectatorId])
+	g.StreamsLock.Lock()
+	if stream := g.SpectatorStreams[spectatorId]; stream != nil {
+		close(stream)
+	}
 	delete(g.SpectatorStreams, spectatorId)
+	g.StreamsLock.Unlock()
 	spectatorLeftUpdate := GameSpectatorLeftUpdate{
 		GameId:      gameId,
 		SpectatorId: spectatorId,
@@ -424,39 +1200,520 @@ func (g *ChessGame) spectatorLeave(gameId uint64, spectatorId uint64) {
 
 func (g *ChessGamesController) Turn(gameId uint64) uint64 {
 	game := g.Games[gameId]
-	if game.GameState.Position().Turn() == chess.White {
+	if game.Bughouse != nil {
+		board := game.Bughouse.Boards[0]
+		if board.Position.Turn == chess.White {
+			return board.WhitePlayerId
+		}
+		return board.BlackPlayerId
+	}
+	if game.turn() == chess.White {
 		return game.WhitePlayerId
 	} else {
 		return game.BlackPlayerId
 	}
 }
 
+/*
+ * Whether the game goes on, which it does until it is finished and everyone
+ * has left. Once it stops nobody can join it any more.
+ */
+func (g *ChessGame) live() bool {
+	finished := g.Finished()
+	g.StreamsLock.Lock()
+	defer g.StreamsLock.Unlock()
+	if !finished || g.connected() {
+		return true
+	}
+	g.Closed = true
+	return false
+}
+
+/* Whether anyone is still connected to the game. Called with StreamsLock held. */
+func (g *ChessGame) connected() bool {
+	for _, connected := range g.PlayerConnected {
+		if connected {
+			return true
+		}
+	}
+	return len(g.SpectatorStreams) > 0
+}
+
+/* The first seat of a player, which is on the lowest board they play on */
+func (g *ChessGame) seat(playerId uint64) (Seat, bool) {
+	for _, seat := range g.Seats {
+		if seat.PlayerId == playerId {
+			return seat, true
+		}
+	}
+	return Seat{}, false
+}
+
+/*
+ * The seat a player makes a move from. Players sitting at more than one
+ * board have to say which board the move is for.
+ */
+func (g *ChessGame) moveSeat(playerId uint64, board int) (Seat, bool) {
+	found := []Seat{}
+	for _, seat := range g.Seats {
+		if seat.PlayerId == playerId {
+			found = append(found, seat)
+		}
+	}
+	if len(found) == 1 {
+		return found[0], true
+	}
+	for _, seat := range found {
+		if seat.Board == board {
+			return seat, true
+		}
+	}
+	return Seat{}, false
+}
+
+/* The first seat of every player in the game */
+func (g *ChessGame) PlayerSeats() []Seat {
+	seats := []Seat{}
+	for _, seat := range g.Seats {
+		if first, _ := g.seat(seat.PlayerId); first == seat {
+			seats = append(seats, seat)
+		}
+	}
+	return seats
+}
+
+/* The next moment a player will run out of time, if any clock is running */
+func (g *ChessGame) deadline() (time.Time, bool) {
+	if g.Bughouse != nil {
+		return g.Bughouse.Deadline()
+	}
+	return g.Clock.Deadline()
+}
+
 func (g *ChessGame) Finished() bool {
-	return g.GameState.Outcome() != chess.NoOutcome
+	if g.Aborted {
+		return true
+	}
+	outcome, _ := g.Result()
+	return outcome != chess.NoOutcome
+}
+
+/* Outcome of the game and how it came about, e.g. "checkmate" */
+func (g *ChessGame) Result() (chess.Outcome, string) {
+	if g.Outcome != chess.NoOutcome || g.Aborted || g.Bughouse != nil {
+		return g.Outcome, g.Method
+	}
+	return g.Variant.Outcome()
+}
+
+/* Stops the clocks and tells everyone how the game ended */
+func (g *ChessGame) broadcastResult() {
+	if g.Bughouse != nil {
+		resultUpdate := g.Bughouse.ResultUpdate(g.Outcome, g.Method)
+		g.archive(resultUpdate)
+		g.BroadcastUpdate(resultUpdate, "result_update")
+		return
+	}
+	now := time.Now()
+	g.Clock.Stop(now)
+	outcome, method := g.Result()
+	resultUpdate := GameResultUpdate{
+		Result: outcome.String(),
+		Method: method,
+		FEN:    g.FEN(),
+		Clock:  g.Clock.Snapshot(now),
+	}
+	if g.Rated() && !g.Aborted && !g.RatingsReported {
+		g.RatingsReported = true
+		changes, err := g.Ratings.RateGame(RatingGameRequest{
+			GameId:  g.GameId,
+			Pool:    RatingPool(g.Mode, g.Clock.TimeControl),
+			White:   g.WhiteUser,
+			Black:   g.BlackUser,
+			Outcome: outcome,
+		})
+		if err != nil {
+			log.Errorf("Could not rate game %d: %s", g.GameId, err)
+		} else {
+			resultUpdate.RatingChanges = map[string]RatingChange{
+				chess.White.String(): changes[0],
+				chess.Black.String(): changes[1],
+			}
+		}
+	}
+	g.archive(resultUpdate)
+	g.BroadcastUpdate(resultUpdate, "result_update")
+}
+
+/* Adds a move to the record of the game, with the time the mover has left */
+func (g *ChessGame) recordMove(board int, color chess.Color, uci string, san string, clock *ClockUpdate) {
+	played := PlayedMove{Board: board, Color: color.String(), UCI: uci, SAN: san}
+	if clock != nil {
+		remaining := clock.WhiteMs
+		if color == chess.Black {
+			remaining = clock.BlackMs
+		}
+		played.ClockMs = &remaining
+	}
+	g.Moves = append(g.Moves, played)
+}
+
+/* Account a seat is reserved for, empty if anyone with its player id may take it */
+func (g *ChessGame) SeatUser(seat Seat) string {
+	if g.Bughouse != nil {
+		return ""
+	}
+	if seat.Color == chess.White {
+		return g.WhiteUser
+	}
+	return g.BlackUser
+}
+
+/* Two player games between different named players count for their ratings */
+func (g *ChessGame) Rated() bool {
+	return g.Ratings != nil && g.Bughouse == nil && g.WhiteUser != "" && g.BlackUser != "" && g.WhiteUser != g.BlackUser && !g.CustomStart
+}
+
+/*
+ * Ends the game if the side to move has run out of time. Returns true if the
+ * game was adjudicated.
+ */
+func (g *ChessGame) checkFlag(now time.Time) bool {
+	if g.Bughouse != nil {
+		return g.checkBughouseFlag(now)
+	}
+	if g.Finished() || !g.Clock.Flagged(now) {
+		return false
+	}
+	flagged := g.Clock.Turn
+	if g.Variant.HasMatingMaterial(flagged.Other()) {
+		if flagged == chess.White {
+			g.Outcome = chess.BlackWon
+		} else {
+			g.Outcome = chess.WhiteWon
+		}
+		g.Method = "timeout"
+	} else {
+		g.Outcome = chess.Draw
+		g.Method = "timeout_vs_insufficient_material"
+	}
+	g.broadcastResult()
+	return true
+}
+
+/* Sends an update to a single player, if they are connected */
+func (g *ChessGame) sendToPlayer(playerId uint64, update GameUpdate, T string) {
+	g.StreamsLock.Lock()
+	defer g.StreamsLock.Unlock()
+	if c, ok := g.PlayerStreams[playerId]; ok && c != nil {
+		c <- struct {
+			GameUpdate
+			string
+		}{update, T}
+	}
 }
 
 func (g *ChessGame) BroadcastUpdate(update GameUpdate, T string) {
+	g.StreamsLock.Lock()
 	updateMsg := struct {
 		GameUpdate
 		string
 	}{update, T}
-	if g.WhitePlayerStream != nil {
-		g.WhitePlayerStream <- updateMsg
+	var event *GameEvent
+	if !transientUpdates[T] {
+		recorded := g.recordEvent(update, T, time.Now())
+		event = &recorded
+		updateMsg.GameUpdate = recorded
 	}
-	if g.BlackPlayerStream != nil {
-		g.BlackPlayerStream <- updateMsg
+	for _, c := range g.PlayerStreams {
+		if c != nil {
+			c <- updateMsg
+		}
 	}
 	for _, c := range g.SpectatorStreams {
 		if c != nil {
 			c <- updateMsg
 		}
 	}
+	g.StreamsLock.Unlock()
+	/* The disk is slow, so the log is written once the streams are free again */
+	if event != nil {
+		g.logEvent(*event)
+	}
+}
+
+/* Color a player is playing in this game */
+func (g *ChessGame) playerColor(gameId uint64, playerId uint64) (chess.Color, error) {
+	if gameId != g.GameId {
+		return chess.NoColor, errors.New("Invalid Game Id")
+	}
+	seat, ok := g.seat(playerId)
+	if !ok {
+		return chess.NoColor, errors.New("Invalid Player Id")
+	}
+	return seat.Color, nil
+}
+
+func (g *ChessGame) resign(update GameResignUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.Finished() {
+		return errors.New("Game is already over")
+	}
+	g.logAction(update, "resign", time.Now())
+	if g.Bughouse != nil {
+		/* A resignation concedes for the whole team */
+		seat, _ := g.seat(update.PlayerId)
+		g.Bughouse.DecidingBoard = seat.Board
+		g.Outcome = teamOutcome(seat.Board, color.Other())
+		g.Method = "resignation"
+		g.BroadcastUpdate(update, "resign")
+		g.broadcastResult()
+		return nil
+	}
+	g.Variant.Resign(color)
+	g.BroadcastUpdate(update, "resign")
+	g.broadcastResult()
+	return nil
+}
+
+func (g *ChessGame) offerDraw(update GameDrawOfferUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.Bughouse != nil {
+		return errors.New("Draw offers are not supported in bughouse")
+	}
+	if g.Finished() {
+		return errors.New("Game is already over")
+	}
+	if g.DrawOfferedBy == color.Other() {
+		/* Both players want a draw */
+		return g.acceptDraw(GameDrawAcceptUpdate{GameId: update.GameId, PlayerId: update.PlayerId})
+	}
+	if g.DrawOfferedBy == color {
+		return errors.New("Draw already offered")
+	}
+	g.logAction(update, "offer_draw", time.Now())
+	g.DrawOfferedBy = color
+	g.BroadcastUpdate(update, "offer_draw")
+	return nil
+}
+
+func (g *ChessGame) acceptDraw(update GameDrawAcceptUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.Finished() {
+		return errors.New("Game is already over")
+	}
+	if g.DrawOfferedBy != color.Other() {
+		return errors.New("No draw offer to accept")
+	}
+	g.logAction(update, "accept_draw", time.Now())
+	g.Variant.Draw()
+	g.DrawOfferedBy = chess.NoColor
+	g.BroadcastUpdate(update, "accept_draw")
+	g.broadcastResult()
+	return nil
+}
+
+func (g *ChessGame) declineDraw(update GameDrawDeclineUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.DrawOfferedBy != color.Other() {
+		return errors.New("No draw offer to decline")
+	}
+	g.logAction(update, "decline_draw", time.Now())
+	g.DrawOfferedBy = chess.NoColor
+	g.BroadcastUpdate(update, "decline_draw")
+	return nil
+}
+
+/* How many takeback requests a player may have waiting on the opponent */
+const MaxPendingTakebacks = 1
+
+func (g *ChessGame) requestTakeback(update GameTakebackRequestUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.Bughouse != nil {
+		return errors.New("Takebacks are not supported in bughouse")
+	}
+	if g.Finished() {
+		return errors.New("Game is already over")
+	}
+	if g.takebackPlies(color) == 0 {
+		return errors.New("No move to take back")
+	}
+	if g.PendingTakebacks[color] >= MaxPendingTakebacks {
+		return errors.New("Too many pending takeback requests")
+	}
+	g.logAction(update, "takeback_request", time.Now())
+	g.PendingTakebacks[color] += 1
+	g.BroadcastUpdate(update, "takeback_request")
+	return nil
 }
 
-func (g *ChessGame) makeMove(move GameMoveUpdate) error {
+func (g *ChessGame) acceptTakeback(update GameTakebackAcceptUpdate, now time.Time) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.Finished() {
+		return errors.New("Game is already over")
+	}
+	requester := color.Other()
+	if g.PendingTakebacks[requester] == 0 {
+		return errors.New("No takeback request to accept")
+	}
+	g.logAction(update, "accept_takeback", now)
+	if err := g.rewind(g.takebackPlies(requester), now); err != nil {
+		return err
+	}
+	g.PendingTakebacks[requester] -= 1
+	g.BroadcastUpdate(update, "accept_takeback")
+	g.BroadcastUpdate(g.SyncUpdate(), "snapshot_update")
+	return nil
+}
+
+func (g *ChessGame) declineTakeback(update GameTakebackDeclineUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.PendingTakebacks[color.Other()] == 0 {
+		return errors.New("No takeback request to decline")
+	}
+	g.logAction(update, "decline_takeback", time.Now())
+	g.PendingTakebacks[color.Other()] = 0
+	g.BroadcastUpdate(update, "decline_takeback")
+	return nil
+}
+
+/*
+ * Number of half moves that need to be undone for color to get its last move
+ * back: one if the opponent has not replied yet, otherwise two
+ */
+func (g *ChessGame) takebackPlies(color chess.Color) int {
+	plies, first := g.Variant.Plies()
+	/* Number of moves color has made so far */
+	made := plies / 2
+	if plies%2 == 1 && first == color {
+		made += 1
+	}
+	if made == 0 {
+		return 0
+	}
+	if g.turn() == color {
+		return 2
+	}
+	return 1
+}
+
+/* Takes back the last plies half moves */
+func (g *ChessGame) rewind(plies int, now time.Time) error {
+	if err := g.Variant.Rewind(plies); err != nil {
+		return err
+	}
+	g.Moves = g.Moves[:len(g.Moves)-plies]
+	g.Clock.Rewind(g.turn(), now)
+	if left, _ := g.Variant.Plies(); left == 0 {
+		/* Back to before the first move, which starts the clock again */
+		g.Clock.Stop(now)
+	}
+	g.DrawOfferedBy = chess.NoColor
+	return nil
+}
+
+func (g *ChessGame) offerRematch(update GameRematchOfferUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.Bughouse != nil {
+		return errors.New("Rematches are not supported in bughouse")
+	}
+	if !g.Finished() {
+		return errors.New("Game is not over yet")
+	}
+	if g.RematchOfferedBy == color.Other() {
+		return g.acceptRematch(GameRematchAcceptUpdate{GameId: update.GameId, PlayerId: update.PlayerId})
+	}
+	if g.RematchOfferedBy == color {
+		return errors.New("Rematch already offered")
+	}
+	g.RematchOfferedBy = color
+	g.BroadcastUpdate(update, "rematch_offer")
+	return nil
+}
+
+/*
+ * Starts the rematch with colors reversed and the same time control and
+ * opening, so both players get to play each side of it
+ */
+func (g *ChessGame) acceptRematch(update GameRematchAcceptUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.RematchOfferedBy != color.Other() {
+		return errors.New("No rematch offer to accept")
+	}
+	g.RematchOfferedBy = chess.NoColor
+	options := GameNewUpdate{
+		Mode:          g.Mode,
+		TimeControl:   g.Clock.TimeControl,
+		StartPosition: RandomStartPosition,
+		WhiteUser:     g.BlackUser,
+		BlackUser:     g.WhiteUser,
+	}
+	g.Variant.Setup(&options)
+	if g.CustomStart {
+		options.FEN = g.StartFEN
+	}
+	rematch, err := g.ControllerRequests.AddNewGame(options)
+	if err != nil {
+		return err
+	}
+	g.BroadcastUpdate(update, "accept_rematch")
+	g.BroadcastUpdate(GameRematchUpdate{GameId: g.GameId, NewGameId: rematch.GameId}, "rematch_update")
+	g.sendToPlayer(g.WhitePlayerId, rematch.matchFound(chess.Black), "match_found")
+	g.sendToPlayer(g.BlackPlayerId, rematch.matchFound(chess.White), "match_found")
+	return nil
+}
+
+func (g *ChessGame) declineRematch(update GameRematchDeclineUpdate) error {
+	color, err := g.playerColor(update.GameId, update.PlayerId)
+	if err != nil {
+		return err
+	}
+	if g.RematchOfferedBy != color.Other() {
+		return errors.New("No rematch offer to decline")
+	}
+	g.RematchOfferedBy = chess.NoColor
+	g.BroadcastUpdate(update, "decline_rematch")
+	return nil
+}
+
+/* Plays move as of now, which is only in the past when the game is replayed from its log */
+func (g *ChessGame) makeMove(move GameMoveUpdate, now time.Time) error {
     if g.GameId != move.GameId {
         return errors.New("Invalid Game id")
     }
+	if g.Finished() {
+		return errors.New("Game is already over")
+	}
+	if g.Bughouse != nil {
+		return g.makeBughouseMove(move, now)
+	}
 	if move.PlayerId == g.WhitePlayerId {
 		if move.PlayerColor != "w" {
 			return errors.New("Invalid Player color")
@@ -469,26 +1726,46 @@ func (g *ChessGame) makeMove(move GameMoveUpdate) error {
 		return errors.New("Invalid Player Id")
 	}
 
-	color := strings.ToLower(g.GameState.Position().Turn().String())
+	color := strings.ToLower(g.turn().String())
 	if color != move.PlayerColor {
 		return errors.New("Player color does not match what's on the server")
 	}
 
-	err := g.GameState.MoveStr(move.Move)
+	/* A move that arrives after the flag has fallen does not count */
+	if g.checkFlag(now) {
+		return nil
+	}
+
+	if err := g.Variant.ValidateMove(move.Move); err != nil {
+		return errors.New("Invalid move")
+	}
+	notation, err := g.Variant.Notation(move.Move)
 	if err != nil {
 		return errors.New("Invalid move")
 	}
-	move.FEN = g.GameState.FEN()
+	mover := g.turn()
+	g.logAction(move, "move_update", now)
+	if err := g.Variant.ApplyMove(move.Move); err != nil {
+		return err
+	}
+	g.Clock.Punch(now)
+	g.recordMove(0, mover, notation.UCI, notation.SAN, g.Clock.Snapshot(now))
+	/* Moving instead of answering a draw offer declines it */
+	if g.DrawOfferedBy == g.turn() {
+		g.DrawOfferedBy = chess.NoColor
+	}
+	/* Takeback requests refer to the position they were made in */
+	g.PendingTakebacks = make(map[chess.Color]int)
+	move.setNotation(notation)
+	move.FEN = g.FEN()
+	move.Clock = g.Clock.Snapshot(now)
+	g.Variant.AddMoveState(&move)
 
 	g.BroadcastUpdate(move, "move_update")
 
 	/* Check if game has ended - if so send a follow-up update */
 	if g.Finished() {
-		resultUpdate := GameResultUpdate{
-			Result: g.GameState.Outcome().String(),
-			FEN:    g.GameState.Position().String(),
-		}
-		g.BroadcastUpdate(resultUpdate, "result_update")
+		g.broadcastResult()
 	}
 	return nil
 }
@@ -502,34 +1779,139 @@ func (g *ChessGamesController) GetGame(gameId uint64) (*ChessGame, error) {
 
 }
 
-func (g *ChessGamesController) addNewGame() *ChessGame {
+func (g *ChessGamesController) addNewGame(options GameNewUpdate) (*ChessGame, error) {
 	/* Because we just have one Matchmaking goroutine calling this function we don't need to worry about
 	 * synchronization yet
 	 */
-	gameId := g.NextAvailGameId
+	newGame, err := g.createGame(g.NextAvailGameId, g.NextAvailPlayerId, options, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := newGame.newSeatTokens(); err != nil {
+		return nil, err
+	}
+	/* The log keeps the options as the variant settled them, so replaying it sets up the same position */
+	if newGame.Variant != nil {
+		newGame.Variant.Setup(&options)
+	}
+	newGame.Log = g.Log
+	newGame.log(GameLogRecord{
+		Type:            LogGameCreated,
+		GameId:          newGame.GameId,
+		Time:            newGame.Started,
+		Options:         &options,
+		FirstPlayerId:   newGame.WhitePlayerId,
+		SeatTokenHashes: newGame.SeatTokenHashes,
+	})
+	g.Games[newGame.GameId] = newGame
 	g.NextAvailGameId += 1
+	g.NextAvailPlayerId += uint64(len(newGame.PlayerSeats()))
+    go newGame.Run()
+	return newGame, nil
+}
+
+/* Makes up the seat tokens of the game's players */
+func (g *ChessGame) newSeatTokens() error {
+	g.SeatTokens = make(map[uint64]string)
+	g.SeatTokenHashes = make(map[uint64]string)
+	for _, seat := range g.PlayerSeats() {
+		token, err := randomToken()
+		if err != nil {
+			return err
+		}
+		g.SeatTokens[seat.PlayerId] = token
+		g.SeatTokenHashes[seat.PlayerId] = hashToken(token)
+	}
+	return nil
+}
+
+/*
+ * Sets up a game started at started whose players get ids from firstPlayerId
+ * on. The game is neither registered nor running yet.
+ */
+func (g *ChessGamesController) createGame(gameId uint64, firstPlayerId uint64, options GameNewUpdate, started time.Time) (*ChessGame, error) {
+	mode := options.Mode
+	if mode == "" {
+		mode = ModeStandard
+	}
+	timeControl := options.TimeControl
 	newGame := ChessGame{
-		GameState:            chess.NewGame(),
 		GameId:               gameId,
-		WhitePlayerId:        g.NextAvailPlayerId,
-		BlackPlayerId:        g.NextAvailPlayerId + 1,
-		WhitePlayerStream:    nil,
-		BlackPlayerStream:    nil,
-		WhitePlayerConnected: false,
-		BlackPlayerConnected: false,
+		Mode:                 mode,
+		WhitePlayerId:        firstPlayerId,
+		BlackPlayerId:        firstPlayerId + 1,
+		Clock:                NewGameClock(timeControl),
+		Outcome:              chess.NoOutcome,
+		PendingTakebacks:     make(map[chess.Color]int),
+		PlayerStreams: make(map[uint64]chan struct {
+			GameUpdate
+			string
+		}),
+		PlayerConnected:      make(map[uint64]bool),
+		JoiningStreams: make(map[uint64]chan struct {
+			GameUpdate
+			string
+		}),
+		ReconnectGrace:       g.ReconnectGrace,
+		Archive:              g.Archive,
+		Started:              started,
+		Disconnected:         make(map[uint64]time.Time),
 		SpectatorStreams: make(map[uint64]chan struct {
 			GameUpdate
 			string
 		}),
         ControllerRequests: &g.Events,
 	}
+	if ModeSeats[mode] == 2 {
+		newGame.WhiteUser = options.WhiteUser
+		newGame.BlackUser = options.BlackUser
+		newGame.Ratings = g.Ratings
+	}
+	newGame.Seats = []Seat{
+		{PlayerId: newGame.WhitePlayerId, Board: 0, Color: chess.White},
+		{PlayerId: newGame.BlackPlayerId, Board: 0, Color: chess.Black},
+	}
+	if options.FEN != "" && ModeSeats[mode] != 2 {
+		return nil, errors.New("Custom start positions need a two player mode")
+	}
+	switch mode {
+	case ModeBughouse:
+		newGame.Bughouse = NewBughouseMatch(timeControl, [4]uint64{
+			newGame.WhitePlayerId,
+			newGame.BlackPlayerId,
+			firstPlayerId + 2,
+			firstPlayerId + 3,
+		})
+		newGame.Seats = newGame.Bughouse.Seats()
+	case ModeBughouse1v1:
+		/* White on board 0 also plays black on board 1, so partners are the same player */
+		newGame.Bughouse = NewBughouseMatch(timeControl, [4]uint64{
+			newGame.WhitePlayerId,
+			newGame.BlackPlayerId,
+			newGame.BlackPlayerId,
+			newGame.WhitePlayerId,
+		})
+		newGame.Seats = newGame.Bughouse.Seats()
+	default:
+		variant, err := NewVariant(mode, options, g.Openings)
+		if err != nil {
+			return nil, err
+		}
+		newGame.Variant = variant
+		newGame.StartFEN = variant.FEN()
+		newGame.CustomStart = options.FEN != ""
+		newGame.Clock.Turn = variant.Turn()
+	}
     newGame.Events.C = make(chan ChessGamesControllerRequest)
-	g.Games[gameId] = &newGame
-	g.NextAvailPlayerId += 2
-    go newGame.Run()
-	return &newGame
+	return &newGame, nil
 }
 
 func (g *ChessGamesController) deleteGame(gameId uint64) {
     delete(g.Games, gameId)
+	/* The game has stopped, so a restart has nothing to recover of it */
+	if g.Log != nil {
+		if err := g.Log.Drop(gameId); err != nil {
+			log.Errorf("Could not drop game %d from the log: %s", gameId, err)
+		}
+	}
 }
@@ -0,0 +1,395 @@
+package chess_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/notnil/chess"
+)
+
+/* A standard game with a minute each, set up as the controller would */
+func newTestGame(t *testing.T, controller *ChessGamesController) *ChessGame {
+	t.Helper()
+	controller.Init()
+	options := GameNewUpdate{Mode: ModeStandard, TimeControl: TimeControl{Base: time.Minute}}
+	game, err := controller.createGame(0, 0, options, clockStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.Games[0] = game
+	return game
+}
+
+/* Plays moves in order from the side to move, a second apart after from */
+func playMoves(t *testing.T, game *ChessGame, from time.Time, moves ...string) time.Time {
+	t.Helper()
+	now := from
+	first := 0
+	if game.turn() == chess.Black {
+		first = 1
+	}
+	for i, move := range moves {
+		i += first
+		now = now.Add(time.Second)
+		update := GameMoveUpdate{GameId: game.GameId, PlayerId: uint64(i % 2), PlayerColor: []string{"w", "b"}[i%2], Move: move}
+		if err := game.makeMove(update, now); err != nil {
+			t.Fatalf("%s: %s", move, err)
+		}
+	}
+	return now
+}
+
+func TestAbandonment(t *testing.T) {
+	tests := []struct {
+		name      string
+		moves     []string
+		connected []uint64
+		outcome   chess.Outcome
+		method    string
+		aborted   bool
+	}{
+		{"opponent waiting", []string{"e4", "e5"}, []uint64{1}, chess.BlackWon, "abandonment", false},
+		{"nobody back", []string{"e4", "e5"}, nil, chess.Draw, "abandonment", false},
+		{"nobody back before a move", nil, nil, chess.NoOutcome, "aborted", true},
+		{"opponent waiting before a move", nil, []uint64{0}, chess.NoOutcome, "aborted", true},
+	}
+	for _, test := range tests {
+		var controller ChessGamesController
+		game := newTestGame(t, &controller)
+		now := playMoves(t, game, clockStart, test.moves...)
+		/* As after a restart: everyone is away, and some come back */
+		for _, seat := range game.PlayerSeats() {
+			game.Disconnected[seat.PlayerId] = now.Add(time.Minute)
+		}
+		for _, playerId := range test.connected {
+			delete(game.Disconnected, playerId)
+			game.PlayerConnected[playerId] = true
+		}
+		game.checkReconnects(now.Add(time.Minute))
+		outcome, method := game.Result()
+		if outcome != test.outcome || method != test.method || game.Aborted != test.aborted {
+			t.Errorf("%s: %s by %s, aborted %t", test.name, outcome, method, game.Aborted)
+		}
+	}
+}
+
+func TestAbandonmentWaitsForOpponent(t *testing.T) {
+	var controller ChessGamesController
+	game := newTestGame(t, &controller)
+	now := playMoves(t, game, clockStart, "e4", "e5")
+	game.Disconnected[0] = now.Add(time.Minute)
+	game.Disconnected[1] = now.Add(2 * time.Minute)
+	/* White is out of time, but black is away too and may still come back */
+	game.checkReconnects(now.Add(time.Minute))
+	if game.Finished() {
+		t.Fatal("white forfeited to an absent opponent")
+	}
+	/* Not straight away again, but with the next countdown */
+	if deadline, ok := game.reconnectDeadline(now.Add(time.Minute)); !ok || !deadline.Equal(now.Add(time.Minute+time.Second)) {
+		t.Errorf("next check at %s", deadline)
+	}
+	game.checkReconnects(now.Add(2 * time.Minute))
+	if outcome, method := game.Result(); outcome != chess.Draw || method != "abandonment" {
+		t.Errorf("%s by %s once nobody came back", outcome, method)
+	}
+}
+
+/* The next update on a stream, failing if none comes */
+func nextUpdate(t *testing.T, stream chan struct {
+	GameUpdate
+	string
+}) struct {
+	GameUpdate
+	string
+} {
+	t.Helper()
+	select {
+	case update := <-stream:
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update")
+	}
+	return struct {
+		GameUpdate
+		string
+	}{}
+}
+
+func TestSeatTokens(t *testing.T) {
+	var server ChessServer
+	server.Init()
+	go server.ChessGamesController.Run()
+	games := &server.ChessGamesController.Events
+	game, err := games.AddNewGame(GameNewUpdate{Mode: ModeStandard, TimeControl: TimeControl{Base: time.Minute}, WhiteUser: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	white, black := game.matchFound(chess.White), game.matchFound(chess.Black)
+	if len(white.Token) < 32 || white.Token == black.Token {
+		t.Fatalf("seat tokens %q and %q", white.Token, black.Token)
+	}
+
+	tests := []struct {
+		name   string
+		update GamePlayerJoinedUpdate
+	}{
+		{"no token", GamePlayerJoinedUpdate{GameId: game.GameId, PlayerId: black.PlayerId}},
+		{"wrong token", GamePlayerJoinedUpdate{GameId: game.GameId, PlayerId: black.PlayerId, Token: white.Token[1:] + "0"}},
+		{"other seat's token", GamePlayerJoinedUpdate{GameId: game.GameId, PlayerId: black.PlayerId, Token: white.Token}},
+		{"another account", GamePlayerJoinedUpdate{GameId: game.GameId, PlayerId: white.PlayerId, Token: white.Token, User: "bob"}},
+		{"anonymous on an account's seat", GamePlayerJoinedUpdate{GameId: game.GameId, PlayerId: white.PlayerId, Token: white.Token}},
+	}
+	for _, test := range tests {
+		if _, _, err := games.PlayerJoin(test.update); err == nil {
+			t.Errorf("%s: joined", test.name)
+		}
+	}
+
+	_, _, spectator, err := games.SpectatorJoin(GameSpectatorJoinUpdate{GameId: game.GameId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := []struct {
+		GameUpdate
+		string
+	}{nextUpdate(t, spectator)}
+	joins := []GamePlayerJoinedUpdate{
+		{GameId: game.GameId, PlayerId: white.PlayerId, Token: white.Token, User: "alice"},
+		{GameId: game.GameId, PlayerId: black.PlayerId, Token: black.Token},
+	}
+	for _, join := range joins {
+		if _, stream, err := games.PlayerJoin(join); err != nil {
+			t.Fatal(err)
+		} else {
+			seen = append(seen, nextUpdate(t, stream))
+		}
+		seen = append(seen, nextUpdate(t, spectator))
+	}
+
+	e := echo.New()
+	recorder := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), recorder)
+	c.SetParamNames("id")
+	c.SetParamValues(strconv.FormatUint(game.GameId, 10))
+	if err := GetGameEvents(&ChessServerContext{Context: c, Server: &server}); err != nil {
+		t.Fatal(err)
+	}
+	sent := []string{recorder.Body.String()}
+	for _, update := range seen {
+		data, err := json.Marshal(update.GameUpdate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, update.string+" "+string(data))
+	}
+	if !strings.Contains(sent[0], "player_joined_update") {
+		t.Errorf("events without the joins: %s", sent[0])
+	}
+	for _, message := range sent {
+		if strings.Contains(message, white.Token) || strings.Contains(message, black.Token) {
+			t.Errorf("seat token sent in %s", message)
+		}
+	}
+}
+
+func TestNoJoinsOnceStopped(t *testing.T) {
+	var controller ChessGamesController
+	game := newTestGame(t, &controller)
+	if err := game.newSeatTokens(); err != nil {
+		t.Fatal(err)
+	}
+	join := GamePlayerJoinedUpdate{GameId: 0, PlayerId: 0, Token: game.SeatTokens[0]}
+	if _, _, err := controller.playerJoin(join); err != nil {
+		t.Fatal(err)
+	}
+	game.Aborted = true
+	/* Finished, but a player is still there to ask for a rematch */
+	if !game.live() {
+		t.Fatal("stopped with a player connected")
+	}
+	game.PlayerConnected[0] = false
+	if game.live() {
+		t.Fatal("went on with nobody connected")
+	}
+	if _, _, err := controller.playerJoin(join); err == nil {
+		t.Error("player joined a stopped game")
+	}
+	if _, _, _, err := controller.spectatorJoin(GameSpectatorJoinUpdate{GameId: 0}); err == nil {
+		t.Error("spectator joined a stopped game")
+	}
+}
+
+func TestTakebacks(t *testing.T) {
+	white := GameTakebackRequestUpdate{GameId: 0, PlayerId: 0}
+	black := GameTakebackRequestUpdate{GameId: 0, PlayerId: 1}
+	tests := []struct {
+		name    string
+		moves   []string
+		request GameTakebackRequestUpdate
+		plies   int
+		fen     string
+	}{
+		{"before the reply", []string{"e4"}, white, 1, "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"},
+		{"after the reply", []string{"e4", "e5"}, white, 2, "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"},
+		{"last move", []string{"e4", "e5"}, black, 1, "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1"},
+	}
+	for _, test := range tests {
+		var controller ChessGamesController
+		game := newTestGame(t, &controller)
+		now := playMoves(t, game, clockStart, test.moves...)
+		color, _ := game.playerColor(0, test.request.PlayerId)
+		if plies := game.takebackPlies(color); plies != test.plies {
+			t.Errorf("%s: %d plies to take back, want %d", test.name, plies, test.plies)
+		}
+		if err := game.requestTakeback(test.request); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if err := game.requestTakeback(test.request); err == nil {
+			t.Errorf("%s: more than %d pending requests", test.name, MaxPendingTakebacks)
+		}
+		/* Only the opponent can accept */
+		if err := game.acceptTakeback(GameTakebackAcceptUpdate{GameId: 0, PlayerId: test.request.PlayerId}, now); err == nil {
+			t.Errorf("%s: accepted own request", test.name)
+		}
+		accept := GameTakebackAcceptUpdate{GameId: 0, PlayerId: 1 - test.request.PlayerId}
+		if err := game.acceptTakeback(accept, now); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if fen := game.FEN(); fen != test.fen {
+			t.Errorf("%s: rewound to %s", test.name, fen)
+		}
+		if len(game.Moves) != len(test.moves)-test.plies || game.PendingTakebacks[color] != 0 {
+			t.Errorf("%s: %d moves and %d requests left", test.name, len(game.Moves), game.PendingTakebacks[color])
+		}
+	}
+}
+
+func TestTakebackDecline(t *testing.T) {
+	var controller ChessGamesController
+	game := newTestGame(t, &controller)
+	if err := game.requestTakeback(GameTakebackRequestUpdate{GameId: 0, PlayerId: 0}); err == nil {
+		t.Error("took back a move before any was made")
+	}
+	playMoves(t, game, clockStart, "e4")
+	request := GameTakebackRequestUpdate{GameId: 0, PlayerId: 0}
+	decline := GameTakebackDeclineUpdate{GameId: 0, PlayerId: 1}
+	if err := game.declineTakeback(decline); err == nil {
+		t.Error("declined a request that was not made")
+	}
+	for i := 0; i < 2; i++ {
+		if err := game.requestTakeback(request); err != nil {
+			t.Fatalf("request %d: %s", i+1, err)
+		}
+		if err := game.declineTakeback(decline); err != nil {
+			t.Fatal(err)
+		}
+		if pending := game.PendingTakebacks[chess.White]; pending != 0 {
+			t.Errorf("%d pending requests after declining", pending)
+		}
+	}
+	game.Aborted = true
+	if err := game.requestTakeback(request); err == nil {
+		t.Error("took back a move once the game was over")
+	}
+}
+
+func TestTakebackClock(t *testing.T) {
+	var controller ChessGamesController
+	game := newTestGame(t, &controller)
+	/* e4 starts the clock, black takes a second over e5 */
+	now := playMoves(t, game, clockStart, "e4", "e5")
+	if err := game.requestTakeback(GameTakebackRequestUpdate{GameId: 0, PlayerId: 0}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(3 * time.Second)
+	if err := game.acceptTakeback(GameTakebackAcceptUpdate{GameId: 0, PlayerId: 1}, now); err != nil {
+		t.Fatal(err)
+	}
+	/* Back before the first move: white was charged for the wait, and the clock waits for a move again */
+	clock := game.Clock
+	if clock.Running || clock.Turn != chess.White {
+		t.Errorf("clock running %t for %s after taking back every move", clock.Running, clock.Turn)
+	}
+	later := now.Add(time.Minute)
+	if white, black := clock.Remaining(chess.White, later), clock.Remaining(chess.Black, later); white != 57*time.Second || black != 59*time.Second {
+		t.Errorf("%s and %s left, want 57s and 59s", white, black)
+	}
+
+	/* Taking back black's move and white's reply hands the running clock back to black */
+	now = playMoves(t, game, now, "d4", "d5", "c4")
+	if err := game.requestTakeback(GameTakebackRequestUpdate{GameId: 0, PlayerId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := game.acceptTakeback(GameTakebackAcceptUpdate{GameId: 0, PlayerId: 0}, now.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	clock = game.Clock
+	if !clock.Running || clock.Turn != chess.Black || !clock.TurnStart.Equal(now.Add(2*time.Second)) {
+		t.Errorf("clock running %t for %s since %s", clock.Running, clock.Turn, clock.TurnStart)
+	}
+	/* Black was charged the two seconds the takeback took */
+	if white, black := clock.Remaining(chess.White, now), clock.Remaining(chess.Black, now.Add(2*time.Second)); white != 56*time.Second || black != 56*time.Second {
+		t.Errorf("%s and %s left, want 56s each", white, black)
+	}
+}
+
+func TestMoveNotations(t *testing.T) {
+	for notation, valid := range map[string]bool{"": true, "uci": true, "san": true, "lan": true, "SAN": false, "pgn": false} {
+		if validNotation(notation) != valid {
+			t.Errorf("notation %q valid %t", notation, !valid)
+		}
+	}
+
+	var controller ChessGamesController
+	game := newTestGame(t, &controller)
+	/* Moves may come in any notation, castling also with zeros */
+	playMoves(t, game, clockStart, "e4", "e7e5", "Ng1-f3", "Nb8c6", "Bf1c4", "Bc5", "0-0")
+	events, err := game.EventsSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* Events read back from the log hold their update as JSON */
+	data, err := json.Marshal(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := []GameEvent{}
+	if err := json.Unmarshal(data, &logged); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		NotationUCI: {"e2e4", "e7e5", "g1f3", "b8c6", "f1c4", "f8c5", "e1g1"},
+		NotationSAN: {"e4", "e5", "Nf3", "Nc6", "Bc4", "Bc5", "O-O"},
+		NotationLAN: {"e2-e4", "e7-e5", "Ng1-f3", "Nb8-c6", "Bf1-c4", "Bf8-c5", "O-O"},
+	}
+	for notation, moves := range want {
+		for _, events := range [][]GameEvent{events, logged} {
+			/* Each notation replays to the same game */
+			replay := newTestGame(t, &ChessGamesController{})
+			got := []string{}
+			for _, event := range events {
+				event := inNotation(event, notation).(GameEvent)
+				update, err := event.Decode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if move, ok := update.(GameMoveUpdate); ok {
+					got = append(got, move.Move)
+					playMoves(t, replay, clockStart, move.Move)
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(moves, " ") {
+				t.Errorf("%s: moves %v, want %v", notation, got, moves)
+			}
+			if replay.FEN() != game.FEN() {
+				t.Errorf("%s: replayed to %s, want %s", notation, replay.FEN(), game.FEN())
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package chess_server
+
+import (
+	"math"
+)
+
+/*
+ * Glicko-2 as described in Glickman's "Example of the Glicko-2 system",
+ * with every game treated as a rating period of its own
+ */
+const (
+	InitialRating     = 1500.0
+	InitialDeviation  = 350.0
+	InitialVolatility = 0.06
+	/* Constrains how much the volatility can change */
+	glickoTau = 0.5
+	/* Converts between the Glicko and Glicko-2 scales */
+	glickoScale   = 173.7178
+	glickoEpsilon = 0.000001
+)
+
+/* Rating, rating deviation and volatility of a player */
+type Glicko struct {
+	Rating     float64 `json:"rating"`
+	Deviation  float64 `json:"deviation"`
+	Volatility float64 `json:"volatility"`
+}
+
+func NewGlicko() Glicko {
+	return Glicko{
+		Rating:     InitialRating,
+		Deviation:  InitialDeviation,
+		Volatility: InitialVolatility,
+	}
+}
+
+/* A game against an opponent, score is 1 for a win, 0.5 for a draw and 0 for a loss */
+type GlickoResult struct {
+	Opponent Glicko
+	Score    float64
+}
+
+func glickoG(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+func glickoE(mu float64, opponentMu float64, opponentPhi float64) float64 {
+	return 1 / (1 + math.Exp(-glickoG(opponentPhi)*(mu-opponentMu)))
+}
+
+/* The player's rating after a rating period with the given results */
+func (p Glicko) Update(results []GlickoResult) Glicko {
+	mu := (p.Rating - InitialRating) / glickoScale
+	phi := p.Deviation / glickoScale
+	sigma := p.Volatility
+	if len(results) == 0 {
+		/* Only the deviation grows while a player does not play */
+		phi = math.Sqrt(phi*phi + sigma*sigma)
+		return Glicko{Rating: p.Rating, Deviation: phi * glickoScale, Volatility: sigma}
+	}
+
+	/* Estimated variance and improvement from the results */
+	vInverse := 0.0
+	improvement := 0.0
+	for _, result := range results {
+		opponentMu := (result.Opponent.Rating - InitialRating) / glickoScale
+		opponentPhi := result.Opponent.Deviation / glickoScale
+		g := glickoG(opponentPhi)
+		e := glickoE(mu, opponentMu, opponentPhi)
+		vInverse += g * g * e * (1 - e)
+		improvement += g * (result.Score - e)
+	}
+	v := 1 / vInverse
+	delta := v * improvement
+
+	/* New volatility by the Illinois algorithm */
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		return ex*(delta*delta-phi*phi-v-ex)/(2*math.Pow(phi*phi+v+ex, 2)) - (x-a)/(glickoTau*glickoTau)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickoTau) < 0 {
+			k += 1
+		}
+		B = a - k*glickoTau
+	}
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoEpsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	newSigma := math.Exp(A / 2)
+
+	phiStar := math.Sqrt(phi*phi + newSigma*newSigma)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*improvement
+	return Glicko{
+		Rating:     newMu*glickoScale + InitialRating,
+		Deviation:  newPhi * glickoScale,
+		Volatility: newSigma,
+	}
+}
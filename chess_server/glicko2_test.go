@@ -0,0 +1,38 @@
+package chess_server
+
+import (
+	"math"
+	"testing"
+)
+
+/* The worked example in Glickman's "Example of the Glicko-2 system" */
+func TestGlickoExample(t *testing.T) {
+	player := Glicko{Rating: 1500, Deviation: 200, Volatility: 0.06}
+	next := player.Update([]GlickoResult{
+		{Opponent: Glicko{Rating: 1400, Deviation: 30, Volatility: 0.06}, Score: 1},
+		{Opponent: Glicko{Rating: 1550, Deviation: 100, Volatility: 0.06}, Score: 0},
+		{Opponent: Glicko{Rating: 1700, Deviation: 300, Volatility: 0.06}, Score: 0},
+	})
+	for _, c := range []struct {
+		name      string
+		got, want float64
+		tolerance float64
+	}{
+		{"rating", next.Rating, 1464.06, 0.01},
+		{"deviation", next.Deviation, 151.52, 0.01},
+		{"volatility", next.Volatility, 0.05999, 0.00001},
+	} {
+		if math.Abs(c.got-c.want) > c.tolerance {
+			t.Errorf("%s %f, want %f", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestGlickoWithoutGames(t *testing.T) {
+	/* Not playing only makes the rating less certain */
+	player := Glicko{Rating: 1700, Deviation: 50, Volatility: 0.06}
+	next := player.Update(nil)
+	if next.Rating != player.Rating || next.Deviation <= player.Deviation {
+		t.Errorf("%+v after no games, was %+v", next, player)
+	}
+}
@@ -1,21 +1,455 @@
 package chess_server
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"github.com/notnil/chess"
 )
 
-// Make asynchronous?
+/* What a player looking for a game asks for, as query parameters or JSON */
+type FindMatchRequest struct {
+	Mode string `json:"mode" query:"mode"`
+	/* Chess960 players may ask for a specific start position */
+	StartPosition *int `json:"start_position" query:"start_position"`
+	/* Rating of anonymous players, logged in ones are matched by their own */
+	Rating *int `json:"rating" query:"rating"`
+	/* Time control in seconds, the controller's default if base is not given */
+	Base      *int      `json:"base" query:"base"`
+	Increment int       `json:"increment" query:"increment"`
+	Clock     ClockMode `json:"clock" query:"clock"`
+}
+
+/* Checks the request and fills in the defaults, leaving the channels to the caller */
+func (r FindMatchRequest) matchRequest(defaults TimeControl) (MatchRequest, error) {
+	request := MatchRequest{
+		Mode:          r.Mode,
+		StartPosition: RandomStartPosition,
+		TimeControl:   defaults,
+		Rating:        DefaultRating,
+	}
+	if request.Mode == "" {
+		request.Mode = ModeStandard
+	}
+	if _, ok := ModeSeats[request.Mode]; !ok {
+		return request, errors.New("Unknown game mode")
+	}
+	if r.StartPosition != nil {
+		n := *r.StartPosition
+		if n < 0 || n >= 960 || request.Mode != ModeChess960 {
+			return request, errors.New("Invalid start position")
+		}
+		request.StartPosition = n
+	}
+	if r.Rating != nil {
+		request.Rating = *r.Rating
+	}
+	if r.Base != nil {
+		if *r.Base < 0 || r.Increment < 0 {
+			return request, errors.New("Invalid time control")
+		}
+		request.TimeControl = TimeControl{
+			Base:      time.Duration(*r.Base) * time.Second,
+			Increment: time.Duration(r.Increment) * time.Second,
+			Mode:      r.Clock,
+		}
+		switch r.Clock {
+		case "":
+			/* Same pool as asking for fischer explicitly */
+			request.TimeControl.Mode = ClockFischer
+		case ClockFischer, ClockBronstein, ClockSimpleDelay:
+		default:
+			return request, errors.New("Unknown clock mode")
+		}
+	}
+	return request, nil
+}
+
+/* The request with the player's own rating looked up if they are logged in */
+func (s *ChessServer) matchRequest(params FindMatchRequest, user string) (MatchRequest, error) {
+	request, err := params.matchRequest(s.MatchMakingController.TimeControl)
+	if err != nil || user == "" {
+		return request, err
+	}
+	request.User = user
+	request.Rating = s.Ratings.Rating(user, RatingPool(request.Mode, request.TimeControl)).Rating
+	return request, nil
+}
+
+/*
+ * Queues the player for a game of the given mode, time control and rating
+ * and answers once they are paired or have waited too long. Players who
+ * hang up are taken out of the queue. The /matchmaking websocket does the
+ * same while telling the player where they stand.
+ */
 func FindMatch(c echo.Context) error {
 	cc := c.(*ChessServerContext)
-	response := make(chan MatchFoundResponse)
-	cc.Server.MatchMakingController.FindMatch(response)
+	var params FindMatchRequest
+	if err := cc.Bind(&params); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	user, err := cc.Server.Authenticate(cc)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	matchmaking := &cc.Server.MatchMakingController
+	request, err := cc.Server.matchRequest(params, user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	response := make(chan interface{}, 1)
+	request.Response = response
+	matchmaking.FindMatch(request)
+
+	select {
+	case responseJSON, ok := <-response:
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Could not start the game")
+		}
+		return cc.JSON(http.StatusOK, responseJSON)
+	case <-cc.Request().Context().Done():
+		matchmaking.CancelMatch(response)
+		return nil
+	}
+}
+
+/*
+ * Settings of a custom game or a challenge, from the query string, a form or
+ * a JSON body
+ */
+type CreateGameRequest struct {
+	FEN  string `json:"fen" form:"fen" query:"fen"`
+	Mode string `json:"mode" form:"mode" query:"mode"`
+	/* Chess960 start position number when no FEN is given */
+	StartPosition *int `json:"start_position" form:"start_position" query:"start_position"`
+	/* Color of the player creating the game: white, black or random */
+	Color string `json:"color" form:"color" query:"color"`
+	/* Time control in seconds, untimed if base is 0 */
+	Base      int       `json:"base" form:"base" query:"base"`
+	Increment int       `json:"increment" form:"increment" query:"increment"`
+	Clock     ClockMode `json:"clock" form:"clock" query:"clock"`
+}
+
+/*
+ * Checks the settings and turns them into the options of the new game and
+ * the color of the player asking for it, whose seat is kept for user if
+ * they are logged in
+ */
+func (r CreateGameRequest) gameOptions(user string) (GameNewUpdate, chess.Color, error) {
+	options := GameNewUpdate{
+		Mode: r.Mode,
+		TimeControl: TimeControl{
+			Base:      time.Duration(r.Base) * time.Second,
+			Increment: time.Duration(r.Increment) * time.Second,
+			Mode:      r.Clock,
+		},
+		StartPosition: RandomStartPosition,
+		FEN:           r.FEN,
+	}
+	if options.Mode == "" {
+		options.Mode = ModeStandard
+	}
+	if ModeSeats[options.Mode] != 2 {
+		return options, chess.NoColor, errors.New("Unknown game mode")
+	}
+	if r.StartPosition != nil {
+		n := *r.StartPosition
+		if n < 0 || n >= 960 || options.Mode != ModeChess960 || r.FEN != "" {
+			return options, chess.NoColor, errors.New("Invalid start position")
+		}
+		options.StartPosition = n
+	}
+	if r.Base < 0 || r.Increment < 0 {
+		return options, chess.NoColor, errors.New("Invalid time control")
+	}
+	switch r.Clock {
+	case "", ClockFischer, ClockBronstein, ClockSimpleDelay:
+	default:
+		return options, chess.NoColor, errors.New("Unknown clock mode")
+	}
+	color := chess.White
+	switch r.Color {
+	case "", "white":
+	case "black":
+		color = chess.Black
+	case "random":
+		if rand.Intn(2) == 1 {
+			color = chess.Black
+		}
+	default:
+		return options, chess.NoColor, errors.New("Unknown color")
+	}
+	options.SetUser(color, user)
+	if options.FEN != "" {
+		/* Set the position up once here so players hear why it can not be played */
+		variant, err := NewVariant(options.Mode, options, nil)
+		if err != nil {
+			return options, chess.NoColor, errors.New("Invalid position: " + err.Error())
+		}
+		if outcome, _ := variant.Outcome(); outcome != chess.NoOutcome {
+			return options, chess.NoColor, errors.New("Invalid position: the game is already over")
+		}
+	}
+	return options, color, nil
+}
+
+/*
+ * The two ways into a custom game. Each is what the player sends as the
+ * player_joined_update on /play.
+ */
+type GameCreatedResponse struct {
+	T        string             `json:"type"`
+	GameId   uint64             `json:"game_id"`
+	FEN      string             `json:"fen"`
+	Creator  MatchFoundResponse `json:"creator"`
+	Opponent MatchFoundResponse `json:"opponent"`
+}
 
-	responseJSON := <-response
+/* Sets up a game between two players from a position of their choosing */
+func CreateGame(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	var request CreateGameRequest
+	if err := cc.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	if request.FEN == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing FEN")
+	}
+	user, err := cc.Server.Authenticate(cc)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	options, creator, err := request.gameOptions(user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	game, err := cc.Server.ChessGamesController.Events.AddNewGame(options)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid position: "+err.Error())
+	}
+	return cc.JSON(http.StatusOK, GameCreatedResponse{
+		T:        "game_created",
+		GameId:   game.GameId,
+		FEN:      game.StartFEN,
+		Creator:  game.matchFound(creator),
+		Opponent: game.matchFound(creator.Other()),
+	})
+}
+
+/* A challenge as returned to the player who made it */
+type ChallengeCreatedResponse struct {
+	T     string `json:"type"`
+	Token string `json:"token"`
+	/* Needed to cancel the challenge and to be told when it is accepted */
+	Secret  string    `json:"secret"`
+	Expires time.Time `json:"expires"`
+}
+
+/*
+ * Creates a challenge with the settings of CreateGameRequest, minus the
+ * required FEN. Its token is meant to be shared with the opponent.
+ */
+func CreateChallenge(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	var request CreateGameRequest
+	if err := cc.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	user, err := cc.Server.Authenticate(cc)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	options, color, err := request.gameOptions(user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	challenge, err := cc.Server.MatchMakingController.CreateChallenge(options, color)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return cc.JSON(http.StatusOK, ChallengeCreatedResponse{
+		T:       "challenge_created",
+		Token:   challenge.Token,
+		Secret:  challenge.Secret,
+		Expires: challenge.Expires,
+	})
+}
+
+/*
+ * Accepts the challenge with the given token and starts the game. The game
+ * is rated if both players are logged in.
+ */
+func AcceptChallenge(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	user, err := cc.Server.Authenticate(cc)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	match, err := cc.Server.MatchMakingController.AcceptChallenge(cc.Param("token"), user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return cc.JSON(http.StatusOK, match)
+}
+
+/* Withdraws a challenge, for the player who made it */
+func CancelChallenge(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	err := cc.Server.MatchMakingController.CancelChallenge(cc.Param("token"), cc.QueryParam("secret"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return cc.NoContent(http.StatusNoContent)
+}
 
-	return cc.JSON(http.StatusOK, responseJSON)
+/* Username and password, as JSON or a form */
+type CredentialsRequest struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+}
+
+type AccountCreatedResponse struct {
+	T        string    `json:"type"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+}
+
+/* A session token to send as "Authorization: Bearer" or ?token= on websockets */
+type SessionResponse struct {
+	T        string    `json:"type"`
+	Username string    `json:"username"`
+	Token    string    `json:"token"`
+	Expires  time.Time `json:"expires"`
+}
+
+func Register(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	var request CredentialsRequest
+	if err := cc.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	account, err := cc.Server.Accounts.Register(request.Username, request.Password)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return cc.JSON(http.StatusCreated, AccountCreatedResponse{
+		T:        "account_created",
+		Username: account.Username,
+		Created:  account.Created,
+	})
+}
+
+func Login(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	var request CredentialsRequest
+	if err := cc.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	account, err := cc.Server.Accounts.Authenticate(request.Username, request.Password)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	token, expires, err := cc.Server.NewSession(account)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Could not create a session")
+	}
+	return cc.JSON(http.StatusOK, SessionResponse{
+		T:        "session",
+		Username: account.Username,
+		Token:    token,
+		Expires:  expires,
+	})
+}
+
+/* Address of the server as seen by the client, for links in exported games */
+func siteURL(c echo.Context) string {
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+/* A finished game in PGN, requested as /games/<id>.pgn */
+func GetGamePGN(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	file := cc.Param("file")
+	if !strings.HasSuffix(file, ".pgn") {
+		return echo.NewHTTPError(http.StatusNotFound, "No such game")
+	}
+	gameId, err := strconv.ParseUint(strings.TrimSuffix(file, ".pgn"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "No such game")
+	}
+	game, ok := cc.Server.Archive.Game(gameId)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "No such game")
+	}
+	return cc.Blob(http.StatusOK, "application/x-chess-pgn", []byte(game.PGN(siteURL(cc))))
+}
+
+type EventsResponse struct {
+	GameId uint64      `json:"game_id"`
+	Events []GameEvent `json:"events"`
+}
+
+/*
+ * The events of a live game after the since query parameter, all of them
+ * without it, with moves in the notation query parameter
+ */
+func GetGameEvents(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	gameId, err := strconv.ParseUint(cc.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "No such game")
+	}
+	since := uint64(0)
+	if param := cc.QueryParam("since"); param != "" {
+		if since, err = strconv.ParseUint(param, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid since")
+		}
+	}
+	notation := cc.QueryParam("notation")
+	if !validNotation(notation) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown notation")
+	}
+	events, err := cc.Server.ChessGamesController.Events.GameEvents(gameId, since)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	for i, event := range events {
+		events[i] = inNotation(event, notation).(GameEvent)
+	}
+	return cc.JSON(http.StatusOK, EventsResponse{GameId: gameId, Events: events})
+}
+
+/* Every finished game of a player in PGN, oldest first */
+func GetUserGamesPGN(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	user := strings.TrimSuffix(cc.Param("user"), ".pgn")
+	if !ValidUser(user) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user")
+	}
+	site := siteURL(cc)
+	pgn := []string{}
+	for _, game := range cc.Server.Archive.ByUser(user) {
+		pgn = append(pgn, game.PGN(site))
+	}
+	cc.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", user+".pgn"))
+	return cc.Blob(http.StatusOK, "application/x-chess-pgn", []byte(strings.Join(pgn, "\n")))
+}
+
+/* Current ratings of a player in every pool they have played in, with their history */
+func GetRatings(c echo.Context) error {
+	cc := c.(*ChessServerContext)
+	user := cc.Param("user")
+	if !ValidUser(user) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user")
+	}
+	return cc.JSON(http.StatusOK, cc.Server.Ratings.History(user))
 }
 
 var (
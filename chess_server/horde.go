@@ -0,0 +1,72 @@
+package chess_server
+
+import (
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeHorde, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		return NewHordeBoard(options)
+	})
+}
+
+const HordeFEN = "rnbqkbnr/pppppppp/8/1PP2PP1/PPPPPPPP/PPPPPPPP/PPPPPPPP/PPPPPPPP w kq - 0 1"
+
+/*
+ * HordeBoard is the board of a horde game: white has 36 pawns and no king
+ * and wins by checkmate, black wins by capturing every white piece.
+ */
+type HordeBoard struct {
+	positionGame
+}
+
+func NewHordeBoard(options GameNewUpdate) (*HordeBoard, error) {
+	start, err := startingPosition(options, HordeFEN, HordeMoves)
+	if err != nil {
+		return nil, err
+	}
+	return &HordeBoard{newPositionGame(start)}, nil
+}
+
+func (b *HordeBoard) FEN() string {
+	return b.Position.FEN(false)
+}
+
+func (b *HordeBoard) ApplyMove(move string) error {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return err
+	}
+	b.play(b.Position.Play(m))
+	return nil
+}
+
+func (b *HordeBoard) Outcome() (chess.Outcome, string) {
+	if b.Decided != chess.NoOutcome {
+		return b.Decided, b.DecidedBy
+	}
+	if !b.Position.hasPieces(chess.White) {
+		return chess.BlackWon, "horde_captured"
+	}
+	if outcome, method := b.mateOutcome(); outcome != chess.NoOutcome {
+		return outcome, method
+	}
+	return b.automaticDraw()
+}
+
+/* Black can always win by taking the rest of the horde, even with a bare king */
+func (b *HordeBoard) HasMatingMaterial(color chess.Color) bool {
+	if color == chess.Black {
+		return true
+	}
+	return hasMatingMaterial(b.Position.Board[:], color)
+}
+
+func (b *HordeBoard) AddSyncState(update *GameSyncUpdate) {
+}
+
+func (b *HordeBoard) AddMoveState(update *GameMoveUpdate) {
+}
+
+func (b *HordeBoard) Setup(options *GameNewUpdate) {
+}
@@ -0,0 +1,72 @@
+package chess_server
+
+import (
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeKingOfTheHill, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		return NewKingOfTheHillBoard(options)
+	})
+}
+
+/* d4, e4, d5 and e5 */
+var hillSquares = []int{27, 28, 35, 36}
+
+/* Regular chess where bringing the king to one of the four center squares also wins */
+type KingOfTheHillBoard struct {
+	positionGame
+}
+
+func NewKingOfTheHillBoard(options GameNewUpdate) (*KingOfTheHillBoard, error) {
+	start, err := startingPosition(options, StartingFEN, StandardMoves)
+	if err != nil {
+		return nil, err
+	}
+	return &KingOfTheHillBoard{newPositionGame(start)}, nil
+}
+
+func (b *KingOfTheHillBoard) FEN() string {
+	return b.Position.FEN(false)
+}
+
+func (b *KingOfTheHillBoard) ApplyMove(move string) error {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return err
+	}
+	b.play(b.Position.Play(m))
+	return nil
+}
+
+/* A bare king can still walk to the center, so there is no insufficient material */
+func (b *KingOfTheHillBoard) Outcome() (chess.Outcome, string) {
+	if b.Decided != chess.NoOutcome {
+		return b.Decided, b.DecidedBy
+	}
+	for _, sq := range hillSquares {
+		switch b.Position.Board[sq] {
+		case chess.WhiteKing:
+			return chess.WhiteWon, "king_of_the_hill"
+		case chess.BlackKing:
+			return chess.BlackWon, "king_of_the_hill"
+		}
+	}
+	if outcome, method := b.mateOutcome(); outcome != chess.NoOutcome {
+		return outcome, method
+	}
+	return b.automaticDraw()
+}
+
+func (b *KingOfTheHillBoard) HasMatingMaterial(color chess.Color) bool {
+	return true
+}
+
+func (b *KingOfTheHillBoard) AddSyncState(update *GameSyncUpdate) {
+}
+
+func (b *KingOfTheHillBoard) AddMoveState(update *GameMoveUpdate) {
+}
+
+func (b *KingOfTheHillBoard) Setup(options *GameNewUpdate) {
+}
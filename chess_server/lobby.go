@@ -0,0 +1,314 @@
+package chess_server
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/notnil/chess"
+)
+
+/*
+ * Updates a lobby connection can fall behind by before it is dropped, so a
+ * slow client can not hold up matchmaking
+ */
+const lobbyStreamSize = 128
+
+/*
+ * An open game request in the lobby. It belongs to the lobby connection that
+ * posted it and goes away with it.
+ */
+type Seek struct {
+	SeekId   uint64
+	MemberId uint64
+	Options  GameNewUpdate
+	/* Color of the player who posted the seek */
+	Color chess.Color
+	/*
+	 * Rating of the player who posted it and the ratings they want to play.
+	 * Logged in players get their own rating in the pool of the seek.
+	 */
+	Rating    int
+	RatingMin int
+	RatingMax int
+}
+
+/* Whether a player rated rating may accept the seek. Zero limits are open. */
+func (s *Seek) Compatible(rating int) bool {
+	if s.RatingMin != 0 && rating < s.RatingMin {
+		return false
+	}
+	if s.RatingMax != 0 && rating > s.RatingMax {
+		return false
+	}
+	return true
+}
+
+/* A seek as shown in the lobby */
+type SeekUpdate struct {
+	SeekId        uint64    `json:"seek_id"`
+	User          string    `json:"user,omitempty"`
+	Mode          string    `json:"mode"`
+	StartPosition *int      `json:"start_position,omitempty"`
+	FEN           string    `json:"fen,omitempty"`
+	BaseMs        int64     `json:"base_ms"`
+	IncrementMs   int64     `json:"increment_ms"`
+	Clock         ClockMode `json:"clock"`
+	Color         string    `json:"color"`
+	Rating        int       `json:"rating"`
+	RatingMin     int       `json:"rating_min"`
+	RatingMax     int       `json:"rating_max"`
+}
+
+func (s *Seek) Update() SeekUpdate {
+	update := SeekUpdate{
+		SeekId:      s.SeekId,
+		User:        s.Options.User(s.Color),
+		Mode:        s.Options.Mode,
+		FEN:         s.Options.FEN,
+		BaseMs:      s.Options.TimeControl.Base.Milliseconds(),
+		IncrementMs: s.Options.TimeControl.Increment.Milliseconds(),
+		Clock:       s.Options.TimeControl.Mode,
+		Color:       s.Color.String(),
+		Rating:      s.Rating,
+		RatingMin:   s.RatingMin,
+		RatingMax:   s.RatingMax,
+	}
+	if update.Clock == "" {
+		update.Clock = ClockFischer
+	}
+	if s.Options.StartPosition != RandomStartPosition {
+		n := s.Options.StartPosition
+		update.StartPosition = &n
+	}
+	return update
+}
+
+/* Every open seek, sent when a connection joins the lobby */
+type LobbySnapshotUpdate struct {
+	Seeks []SeekUpdate `json:"seeks"`
+}
+
+type SeekAddedUpdate struct {
+	Seek SeekUpdate `json:"seek"`
+}
+
+type SeekRemovedUpdate struct {
+	SeekId uint64 `json:"seek_id"`
+}
+
+/* Tells a lobby connection why its last request failed */
+type LobbyErrorUpdate struct {
+	Message string `json:"message"`
+}
+
+/* Sent by a lobby connection to post a seek, with the settings of a custom game */
+type SeekCreateUpdate struct {
+	CreateGameRequest
+	Rating    int `json:"rating"`
+	RatingMin int `json:"rating_min"`
+	RatingMax int `json:"rating_max"`
+}
+
+type SeekCancelUpdate struct {
+	SeekId uint64 `json:"seek_id"`
+}
+
+type SeekAcceptUpdate struct {
+	SeekId uint64 `json:"seek_id"`
+	/* Rating of anonymous players, logged in ones are looked up */
+	Rating int `json:"rating"`
+}
+
+type LobbyJoinRequest struct {
+}
+
+type LobbyLeaveRequest struct {
+	MemberId uint64
+}
+
+type SeekCreateRequest struct {
+	MemberId uint64
+	Seek     Seek
+}
+
+type SeekCancelRequest struct {
+	MemberId uint64
+	SeekId   uint64
+}
+
+type SeekAcceptRequest struct {
+	MemberId uint64
+	SeekId   uint64
+	User     string
+	Rating   int
+}
+
+/* Lobby requests are handled by the matchmaking goroutine */
+type LobbyRequest struct {
+	Update   interface{}
+	Response chan<- interface{}
+}
+
+type LobbyResponse struct {
+	MemberId uint64
+	Stream   <-chan GameUpdate
+	SeekId   uint64
+	Match    MatchFoundResponse
+	Error    error
+}
+
+func (m *MatchMakingController) lobbyRequest(update interface{}) LobbyResponse {
+	response := make(chan interface{})
+	m.LobbyRequests <- LobbyRequest{Update: update, Response: response}
+	return (<-response).(LobbyResponse)
+}
+
+/*
+ * Adds a connection to the lobby. The stream starts with the open seeks and
+ * then carries every seek added or removed, and match_found once one of the
+ * connection's seeks is accepted. It is closed if the connection falls too
+ * far behind.
+ */
+func (m *MatchMakingController) JoinLobby() (uint64, <-chan GameUpdate) {
+	response := m.lobbyRequest(LobbyJoinRequest{})
+	return response.MemberId, response.Stream
+}
+
+/* Removes a connection and its seeks from the lobby */
+func (m *MatchMakingController) LeaveLobby(memberId uint64) {
+	m.lobbyRequest(LobbyLeaveRequest{MemberId: memberId})
+}
+
+func (m *MatchMakingController) CreateSeek(memberId uint64, seek Seek) (uint64, error) {
+	response := m.lobbyRequest(SeekCreateRequest{MemberId: memberId, Seek: seek})
+	return response.SeekId, response.Error
+}
+
+func (m *MatchMakingController) CancelSeek(memberId uint64, seekId uint64) error {
+	return m.lobbyRequest(SeekCancelRequest{MemberId: memberId, SeekId: seekId}).Error
+}
+
+/* Starts the game of a seek and returns the seat of the player accepting it */
+func (m *MatchMakingController) AcceptSeek(memberId uint64, seekId uint64, user string, rating int) (MatchFoundResponse, error) {
+	response := m.lobbyRequest(SeekAcceptRequest{MemberId: memberId, SeekId: seekId, User: user, Rating: rating})
+	return response.Match, response.Error
+}
+
+func (m *MatchMakingController) handleLobby(request LobbyRequest) {
+	var response LobbyResponse
+	switch update := request.Update.(type) {
+	case LobbyJoinRequest:
+		response.MemberId, response.Stream = m.joinLobby()
+	case LobbyLeaveRequest:
+		m.leaveLobby(update.MemberId)
+	case SeekCreateRequest:
+		response.SeekId, response.Error = m.createSeek(update.MemberId, update.Seek)
+	case SeekCancelRequest:
+		response.Error = m.cancelSeek(update.MemberId, update.SeekId)
+	case SeekAcceptRequest:
+		response.Match, response.Error = m.acceptSeek(update)
+	}
+	request.Response <- response
+}
+
+func (m *MatchMakingController) joinLobby() (uint64, <-chan GameUpdate) {
+	memberId := m.NextLobbyMemberId
+	m.NextLobbyMemberId += 1
+	stream := make(chan GameUpdate, lobbyStreamSize)
+	snapshot := LobbySnapshotUpdate{Seeks: []SeekUpdate{}}
+	for _, seek := range m.Seeks {
+		snapshot.Seeks = append(snapshot.Seeks, seek.Update())
+	}
+	sort.Slice(snapshot.Seeks, func(i, j int) bool {
+		return snapshot.Seeks[i].SeekId < snapshot.Seeks[j].SeekId
+	})
+	stream <- snapshot
+	m.LobbyMembers[memberId] = stream
+	return memberId, stream
+}
+
+func (m *MatchMakingController) leaveLobby(memberId uint64) {
+	if stream, ok := m.LobbyMembers[memberId]; ok {
+		delete(m.LobbyMembers, memberId)
+		close(stream)
+	}
+	for seekId, seek := range m.Seeks {
+		if seek.MemberId == memberId {
+			m.removeSeek(seekId)
+		}
+	}
+}
+
+/* Sends an update to one lobby connection, dropping it if it is not keeping up */
+func (m *MatchMakingController) sendToLobbyMember(memberId uint64, update GameUpdate) {
+	stream, ok := m.LobbyMembers[memberId]
+	if !ok {
+		return
+	}
+	select {
+	case stream <- update:
+	default:
+		m.leaveLobby(memberId)
+	}
+}
+
+func (m *MatchMakingController) broadcastToLobby(update GameUpdate) {
+	for memberId := range m.LobbyMembers {
+		m.sendToLobbyMember(memberId, update)
+	}
+}
+
+func (m *MatchMakingController) createSeek(memberId uint64, seek Seek) (uint64, error) {
+	if _, ok := m.LobbyMembers[memberId]; !ok {
+		return 0, errors.New("Not in the lobby")
+	}
+	if user := seek.Options.User(seek.Color); user != "" {
+		seek.Rating = m.Ratings.Rating(user, RatingPool(seek.Options.Mode, seek.Options.TimeControl)).Rating
+	}
+	seek.SeekId = m.NextSeekId
+	seek.MemberId = memberId
+	m.NextSeekId += 1
+	m.Seeks[seek.SeekId] = &seek
+	m.broadcastToLobby(SeekAddedUpdate{Seek: seek.Update()})
+	return seek.SeekId, nil
+}
+
+func (m *MatchMakingController) removeSeek(seekId uint64) {
+	delete(m.Seeks, seekId)
+	m.broadcastToLobby(SeekRemovedUpdate{SeekId: seekId})
+}
+
+func (m *MatchMakingController) cancelSeek(memberId uint64, seekId uint64) error {
+	seek, ok := m.Seeks[seekId]
+	if !ok || seek.MemberId != memberId {
+		return errors.New("No such seek")
+	}
+	m.removeSeek(seekId)
+	return nil
+}
+
+func (m *MatchMakingController) acceptSeek(request SeekAcceptRequest) (MatchFoundResponse, error) {
+	seek, ok := m.Seeks[request.SeekId]
+	if !ok {
+		return MatchFoundResponse{}, errors.New("No such seek")
+	}
+	if seek.MemberId == request.MemberId || (request.User != "" && request.User == seek.Options.User(seek.Color)) {
+		return MatchFoundResponse{}, errors.New("Can not accept your own seek")
+	}
+	rating := request.Rating
+	if request.User != "" {
+		rating = m.Ratings.Rating(request.User, RatingPool(seek.Options.Mode, seek.Options.TimeControl)).Rating
+	}
+	if !seek.Compatible(rating) {
+		return MatchFoundResponse{}, errors.New("Rating outside the range of the seek")
+	}
+	options := seek.Options
+	options.SetUser(seek.Color.Other(), request.User)
+	game, err := m.NewGameRequests.AddNewGame(options)
+	if err != nil {
+		return MatchFoundResponse{}, err
+	}
+	m.removeSeek(seek.SeekId)
+	m.sendToLobbyMember(seek.MemberId, game.matchFound(seek.Color))
+	return game.matchFound(seek.Color.Other()), nil
+}
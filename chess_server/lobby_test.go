@@ -0,0 +1,104 @@
+package chess_server
+
+import (
+	"testing"
+
+	"github.com/notnil/chess"
+)
+
+func TestSeekCompatible(t *testing.T) {
+	tests := []struct {
+		min, max, rating int
+		compatible       bool
+	}{
+		{0, 0, 800, true},
+		{1400, 0, 1399, false},
+		{1400, 0, 1400, true},
+		{0, 1600, 1600, true},
+		{0, 1600, 1601, false},
+		{1400, 1600, 1500, true},
+		{1400, 1600, 2000, false},
+	}
+	for _, test := range tests {
+		seek := Seek{RatingMin: test.min, RatingMax: test.max}
+		if seek.Compatible(test.rating) != test.compatible {
+			t.Errorf("%d-%d for %d: compatible %t", test.min, test.max, test.rating, !test.compatible)
+		}
+	}
+}
+
+/* Reads the updates waiting on a lobby stream */
+func lobbyUpdates(stream <-chan GameUpdate) []GameUpdate {
+	updates := []GameUpdate{}
+	for len(stream) > 0 {
+		updates = append(updates, <-stream)
+	}
+	return updates
+}
+
+func TestLobby(t *testing.T) {
+	m := newTestMatchMaker()
+	alice, aliceStream := m.joinLobby()
+	bob, bobStream := m.joinLobby()
+	seek := Seek{Options: GameNewUpdate{Mode: ModeStandard, TimeControl: DefaultTimeControl}, Color: chess.White, Rating: 1500, RatingMin: 1400, RatingMax: 1600}
+	first, err := m.createSeek(alice, seek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.createSeek(alice, seek); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := m.createSeek(bob, seek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lobbyUpdates(aliceStream)
+	lobbyUpdates(bobStream)
+
+	if _, err := m.acceptSeek(SeekAcceptRequest{MemberId: alice, SeekId: first, Rating: 1500}); err == nil {
+		t.Error("accepted own seek")
+	}
+	if _, err := m.acceptSeek(SeekAcceptRequest{MemberId: bob, SeekId: first, Rating: 1700}); err == nil {
+		t.Error("accepted a seek outside its rating range")
+	}
+	if err := m.cancelSeek(bob, first); err == nil {
+		t.Error("cancelled another member's seek")
+	}
+
+	/* Leaving takes the member's seeks along */
+	m.leaveLobby(alice)
+	if len(m.Seeks) != 1 || m.Seeks[kept] == nil {
+		t.Errorf("seeks %v left, want only %d", m.Seeks, kept)
+	}
+	removed := lobbyUpdates(bobStream)
+	if len(removed) != 2 {
+		t.Fatalf("%d updates after alice left, want 2", len(removed))
+	}
+	for _, update := range removed {
+		if _, ok := update.(SeekRemovedUpdate); !ok {
+			t.Errorf("got %+v, want a seek removed", update)
+		}
+	}
+	if _, open := <-aliceStream; open {
+		t.Error("stream of the member who left still open")
+	}
+
+	/* A new member gets the seeks that are left */
+	carol, carolStream := m.joinLobby()
+	if snapshot, ok := (<-carolStream).(LobbySnapshotUpdate); !ok || len(snapshot.Seeks) != 1 || snapshot.Seeks[0].SeekId != kept {
+		t.Errorf("snapshot %+v", snapshot)
+	}
+	match, err := m.acceptSeek(SeekAcceptRequest{MemberId: carol, SeekId: kept, Rating: 1450})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := (<-bobStream).(SeekRemovedUpdate); !ok || found.SeekId != kept {
+		t.Errorf("got %+v, want the accepted seek removed", found)
+	}
+	if found, ok := (<-bobStream).(MatchFoundResponse); !ok || found.GameId != match.GameId || found.PlayerColor != "w" {
+		t.Errorf("seeker got %+v", found)
+	}
+	if len(m.Seeks) != 0 {
+		t.Error("accepted seek still open")
+	}
+}
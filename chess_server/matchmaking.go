@@ -1,9 +1,115 @@
 package chess_server
 
-import "math/rand"
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/notnil/chess"
+)
+
+const (
+	ModeStandard = "standard"
+	ModeBughouse = "bughouse"
+	/* Bughouse where each player plays one color on board 0 and the other on board 1 */
+	ModeBughouse1v1 = "bughouse_1v1"
+	/* Regular chess starting from an opening picked from the opening pool */
+	ModeRandomOpening = "random_opening"
+	ModeCrazyhouse    = "crazyhouse"
+	ModeChess960      = "chess960"
+	ModeThreeCheck    = "three_check"
+	ModeKingOfTheHill = "king_of_the_hill"
+	ModeAtomic        = "atomic"
+	ModeAntichess     = "antichess"
+	ModeHorde         = "horde"
+	ModeRacingKings   = "racing_kings"
+)
+
+/*
+ * Number of players needed to start a game of each mode. Single board
+ * variants are added by RegisterVariant.
+ */
+var ModeSeats = map[string]int{
+	ModeBughouse:    4,
+	ModeBughouse1v1: 2,
+}
+
+/* Time control used for games paired through the matchmaking queue */
+var DefaultTimeControl = TimeControl{
+	Base:      5 * time.Minute,
+	Increment: 3 * time.Second,
+	Mode:      ClockFischer,
+}
+
+/* Rating of players who have not given one */
+const DefaultRating = 1500
 
 type MatchRequest struct {
-	Response chan<- MatchFoundResponse
+	Mode          string
+	/* Chess960 start position number, or RandomStartPosition */
+	StartPosition int
+	TimeControl   TimeControl
+	/* Name the player is rated under, empty for anonymous players */
+	User          string
+	Rating        int
+	/* When the request joined the queue, the rating window grows from then on */
+	Enqueued      time.Time
+	/*
+	 * Gets a MatchFoundResponse or a MatchTimeoutResponse, or is closed if
+	 * the game could not be started. It needs room for that one response,
+	 * so the player can stop listening at any time. It also identifies the
+	 * request when it is cancelled.
+	 */
+	Response      chan<- interface{}
+	/* Optional, gets a QueueUpdate whenever there is room for one */
+	Progress      chan<- QueueUpdate
+}
+
+/* Takes a request out of the queue, e.g. because the player went away */
+type MatchCancelRequest struct {
+	Response chan<- interface{}
+}
+
+/* Where a waiting player stands */
+type QueueUpdate struct {
+	/* Place in the queue of the pool, starting at 1 for the longest waiting player */
+	Position     int   `json:"position"`
+	QueueSize    int   `json:"queue_size"`
+	RatingWindow int   `json:"rating_window"`
+	WaitedMs     int64 `json:"waited_ms"`
+	/* Left out while there is nothing to base an estimate on */
+	EstimatedWaitMs *int64 `json:"estimated_wait_ms,omitempty"`
+}
+
+/*
+ * Players are only paired with others asking for the same mode, start
+ * position and time control
+ */
+type matchPool struct {
+	Mode          string
+	StartPosition int
+	TimeControl   TimeControl
+}
+
+func (r MatchRequest) pool() matchPool {
+	return matchPool{
+		Mode:          r.Mode,
+		StartPosition: r.StartPosition,
+		TimeControl:   r.TimeControl,
+	}
+}
+
+/* Sent to a player whose request could not be handled */
+type MatchErrorResponse struct {
+	T       string `json:"type"`
+	Message string `json:"message"`
+}
+
+/* Sent to a player nobody could be found for within the MatchTimeout */
+type MatchTimeoutResponse struct {
+	T        string `json:"type"`
+	WaitedMs int64  `json:"waited_ms"`
 }
 
 /* Match found results */
@@ -12,64 +118,371 @@ type MatchFoundResponse struct {
 	GameId      uint64 `json:"game_id" xml:"game_id"`
 	PlayerId    uint64 `json:"player_id" xml:"player_id"`
 	PlayerColor string `json:"player_color" xml:"player_color"`
+	Mode        string `json:"mode" xml:"mode"`
+	Board       int    `json:"board" xml:"board"`
+	/* Needed to take the seat, so only the player matched to it gets this */
+	Token       string `json:"token" xml:"token"`
+}
+
+/* What the player in color of game sends as their player_joined_update */
+func (g *ChessGame) matchFound(color chess.Color) MatchFoundResponse {
+	playerId := g.WhitePlayerId
+	if color == chess.Black {
+		playerId = g.BlackPlayerId
+	}
+	seat, _ := g.seat(playerId)
+	return g.seatFound(seat)
+}
+
+func (g *ChessGame) seatFound(seat Seat) MatchFoundResponse {
+	return MatchFoundResponse{
+		T:           "match_found",
+		GameId:      g.GameId,
+		PlayerId:    seat.PlayerId,
+		PlayerColor: seat.Color.String(),
+		Mode:        g.Mode,
+		Board:       seat.Board,
+		Token:       g.SeatTokens[seat.PlayerId],
+	}
 }
 
 type MatchMakingController struct {
 	MatchRequests       chan MatchRequest
+	MatchCancels        chan MatchCancelRequest
 	NewGameRequests     *ChessGamesControllerChannel
+	/* Time control of requests that do not ask for one */
+	TimeControl         TimeControl
+	/*
+	 * Players are paired when their ratings differ by no more than either
+	 * of their windows. A window starts at RatingWindow and grows by
+	 * RatingWindowGrowth every second the player waits, up to
+	 * MaxRatingWindow.
+	 */
+	RatingWindow        int
+	RatingWindowGrowth  int
+	MaxRatingWindow     int
+	/* How long a player waits for a match before giving up */
+	MatchTimeout        time.Duration
+	/* Players waiting for enough opponents, oldest first, per pool */
+	Queues              map[matchPool][]MatchRequest
+	/* Ratings of named players, looked up for seeks */
+	Ratings             *RatingController
+	/* Moving average of how long matched players waited, per pool */
+	AverageWait         map[matchPool]time.Duration
+	ChallengeRequests   chan ChallengeRequest
+	/* Open challenges, and accepted ones until they expire, by token */
+	Challenges          map[string]*Challenge
+	LobbyRequests       chan LobbyRequest
+	/* Open seeks by id and the lobby connections watching them */
+	Seeks               map[uint64]*Seek
+	NextSeekId          uint64
+	LobbyMembers        map[uint64]chan GameUpdate
+	NextLobbyMemberId   uint64
 }
 
-func (m *MatchMakingController) FindMatch(response chan<- MatchFoundResponse) {
-	request := MatchRequest{
-		Response: response,
-	}
+/* Queues request. Its Response gets the outcome. */
+func (m *MatchMakingController) FindMatch(request MatchRequest) {
 	m.MatchRequests <- request
 }
 
+/* Withdraws the request answered on response, if it is still queued */
+func (m *MatchMakingController) CancelMatch(response chan<- interface{}) {
+	m.MatchCancels <- MatchCancelRequest{Response: response}
+}
+
 func (m *MatchMakingController) Run() {
+	/*
+	 * Windows widen and requests time out while nobody new joins the queue,
+	 * and challenges expire
+	 */
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		r1 := <-m.MatchRequests
-		r2 := <-m.MatchRequests
-
-		game := m.NewGameRequests.AddNewGame()
-		gameId := game.GameId
-
-		/* Randomly assign colors */
-		var r1MatchFound MatchFoundResponse
-		var r2MatchFound MatchFoundResponse
-		if rand.Uint32()%2 == 0 {
-			r1MatchFound = MatchFoundResponse{
-				T:           "match_found",
-				GameId:      gameId,
-				PlayerId:    game.WhitePlayerId,
-				PlayerColor: "w",
+		select {
+		case request := <-m.MatchRequests:
+			request.Enqueued = time.Now()
+			pool := request.pool()
+			m.Queues[pool] = append(m.Queues[pool], request)
+			m.match(pool, request.Enqueued)
+			m.sendQueueUpdates(pool, request.Enqueued)
+		case request := <-m.MatchCancels:
+			m.cancel(request.Response)
+		case now := <-ticker.C:
+			for pool := range m.Queues {
+				m.timeOut(pool, now)
+				m.match(pool, now)
+				m.sendQueueUpdates(pool, now)
+			}
+			m.expireChallenges(now)
+		case request := <-m.ChallengeRequests:
+			m.handleChallenge(request)
+		case request := <-m.LobbyRequests:
+			m.handleLobby(request)
+		}
+	}
+}
+
+/* Rating window of a request at time now */
+func (m *MatchMakingController) window(request MatchRequest, now time.Time) int {
+	window := m.RatingWindow + int(now.Sub(request.Enqueued)/time.Second)*m.RatingWindowGrowth
+	if window > m.MaxRatingWindow {
+		return m.MaxRatingWindow
+	}
+	return window
+}
+
+/*
+ * Whether two requests are close enough in rating for both of them. Named
+ * players are never paired with themselves.
+ */
+func (m *MatchMakingController) compatible(a MatchRequest, b MatchRequest, now time.Time) bool {
+	if a.User != "" && a.User == b.User {
+		return false
+	}
+	difference := a.Rating - b.Rating
+	if difference < 0 {
+		difference = -difference
+	}
+	return difference <= m.window(a, now) && difference <= m.window(b, now)
+}
+
+/*
+ * Starts games for as many players of the pool as possible. The longest
+ * waiting player goes first and gets the closest rated opponents that fit
+ * every window of the game.
+ */
+func (m *MatchMakingController) match(pool matchPool, now time.Time) {
+	seats := ModeSeats[pool.Mode]
+	queue := m.Queues[pool]
+	for anchor := 0; anchor < len(queue); anchor++ {
+		others := []int{}
+		for i := anchor + 1; i < len(queue); i++ {
+			if m.compatible(queue[anchor], queue[i], now) {
+				others = append(others, i)
+			}
+		}
+		distance := func(i int) int {
+			difference := queue[i].Rating - queue[anchor].Rating
+			if difference < 0 {
+				return -difference
 			}
-			r2MatchFound = MatchFoundResponse{
-				T:           "match_found",
-				GameId:      gameId,
-				PlayerId:    game.BlackPlayerId,
-				PlayerColor: "b",
+			return difference
+		}
+		sort.SliceStable(others, func(i, j int) bool {
+			return distance(others[i]) < distance(others[j])
+		})
+		group := []int{anchor}
+		for _, i := range others {
+			if len(group) == seats {
+				break
 			}
-		} else {
-			r1MatchFound = MatchFoundResponse{
-				T:           "match_found",
-				GameId:      gameId,
-				PlayerId:    game.BlackPlayerId,
-				PlayerColor: "b",
+			fits := true
+			for _, j := range group {
+				fits = fits && m.compatible(queue[i], queue[j], now)
+			}
+			if fits {
+				group = append(group, i)
+			}
+		}
+		if len(group) < seats {
+			continue
+		}
+		players := []MatchRequest{}
+		taken := map[int]bool{}
+		for _, i := range group {
+			players = append(players, queue[i])
+			taken[i] = true
+		}
+		rest := []MatchRequest{}
+		for i, request := range queue {
+			if !taken[i] {
+				rest = append(rest, request)
+			}
+		}
+		queue = rest
+		/* The anchor has left the queue, so the next one now sits at its index */
+		anchor -= 1
+		m.startGame(pool, players)
+	}
+	if len(queue) == 0 {
+		delete(m.Queues, pool)
+	} else {
+		m.Queues[pool] = queue
+	}
+}
+
+/* Tells the players of the pool who waited too long that there is no match */
+func (m *MatchMakingController) timeOut(pool matchPool, now time.Time) {
+	queue := []MatchRequest{}
+	for _, request := range m.Queues[pool] {
+		waited := now.Sub(request.Enqueued)
+		if waited < m.MatchTimeout {
+			queue = append(queue, request)
+			continue
+		}
+		request.Response <- MatchTimeoutResponse{
+			T:        "match_timeout",
+			WaitedMs: waited.Milliseconds(),
+		}
+	}
+	m.Queues[pool] = queue
+}
+
+func (m *MatchMakingController) cancel(response chan<- interface{}) {
+	for pool, queue := range m.Queues {
+		for i, request := range queue {
+			if request.Response != response {
+				continue
+			}
+			m.Queues[pool] = append(queue[:i:i], queue[i+1:]...)
+			m.sendQueueUpdates(pool, time.Now())
+			return
+		}
+	}
+}
+
+/* Tells every player waiting in the pool where they stand */
+func (m *MatchMakingController) sendQueueUpdates(pool matchPool, now time.Time) {
+	queue := m.Queues[pool]
+	for i, request := range queue {
+		if request.Progress == nil {
+			continue
+		}
+		update := QueueUpdate{
+			Position:     i + 1,
+			QueueSize:    len(queue),
+			RatingWindow: m.window(request, now),
+			WaitedMs:     now.Sub(request.Enqueued).Milliseconds(),
+		}
+		if wait, ok := m.estimateWait(pool, i, now); ok {
+			ms := wait.Milliseconds()
+			update.EstimatedWaitMs = &ms
+		}
+		select {
+		case request.Progress <- update:
+		default:
+		}
+	}
+}
+
+/*
+ * How much longer the player at index of the pool's queue should have to
+ * wait. In two player modes that is until their window and an opponent's
+ * both cover the difference in rating, otherwise it is the average wait.
+ */
+func (m *MatchMakingController) estimateWait(pool matchPool, index int, now time.Time) (time.Duration, bool) {
+	queue := m.Queues[pool]
+	request := queue[index]
+	best, found := time.Duration(0), false
+	if ModeSeats[pool.Mode] == 2 {
+		for i, other := range queue {
+			if i == index {
+				continue
+			}
+			at, ok := m.windowsMeet(request, other)
+			if !ok {
+				continue
+			}
+			wait := at.Sub(now)
+			if wait < 0 {
+				wait = 0
 			}
-			r2MatchFound = MatchFoundResponse{
-				T:           "match_found",
-				GameId:      gameId,
-				PlayerId:    game.WhitePlayerId,
-				PlayerColor: "w",
+			if !found || wait < best {
+				best, found = wait, true
 			}
 		}
-		r1.Response <- r1MatchFound
-		r2.Response <- r2MatchFound
+	}
+	if found {
+		return best, true
+	}
+	average, ok := m.AverageWait[pool]
+	if !ok {
+		return 0, false
+	}
+	wait := average - now.Sub(request.Enqueued)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+/* When the windows of two requests will both have grown to their difference in rating */
+func (m *MatchMakingController) windowsMeet(a MatchRequest, b MatchRequest) (time.Time, bool) {
+	difference := a.Rating - b.Rating
+	if difference < 0 {
+		difference = -difference
+	}
+	if difference > m.MaxRatingWindow {
+		return time.Time{}, false
+	}
+	seconds := 0
+	if difference > m.RatingWindow {
+		if m.RatingWindowGrowth <= 0 {
+			return time.Time{}, false
+		}
+		seconds = (difference - m.RatingWindow + m.RatingWindowGrowth - 1) / m.RatingWindowGrowth
+	}
+	at := a.Enqueued
+	if b.Enqueued.After(at) {
+		at = b.Enqueued
+	}
+	return at.Add(time.Duration(seconds) * time.Second), true
+}
+
+/* Starts a game for players, seating them at random */
+func (m *MatchMakingController) startGame(pool matchPool, players []MatchRequest) {
+	seats := len(players)
+	now := time.Now()
+	rand.Shuffle(seats, func(i, j int) {
+		players[i], players[j] = players[j], players[i]
+	})
+	for _, player := range players {
+		waited := now.Sub(player.Enqueued)
+		if average, ok := m.AverageWait[pool]; ok {
+			m.AverageWait[pool] = (4*average + waited) / 5
+		} else {
+			m.AverageWait[pool] = waited
+		}
+	}
+	options := GameNewUpdate{
+		Mode:          pool.Mode,
+		TimeControl:   pool.TimeControl,
+		StartPosition: pool.StartPosition,
+	}
+	if seats == 2 {
+		options.WhiteUser = players[0].User
+		options.BlackUser = players[1].User
+	}
+	game, err := m.NewGameRequests.AddNewGame(options)
+	if err != nil {
+		/* Closing the response tells the waiting handlers that no game was made */
+		log.Errorf("Can not start a %s game: %s", pool.Mode, err)
+		for _, player := range players {
+			close(player.Response)
+		}
+		return
+	}
+
+	/* Players with several seats are told about the one on board 0 */
+	for i, seat := range game.PlayerSeats() {
+		players[i].Response <- game.seatFound(seat)
 	}
 }
 
 func (m *MatchMakingController) Init(c *ChessGamesControllerChannel) {
 	m.MatchRequests = make(chan MatchRequest)
+	m.MatchCancels = make(chan MatchCancelRequest)
 	m.NewGameRequests = c
+	m.TimeControl = DefaultTimeControl
+	m.RatingWindow = 100
+	m.RatingWindowGrowth = 10
+	m.MaxRatingWindow = 500
+	m.MatchTimeout = 2 * time.Minute
+	m.Queues = make(map[matchPool][]MatchRequest)
+	m.AverageWait = make(map[matchPool]time.Duration)
+	m.ChallengeRequests = make(chan ChallengeRequest)
+	m.Challenges = make(map[string]*Challenge)
+	m.LobbyRequests = make(chan LobbyRequest)
+	m.Seeks = make(map[uint64]*Seek)
+	m.LobbyMembers = make(map[uint64]chan GameUpdate)
 }
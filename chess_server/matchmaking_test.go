@@ -0,0 +1,195 @@
+package chess_server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/* A matchmaker whose games are started by a running controller */
+func newTestMatchMaker() *MatchMakingController {
+	var controller ChessGamesController
+	controller.Init()
+	go controller.Run()
+	var m MatchMakingController
+	m.Init(&controller.Events)
+	return &m
+}
+
+func TestRatingWindow(t *testing.T) {
+	m := newTestMatchMaker()
+	request := MatchRequest{Enqueued: clockStart}
+	tests := []struct {
+		waited time.Duration
+		window int
+	}{
+		{0, 100},
+		{999 * time.Millisecond, 100},
+		{5 * time.Second, 150},
+		{39 * time.Second, 490},
+		{40 * time.Second, 500},
+		{time.Hour, 500},
+	}
+	for _, test := range tests {
+		if window := m.window(request, clockStart.Add(test.waited)); window != test.window {
+			t.Errorf("window %d after %s, want %d", window, test.waited, test.window)
+		}
+	}
+}
+
+func TestMatchPools(t *testing.T) {
+	m := newTestMatchMaker()
+	blitz := TimeControl{Base: 3 * time.Minute, Mode: ClockFischer}
+	requests := []MatchRequest{
+		{Mode: ModeStandard, TimeControl: blitz, Rating: 1500},
+		{Mode: ModeCrazyhouse, TimeControl: blitz, Rating: 1500},
+		{Mode: ModeStandard, TimeControl: DefaultTimeControl, Rating: 1500},
+		{Mode: ModeChess960, StartPosition: 518, TimeControl: blitz, Rating: 1500},
+		{Mode: ModeChess960, StartPosition: 519, TimeControl: blitz, Rating: 1500},
+		/* Same pool as the first, but too far apart in rating for now */
+		{Mode: ModeStandard, TimeControl: blitz, Rating: 1700},
+	}
+	responses := []chan interface{}{}
+	for i := range requests {
+		response := make(chan interface{}, 1)
+		responses = append(responses, response)
+		requests[i].Response = response
+		requests[i].Enqueued = clockStart
+		pool := requests[i].pool()
+		m.Queues[pool] = append(m.Queues[pool], requests[i])
+	}
+	for pool := range m.Queues {
+		m.match(pool, clockStart)
+	}
+	if len(m.Queues) != 5 {
+		t.Errorf("%d pools, want 5", len(m.Queues))
+	}
+	for i, response := range responses {
+		if len(response) != 0 {
+			t.Errorf("request %d paired with a player of another pool", i)
+		}
+	}
+
+	/* Once the windows have grown to the difference the two are paired */
+	standard := requests[0].pool()
+	m.match(standard, clockStart.Add(10*time.Second))
+	for _, i := range []int{0, 5} {
+		if found, ok := (<-responses[i]).(MatchFoundResponse); !ok || found.Mode != ModeStandard {
+			t.Errorf("request %d got %+v", i, found)
+		}
+	}
+	if _, ok := m.Queues[standard]; ok {
+		t.Error("paired players left in the queue")
+	}
+}
+
+func TestMatchTimeout(t *testing.T) {
+	m := newTestMatchMaker()
+	m.MatchTimeout = 10 * time.Millisecond
+	go m.Run()
+	response := make(chan interface{}, 1)
+	m.FindMatch(MatchRequest{Mode: ModeStandard, TimeControl: DefaultTimeControl, Rating: DefaultRating, Response: response})
+	select {
+	case answer := <-response:
+		timeout, ok := answer.(MatchTimeoutResponse)
+		if !ok || timeout.T != "match_timeout" || timeout.WaitedMs < 10 {
+			t.Errorf("got %+v, want a match_timeout", answer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no match_timeout")
+	}
+}
+
+/* A /matchmaking connection, as MatchLoop sees it */
+type testMatchConnection struct {
+	In chan struct {
+		GameUpdate
+		string
+	}
+	Out  chan GameUpdate
+	Done chan struct{}
+}
+
+func startMatchLoop(server *ChessServer, request FindMatchRequest) testMatchConnection {
+	connection := testMatchConnection{
+		In: make(chan struct {
+			GameUpdate
+			string
+		}, 1),
+		Out:  make(chan GameUpdate, 64),
+		Done: make(chan struct{}),
+	}
+	connection.In <- struct {
+		GameUpdate
+		string
+	}{request, "find_match"}
+	go func() {
+		server.MatchLoop(&server.ChessGamesController.Events, connection.In, connection.Out, "", echo.New().Logger)
+		close(connection.Done)
+	}()
+	return connection
+}
+
+/* The last update the connection got before the loop ended, skipping queue updates */
+func (c testMatchConnection) result(t *testing.T) GameUpdate {
+	t.Helper()
+	select {
+	case <-c.Done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("matchmaking loop did not end")
+	}
+	var last GameUpdate
+	for len(c.Out) > 0 {
+		if update := <-c.Out; update != nil {
+			if _, ok := update.(QueueUpdate); !ok {
+				last = update
+			}
+		}
+	}
+	return last
+}
+
+/* A server with running controllers whose players give up after timeout */
+func newTestServer(timeout time.Duration) *ChessServer {
+	server := &ChessServer{}
+	server.Init()
+	server.MatchMakingController.MatchTimeout = timeout
+	go server.ChessGamesController.Run()
+	go server.MatchMakingController.Run()
+	return server
+}
+
+func TestMatchLoop(t *testing.T) {
+	server := newTestServer(time.Minute)
+	rating := 1500
+	request := FindMatchRequest{Mode: ModeStandard, Rating: &rating}
+	unknown := FindMatchRequest{Mode: "shogi"}
+	if update, ok := startMatchLoop(server, unknown).result(t).(MatchErrorResponse); !ok || update.T != "match_error" {
+		t.Errorf("got %+v for an unknown mode", update)
+	}
+	white, black := startMatchLoop(server, request), startMatchLoop(server, request)
+	first, ok := white.result(t).(MatchFoundResponse)
+	second, ok2 := black.result(t).(MatchFoundResponse)
+	if !ok || !ok2 || first.GameId != second.GameId || first.PlayerColor == second.PlayerColor {
+		t.Errorf("paired as %+v and %+v", first, second)
+	}
+}
+
+func TestMatchLoopCancel(t *testing.T) {
+	server := newTestServer(10 * time.Millisecond)
+	rating := 1500
+	request := FindMatchRequest{Mode: ModeStandard, Rating: &rating}
+	/* Whoever cancels is out of the queue, so the next player finds nobody */
+	cancelled := startMatchLoop(server, request)
+	cancelled.In <- struct {
+		GameUpdate
+		string
+	}{nil, "cancel_match"}
+	if update := cancelled.result(t); update != nil {
+		t.Errorf("cancelled player got %+v", update)
+	}
+	if update, ok := startMatchLoop(server, request).result(t).(MatchTimeoutResponse); !ok {
+		t.Errorf("got %+v, want a match_timeout", update)
+	}
+}
@@ -0,0 +1,158 @@
+package chess_server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+/*
+ * A starting position for the random opening mode, given either as the
+ * moves leading to it or as a FEN
+ */
+type Opening struct {
+	ECO  string
+	Name string
+	/* In SAN, empty if the opening was given as a FEN */
+	Moves []string
+	/* Position once the opening has been played */
+	FEN string
+}
+
+type OpeningUpdate struct {
+	ECO   string   `json:"eco"`
+	Name  string   `json:"name"`
+	Moves []string `json:"moves"`
+	FEN   string   `json:"fen"`
+}
+
+func (o *Opening) Update() *OpeningUpdate {
+	if o == nil {
+		return nil
+	}
+	return &OpeningUpdate{
+		ECO:   o.ECO,
+		Name:  o.Name,
+		Moves: o.Moves,
+		FEN:   o.FEN,
+	}
+}
+
+/* A new game with the opening already played */
+func (o *Opening) Game() (*chess.Game, error) {
+	if len(o.Moves) == 0 {
+		start, err := chess.FEN(o.FEN)
+		if err != nil {
+			return nil, err
+		}
+		return chess.NewGame(start), nil
+	}
+	game := chess.NewGame()
+	for _, move := range o.Moves {
+		if err := game.MoveStr(move); err != nil {
+			return nil, err
+		}
+	}
+	return game, nil
+}
+
+type OpeningPool struct {
+	Openings []*Opening
+}
+
+/* Loads an opening pool, see ParseOpeningPool for the format */
+func LoadOpeningPool(path string) (*OpeningPool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseOpeningPool(f)
+}
+
+/*
+ * Parses tab separated lines of ECO code, name and either PGN movetext
+ * ("1. e4 e5 2. Nf3") or a FEN, like the lichess opening tables. Blank
+ * lines, lines starting with # and a header line starting with "eco" are
+ * skipped, as are any columns after the third.
+ */
+func ParseOpeningPool(r io.Reader) (*OpeningPool, error) {
+	pool := &OpeningPool{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if strings.ToLower(fields[0]) == "eco" {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Opening pool line %d: expected eco, name and moves or FEN", lineNo)
+		}
+		opening, err := parseOpening(fields[0], fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Opening pool line %d: %s", lineNo, err)
+		}
+		pool.Openings = append(pool.Openings, opening)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(pool.Openings) == 0 {
+		return nil, errors.New("Opening pool is empty")
+	}
+	return pool, nil
+}
+
+var moveNumber = regexp.MustCompile(`^[0-9]+\.+`)
+
+/* Results that may end PGN movetext */
+var gameTermination = map[string]bool{"1-0": true, "0-1": true, "1/2-1/2": true, "*": true}
+
+func parseOpening(eco string, name string, position string) (*Opening, error) {
+	opening := &Opening{ECO: strings.TrimSpace(eco), Name: strings.TrimSpace(name)}
+	position = strings.TrimSpace(position)
+	if fields := strings.Fields(position); len(fields) > 0 && strings.Contains(fields[0], "/") {
+		opening.FEN = position
+		if strings.Count(position, " ") == 3 {
+			/* EPD without move counters */
+			opening.FEN += " 0 1"
+		}
+	} else {
+		for _, token := range strings.Fields(position) {
+			/* Move numbers like "1." and "3..." may be written apart or stuck to the move */
+			token = moveNumber.ReplaceAllString(token, "")
+			if token == "" || gameTermination[token] {
+				continue
+			}
+			opening.Moves = append(opening.Moves, token)
+		}
+		if len(opening.Moves) == 0 {
+			return nil, errors.New("no moves")
+		}
+	}
+	game, err := opening.Game()
+	if err != nil {
+		return nil, err
+	}
+	if game.Outcome() != chess.NoOutcome {
+		return nil, errors.New("opening position is already decided")
+	}
+	opening.FEN = game.FEN()
+	return opening, nil
+}
+
+func (p *OpeningPool) Random() *Opening {
+	return p.Openings[rand.Intn(len(p.Openings))]
+}
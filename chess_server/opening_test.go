@@ -0,0 +1,61 @@
+package chess_server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOpening(t *testing.T) {
+	cases := []struct {
+		position string
+		moves    []string
+		fen      string
+	}{
+		{"1. e4 e5 2. Nf3", []string{"e4", "e5", "Nf3"}, "rnbqkbnr/pppp1ppp/8/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R b KQkq - 1 2"},
+		{"1.e4 e5 2.Nf3", []string{"e4", "e5", "Nf3"}, "rnbqkbnr/pppp1ppp/8/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R b KQkq - 1 2"},
+		{"1.d4 1...d5 *", []string{"d4", "d5"}, "rnbqkbnr/ppp1pppp/8/3p4/3P4/8/PPP1PPPP/RNBQKBNR w KQkq d6 0 2"},
+		{"1. e4 c5 1/2-1/2", []string{"e4", "c5"}, "rnbqkbnr/pp1ppppp/8/2p5/4P3/8/PPPP1PPP/RNBQKBNR w KQkq c6 0 2"},
+		{"rnbqkbnr/pppppppp/8/8/3P4/8/PPP1PPPP/RNBQKBNR b KQkq -", nil, "rnbqkbnr/pppppppp/8/8/3P4/8/PPP1PPPP/RNBQKBNR b KQkq - 0 1"},
+	}
+	for _, c := range cases {
+		opening, err := parseOpening("C00", "Test", c.position)
+		if err != nil {
+			t.Errorf("%s: %s", c.position, err)
+			continue
+		}
+		if !reflect.DeepEqual(opening.Moves, c.moves) {
+			t.Errorf("%s: moves %q, want %q", c.position, opening.Moves, c.moves)
+		}
+		if opening.FEN != c.fen {
+			t.Errorf("%s: FEN %s, want %s", c.position, opening.FEN, c.fen)
+		}
+	}
+	for _, position := range []string{"", "1.", "1. e5", "1. e4 e5 2. Ke3"} {
+		if _, err := parseOpening("C00", "Bad", position); err == nil {
+			t.Errorf("%q accepted", position)
+		}
+	}
+}
+
+func TestParseOpeningPool(t *testing.T) {
+	pool, err := ParseOpeningPool(strings.NewReader(strings.Join([]string{
+		"eco\tname\tpgn",
+		"# comment",
+		"",
+		"B01\tScandinavian Defense\t1.e4 d5",
+		"A40\tQueen's Pawn\trnbqkbnr/pppppppp/8/8/3P4/8/PPP1PPPP/RNBQKBNR b KQkq -\textra",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Openings) != 2 || pool.Openings[0].Name != "Scandinavian Defense" || len(pool.Openings[0].Moves) != 2 {
+		t.Errorf("pool %+v", pool.Openings)
+	}
+	if _, err := ParseOpeningPool(strings.NewReader("B01\tScandinavian Defense\n")); err == nil {
+		t.Error("line without moves accepted")
+	}
+	if _, err := LoadOpeningPool("../openings.tsv"); err != nil {
+		t.Errorf("openings.tsv: %s", err)
+	}
+}
@@ -0,0 +1,222 @@
+package chess_server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+/* Names of the modes in the Variant tag. Standard games have none. */
+var pgnVariants = map[string]string{
+	ModeChess960:      "Chess960",
+	ModeCrazyhouse:    "Crazyhouse",
+	ModeThreeCheck:    "Three-check",
+	ModeKingOfTheHill: "King of the Hill",
+	ModeAtomic:        "Atomic",
+	ModeAntichess:     "Antichess",
+	ModeHorde:         "Horde",
+	ModeRacingKings:   "Racing Kings",
+	ModeBughouse:      "Bughouse",
+	ModeBughouse1v1:   "Bughouse",
+}
+
+/* Characters past which movetext lines are wrapped */
+const pgnLineLength = 79
+
+func pgnTag(sb *strings.Builder, name string, value string) {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	fmt.Fprintf(sb, "[%s \"%s\"]\n", name, value)
+}
+
+/* How the game ended, in the words of the Termination tag */
+func pgnTermination(method string) string {
+	switch method {
+	case "timeout", "timeout_vs_insufficient_material":
+		return "Time forfeit"
+	case "abandonment", "aborted":
+		return "Abandoned"
+	case "":
+		return "Unterminated"
+	default:
+		return "Normal"
+	}
+}
+
+func pgnTimeControl(tc TimeControl) string {
+	if !tc.Timed() {
+		return "-"
+	}
+	return fmt.Sprintf("%d+%d", int64(tc.Base.Seconds()), int64(tc.Increment.Seconds()))
+}
+
+/* Remaining time as a %clk comment */
+func pgnClock(ms int64) string {
+	seconds := ms / 1000
+	return fmt.Sprintf("{ [%%clk %d:%02d:%02d] }", seconds/3600, seconds/60%60, seconds%60)
+}
+
+/* The result as seen from board, whose teams are swapped on board 1 of bughouse */
+func boardResult(result string, board int) string {
+	if board == 0 {
+		return result
+	}
+	switch result {
+	case chess.WhiteWon.String():
+		return chess.BlackWon.String()
+	case chess.BlackWon.String():
+		return chess.WhiteWon.String()
+	}
+	return result
+}
+
+/*
+ * The game in PGN, site being the address of the server. Bughouse games are
+ * written as one PGN game per board.
+ */
+func (a *ArchivedGame) PGN(site string) string {
+	boards := 1
+	if a.Mode == ModeBughouse || a.Mode == ModeBughouse1v1 {
+		boards = 2
+	}
+	games := []string{}
+	for board := 0; board < boards; board++ {
+		games = append(games, a.boardPGN(site, board, boards > 1))
+	}
+	return strings.Join(games, "\n")
+}
+
+func (a *ArchivedGame) boardPGN(site string, board int, bughouse bool) string {
+	var sb strings.Builder
+	rated := "Casual"
+	if a.Rated {
+		rated = "Rated"
+	}
+	event := fmt.Sprintf("%s %s game", rated, RatingCategory(a.TimeControl()))
+	if variant, ok := pgnVariants[a.Mode]; ok {
+		event = fmt.Sprintf("%s %s %s game", rated, RatingCategory(a.TimeControl()), variant)
+	}
+	result := boardResult(a.Result, board)
+	started := a.Started.UTC()
+
+	/* The Seven Tag Roster comes first and in this order */
+	pgnTag(&sb, "Event", event)
+	pgnTag(&sb, "Site", fmt.Sprintf("%s/games/%d.pgn", site, a.GameId))
+	pgnTag(&sb, "Date", started.Format("2006.01.02"))
+	pgnTag(&sb, "Round", "-")
+	players := [2]ArchivedPlayer{}
+	for i, color := range []chess.Color{chess.White, chess.Black} {
+		player, _ := a.Player(board, color)
+		players[i] = player
+		name := player.User
+		if name == "" {
+			name = "Anonymous"
+		}
+		pgnTag(&sb, color.Name(), name)
+	}
+	pgnTag(&sb, "Result", result)
+
+	pgnTag(&sb, "GameId", strconv.FormatUint(a.GameId, 10))
+	if bughouse {
+		pgnTag(&sb, "Board", strconv.Itoa(board+1))
+	}
+	pgnTag(&sb, "UTCDate", started.Format("2006.01.02"))
+	pgnTag(&sb, "UTCTime", started.Format("15:04:05"))
+	for i, color := range []chess.Color{chess.White, chess.Black} {
+		if players[i].Rating != 0 {
+			pgnTag(&sb, color.Name()+"Elo", strconv.Itoa(players[i].Rating))
+			pgnTag(&sb, color.Name()+"RatingDiff", fmt.Sprintf("%+d", players[i].Change))
+		}
+	}
+	if variant, ok := pgnVariants[a.Mode]; ok {
+		pgnTag(&sb, "Variant", variant)
+	}
+	pgnTag(&sb, "TimeControl", pgnTimeControl(a.TimeControl()))
+
+	/*
+	 * Opening moves are written out from the initial position; openings given
+	 * as a position and other start positions need a FEN tag
+	 */
+	start := a.StartFEN
+	openingMoves := []string{}
+	if a.Opening != nil {
+		if a.Opening.ECO != "" {
+			pgnTag(&sb, "ECO", a.Opening.ECO)
+		}
+		if a.Opening.Name != "" {
+			pgnTag(&sb, "Opening", a.Opening.Name)
+		}
+		if len(a.Opening.Moves) > 0 && !a.CustomStart {
+			start = StartingFEN
+			openingMoves = a.Opening.Moves
+		}
+	}
+	/* Chess960 games always give their start position, even the regular one */
+	if start != StartingFEN || a.Mode == ModeChess960 {
+		pgnTag(&sb, "SetUp", "1")
+		pgnTag(&sb, "FEN", start)
+	}
+	if a.StartPosition != nil {
+		pgnTag(&sb, "StartPosition", strconv.Itoa(*a.StartPosition))
+	}
+	pgnTag(&sb, "Termination", pgnTermination(a.Method))
+	sb.WriteString("\n")
+
+	/* Move numbers continue from the start position */
+	fields := strings.Fields(start)
+	number := 1
+	if len(fields) >= 6 {
+		if n, err := strconv.Atoi(fields[5]); err == nil && n > 0 {
+			number = n
+		}
+	}
+	black := len(fields) >= 2 && fields[1] == "b"
+	tokens := []string{}
+	/* Black's moves need their number again after a comment */
+	numbered := false
+	addMove := func(san string, clockMs *int64) {
+		if !black {
+			tokens = append(tokens, fmt.Sprintf("%d.", number))
+		} else if !numbered {
+			tokens = append(tokens, fmt.Sprintf("%d...", number))
+		}
+		tokens = append(tokens, san)
+		numbered = true
+		if clockMs != nil {
+			tokens = append(tokens, pgnClock(*clockMs))
+			numbered = false
+		}
+		if black {
+			number += 1
+		}
+		black = !black
+	}
+	for _, san := range openingMoves {
+		addMove(san, nil)
+	}
+	for _, move := range a.Moves {
+		if move.Board == board {
+			addMove(move.SAN, move.ClockMs)
+		}
+	}
+	tokens = append(tokens, result)
+
+	line := 0
+	for i, token := range tokens {
+		if i > 0 {
+			if line+1+len(token) > pgnLineLength {
+				sb.WriteString("\n")
+				line = 0
+			} else {
+				sb.WriteString(" ")
+				line += 1
+			}
+		}
+		sb.WriteString(token)
+		line += len(token)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
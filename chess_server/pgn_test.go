@@ -0,0 +1,98 @@
+package chess_server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+func archivedGame(mode string, startFEN string, moves ...string) ArchivedGame {
+	game := ArchivedGame{
+		GameId:   7,
+		Mode:     mode,
+		StartFEN: startFEN,
+		BaseMs:   180000,
+		Players: []ArchivedPlayer{
+			{Color: chess.White.String(), User: "alice"},
+			{Color: chess.Black.String()},
+		},
+		Result:  "1-0",
+		Method:  "resignation",
+		Started: time.Date(2024, 3, 1, 18, 30, 0, 0, time.UTC),
+	}
+	for _, san := range moves {
+		game.Moves = append(game.Moves, PlayedMove{SAN: san})
+	}
+	return game
+}
+
+func TestPGN(t *testing.T) {
+	game := archivedGame(ModeStandard, StartingFEN, "e4", "e5", "Nf3")
+	pgn := game.PGN("http://localhost")
+	want := strings.Join([]string{
+		`[Event "Casual blitz game"]`,
+		`[Site "http://localhost/games/7.pgn"]`,
+		`[Date "2024.03.01"]`,
+		`[Round "-"]`,
+		`[White "alice"]`,
+		`[Black "Anonymous"]`,
+		`[Result "1-0"]`,
+		`[GameId "7"]`,
+		`[UTCDate "2024.03.01"]`,
+		`[UTCTime "18:30:00"]`,
+		`[TimeControl "180+0"]`,
+		`[Termination "Normal"]`,
+		``,
+		`1. e4 e5 2. Nf3 1-0`,
+		``,
+	}, "\n")
+	if pgn != want {
+		t.Errorf("got\n%s\nwant\n%s", pgn, want)
+	}
+}
+
+func TestPGNMoveNumbers(t *testing.T) {
+	game := archivedGame(ModeStandard, "4k3/8/8/8/8/8/8/R3K3 b Q - 3 20", "Kd7", "Ra7+")
+	clock := int64(61000)
+	game.Moves[0].ClockMs = &clock
+	pgn := game.PGN("http://localhost")
+	for _, want := range []string{`[SetUp "1"]`, `[FEN "4k3/8/8/8/8/8/8/R3K3 b Q - 3 20"]`, "20... Kd7 { [%clk 0:01:01] } 21. Ra7+ 1-0"} {
+		if !strings.Contains(pgn, want) {
+			t.Errorf("%s missing from\n%s", want, pgn)
+		}
+	}
+}
+
+func TestPGNChess960(t *testing.T) {
+	n := StandardStartPosition
+	game := archivedGame(ModeChess960, StartingFEN, "e4")
+	game.StartPosition = &n
+	pgn := game.PGN("http://localhost")
+	/* The regular start position still needs its FEN in a Chess960 game */
+	for _, want := range []string{`[Variant "Chess960"]`, `[SetUp "1"]`, `[FEN "` + StartingFEN + `"]`, `[StartPosition "518"]`} {
+		if !strings.Contains(pgn, want) {
+			t.Errorf("%s missing from\n%s", want, pgn)
+		}
+	}
+	/* Games set up from a FEN have no number */
+	game.StartPosition = nil
+	if pgn := game.PGN("http://localhost"); strings.Contains(pgn, "StartPosition") {
+		t.Errorf("custom Chess960 game numbered\n%s", pgn)
+	}
+}
+
+func TestPGNBughouse(t *testing.T) {
+	game := archivedGame(ModeBughouse, StartingFEN, "e4", "d5")
+	game.Moves[1].Board = 1
+	game.Players = append(game.Players, ArchivedPlayer{Board: 1, Color: chess.White.String(), User: "carol"}, ArchivedPlayer{Board: 1, Color: chess.Black.String(), User: "dave"})
+	boards := strings.Split(game.PGN("http://localhost"), "\n\n[Event")
+	if len(boards) != 2 {
+		t.Fatalf("%d boards, want 2", len(boards))
+	}
+	/* Board 2 has the teams the other way round */
+	if !strings.Contains(boards[1], `[Board "2"]`) || !strings.Contains(boards[1], "1. d5 0-1") {
+		t.Errorf("second board\n%s", boards[1])
+	}
+}
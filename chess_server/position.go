@@ -0,0 +1,1268 @@
+package chess_server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+/*
+ * Position is a small rules engine for the modes notnil/chess can not
+ * express, most importantly anything with pieces in hand that can be dropped
+ * back onto the board. Squares are numbered like chess.Square, a1 = 0
+ * through h8 = 63.
+ */
+type Position struct {
+	Board [64]chess.Piece
+	/* The piece on the square got there by promotion */
+	Promoted [64]bool
+	Turn     chess.Color
+	/*
+	 * File of the rook each color may still castle with, indexed by color,
+	 * then side (0 = king side, 1 = queen side). -1 once the right is lost.
+	 */
+	Castling  [3][2]int
+	EnPassant int
+	HalfMove  int
+	FullMove  int
+	/* Pieces in hand, indexed by color, then piece type */
+	Pockets [3][7]int
+	/*
+	 * Castling follows Chess960 rules: UCI castling moves are written as the
+	 * king taking its own rook, and the FEN names castling rooks by file when
+	 * KQkq would be ambiguous
+	 */
+	Chess960 bool
+	/* Checks given by each color, counted by three-check */
+	Checks [3]int
+	Rules  MoveRules
+}
+
+/* Move rules of variants that change how pieces move or capture */
+type MoveRules int
+
+const (
+	StandardMoves MoveRules = iota
+	/*
+	 * Captures explode every piece other than pawns next to the capture
+	 * square, along with the capturing piece. Kings can not capture, and a
+	 * king next to the enemy king can not be captured.
+	 */
+	AtomicMoves
+	/*
+	 * Captures are compulsory and the king is an ordinary piece that can be
+	 * captured, so there is no check. Pawns may also promote to a king.
+	 */
+	AntichessMoves
+	/* White pawns on the first rank may advance two squares as well */
+	HordeMoves
+	/* Moves that give check are not allowed */
+	RacingKingsMoves
+)
+
+/*
+ * A move on a Position. Drops have Drop set and no From square. Castling is
+ * stored as the king moving onto the square of the rook it castles with.
+ */
+type Move struct {
+	From  int
+	To    int
+	Promo chess.PieceType
+	Drop  chess.PieceType
+}
+
+const (
+	kingSide  = 0
+	queenSide = 1
+)
+
+const StartingFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+
+var (
+	knightOffsets = [][2]int{{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2}}
+	kingOffsets   = [][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}, {0, -1}, {1, -1}}
+	rookDirs      = [][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}}
+	bishopDirs    = [][2]int{{1, 1}, {1, -1}, {-1, 1}, {-1, -1}}
+	/* Piece types that can be held in a pocket, in display order */
+	pocketTypes = []chess.PieceType{chess.Queen, chess.Rook, chess.Bishop, chess.Knight, chess.Pawn}
+)
+
+func makePiece(t chess.PieceType, c chess.Color) chess.Piece {
+	if t == chess.NoPieceType || c == chess.NoColor {
+		return chess.NoPiece
+	}
+	piece := chess.Piece(t)
+	if c == chess.Black {
+		piece += chess.BlackKing - chess.WhiteKing
+	}
+	return piece
+}
+
+func pieceLetter(t chess.PieceType) string {
+	switch t {
+	case chess.King:
+		return "K"
+	case chess.Queen:
+		return "Q"
+	case chess.Rook:
+		return "R"
+	case chess.Bishop:
+		return "B"
+	case chess.Knight:
+		return "N"
+	case chess.Pawn:
+		return "P"
+	}
+	return ""
+}
+
+func pieceTypeFromLetter(letter byte) chess.PieceType {
+	switch letter {
+	case 'K', 'k':
+		return chess.King
+	case 'Q', 'q':
+		return chess.Queen
+	case 'R', 'r':
+		return chess.Rook
+	case 'B', 'b':
+		return chess.Bishop
+	case 'N', 'n':
+		return chess.Knight
+	case 'P', 'p':
+		return chess.Pawn
+	}
+	return chess.NoPieceType
+}
+
+/* FEN letter of a piece, upper case for white */
+func fenLetter(p chess.Piece) string {
+	letter := pieceLetter(p.Type())
+	if p.Color() == chess.Black {
+		return strings.ToLower(letter)
+	}
+	return letter
+}
+
+func square(file int, rank int) int {
+	return rank*8 + file
+}
+
+func squareName(sq int) string {
+	return chess.Square(sq).String()
+}
+
+func parseSquare(s string) (int, error) {
+	if len(s) != 2 || s[0] < 'a' || s[0] > 'h' || s[1] < '1' || s[1] > '8' {
+		return 0, fmt.Errorf("Invalid square %s", s)
+	}
+	return square(int(s[0]-'a'), int(s[1]-'1')), nil
+}
+
+func NewPosition() *Position {
+	pos, err := ParsePosition(StartingFEN)
+	if err != nil {
+		panic(err)
+	}
+	return pos
+}
+
+/*
+ * Parses a FEN. Pieces in hand may follow the board in brackets and promoted
+ * pieces may be marked with a trailing ~, as is common for crazyhouse.
+ */
+func ParsePosition(fen string) (*Position, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 {
+		return nil, errors.New("Invalid FEN: too few fields")
+	}
+	pos := &Position{EnPassant: -1, HalfMove: 0, FullMove: 1}
+	pos.Castling = [3][2]int{{-1, -1}, {-1, -1}, {-1, -1}}
+
+	/* Three-check FENs end with the checks each side has given, e.g. +1+0 */
+	if last := fields[len(fields)-1]; len(fields) > 4 && strings.HasPrefix(last, "+") {
+		if err := pos.parseChecks(last); err != nil {
+			return nil, err
+		}
+		fields = fields[:len(fields)-1]
+	}
+
+	placement := fields[0]
+	if i := strings.Index(placement, "["); i >= 0 {
+		if !strings.HasSuffix(placement, "]") {
+			return nil, errors.New("Invalid FEN: unterminated pocket")
+		}
+		for _, letter := range []byte(placement[i+1 : len(placement)-1]) {
+			t := pieceTypeFromLetter(letter)
+			if t == chess.NoPieceType || t == chess.King {
+				return nil, fmt.Errorf("Invalid FEN: bad pocket piece %c", letter)
+			}
+			if letter >= 'a' {
+				pos.Pockets[chess.Black][t] += 1
+			} else {
+				pos.Pockets[chess.White][t] += 1
+			}
+		}
+		placement = placement[:i]
+	}
+	ranks := strings.Split(placement, "/")
+	if len(ranks) == 9 && len(ranks[8]) <= 32 {
+		/* Pocket given as a ninth rank */
+		for _, letter := range []byte(ranks[8]) {
+			t := pieceTypeFromLetter(letter)
+			if t == chess.NoPieceType || t == chess.King {
+				return nil, fmt.Errorf("Invalid FEN: bad pocket piece %c", letter)
+			}
+			if letter >= 'a' {
+				pos.Pockets[chess.Black][t] += 1
+			} else {
+				pos.Pockets[chess.White][t] += 1
+			}
+		}
+		ranks = ranks[:8]
+	}
+	if len(ranks) != 8 {
+		return nil, errors.New("Invalid FEN: expected 8 ranks")
+	}
+	for i, rankStr := range ranks {
+		rank := 7 - i
+		file := 0
+		for j := 0; j < len(rankStr); j++ {
+			c := rankStr[j]
+			if c >= '1' && c <= '8' {
+				file += int(c - '0')
+				continue
+			}
+			if c == '~' {
+				if file == 0 {
+					return nil, errors.New("Invalid FEN: misplaced ~")
+				}
+				pos.Promoted[square(file-1, rank)] = true
+				continue
+			}
+			t := pieceTypeFromLetter(c)
+			if t == chess.NoPieceType || file > 7 {
+				return nil, fmt.Errorf("Invalid FEN: bad rank %s", rankStr)
+			}
+			color := chess.White
+			if c >= 'a' {
+				color = chess.Black
+			}
+			pos.Board[square(file, rank)] = makePiece(t, color)
+			file += 1
+		}
+		if file != 8 {
+			return nil, fmt.Errorf("Invalid FEN: bad rank %s", rankStr)
+		}
+	}
+
+	switch fields[1] {
+	case "w":
+		pos.Turn = chess.White
+	case "b":
+		pos.Turn = chess.Black
+	default:
+		return nil, errors.New("Invalid FEN: bad side to move")
+	}
+
+	if fields[2] != "-" {
+		for _, c := range []byte(fields[2]) {
+			if err := pos.addCastlingRight(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if fields[3] != "-" {
+		sq, err := parseSquare(fields[3])
+		if err != nil {
+			return nil, errors.New("Invalid FEN: bad en passant square")
+		}
+		pos.EnPassant = sq
+	}
+
+	if len(fields) > 4 {
+		halfMove, err := strconv.Atoi(fields[4])
+		if err != nil || halfMove < 0 {
+			return nil, errors.New("Invalid FEN: bad half move clock")
+		}
+		pos.HalfMove = halfMove
+	}
+	if len(fields) > 5 {
+		fullMove, err := strconv.Atoi(fields[5])
+		if err != nil || fullMove < 1 {
+			return nil, errors.New("Invalid FEN: bad move number")
+		}
+		pos.FullMove = fullMove
+	}
+	return pos, nil
+}
+
+/*
+ * Checks that a position set up by hand can be played from: one king each
+ * (none or any number in some variants), no pawns on the first or last rank,
+ * no more pawns and promoted pieces than eight pawns allow, and the side that
+ * just moved not left in check. Where captured pieces change sides, as in
+ * crazyhouse, sharedMaterial is set and only the material of both sides
+ * together is limited.
+ */
+func (p *Position) Validate(sharedMaterial bool) error {
+	if err := p.validateMaterial(sharedMaterial); err != nil {
+		return err
+	}
+	kings := [3]int{}
+	for sq, piece := range p.Board {
+		switch piece.Type() {
+		case chess.King:
+			kings[piece.Color()] += 1
+		case chess.Pawn:
+			color := piece.Color()
+			if sq/8 == backRank(color.Other()) {
+				return errors.New("Pawns can not stand on the last rank")
+			}
+			if sq/8 == backRank(color) && !(p.Rules == HordeMoves && color == chess.White) {
+				return errors.New("Pawns can not stand on the first rank")
+			}
+		}
+	}
+	for _, color := range []chess.Color{chess.White, chess.Black} {
+		switch {
+		case p.Rules == AntichessMoves:
+		case p.Rules == HordeMoves && color == chess.White:
+			if kings[color] > 1 {
+				return errors.New("Each side needs exactly one king")
+			}
+		case kings[color] != 1:
+			return errors.New("Each side needs exactly one king")
+		}
+	}
+	if p.kingEnPrise(p.Turn.Other()) {
+		return errors.New("The side not to move is in check")
+	}
+	if p.Rules == RacingKingsMoves && p.InCheck() {
+		return errors.New("Checks are not allowed in racing kings")
+	}
+	if p.EnPassant >= 0 {
+		/* The pawn that just made a double step has to be in front of the square */
+		dir := 8
+		if p.Turn == chess.Black {
+			dir = -8
+		}
+		pawn := p.EnPassant - dir
+		if p.EnPassant/8 != backRank(p.Turn.Other())-dir/8*2 || p.Board[pawn] != makePiece(chess.Pawn, p.Turn.Other()) {
+			return errors.New("Invalid en passant square")
+		}
+	}
+	return nil
+}
+
+/*
+ * Checks that every piece beyond the starting set of its side could have come
+ * from a pawn that promoted. Horde's white pawns are not limited.
+ */
+func (p *Position) validateMaterial(sharedMaterial bool) error {
+	counts := [3][7]int{}
+	for sq, piece := range p.Board {
+		if piece == chess.NoPiece {
+			continue
+		}
+		color, t := piece.Color(), piece.Type()
+		if sharedMaterial {
+			color = chess.White
+			if p.Promoted[sq] {
+				t = chess.Pawn
+			}
+		}
+		counts[color][t] += 1
+	}
+	sets := []chess.Color{chess.White, chess.Black}
+	if sharedMaterial {
+		sets = []chess.Color{chess.White}
+		for _, color := range []chess.Color{chess.White, chess.Black} {
+			for t, n := range p.Pockets[color] {
+				counts[chess.White][t] += n
+			}
+		}
+	}
+	/* Each side starts with these, shared material has twice as many */
+	start := map[chess.PieceType]int{chess.King: 1, chess.Queen: 1, chess.Rook: 2, chess.Bishop: 2, chess.Knight: 2}
+	pawns := 8
+	if sharedMaterial {
+		pawns = 16
+	}
+	for _, color := range sets {
+		if p.Rules == HordeMoves && color == chess.White {
+			continue
+		}
+		promoted := 0
+		for t, n := range start {
+			if sharedMaterial {
+				n *= 2
+			}
+			/* Only antichess promotes to kings, elsewhere kings are checked on their own */
+			if t == chess.King && p.Rules != AntichessMoves {
+				continue
+			}
+			if counts[color][t] > n {
+				promoted += counts[color][t] - n
+			}
+		}
+		if counts[color][chess.Pawn] > pawns {
+			return errors.New("Too many pawns")
+		}
+		if counts[color][chess.Pawn]+promoted > pawns {
+			return errors.New("Too many pieces for the pawns that could have promoted")
+		}
+	}
+	return nil
+}
+
+func (p *Position) parseChecks(field string) error {
+	counts := strings.Split(field[1:], "+")
+	if len(counts) != 2 {
+		return errors.New("Invalid FEN: bad check counts")
+	}
+	for i, color := range []chess.Color{chess.White, chess.Black} {
+		checks, err := strconv.Atoi(counts[i])
+		if err != nil || checks < 0 {
+			return errors.New("Invalid FEN: bad check counts")
+		}
+		p.Checks[color] = checks
+	}
+	return nil
+}
+
+/* Checks given by white and black in the three-check FEN field, e.g. +1+0 */
+func (p *Position) ChecksField() string {
+	return fmt.Sprintf("+%d+%d", p.Checks[chess.White], p.Checks[chess.Black])
+}
+
+/* FEN of the position, with the pockets in brackets if withPockets is set */
+func (p *Position) FEN(withPockets bool) string {
+	var sb strings.Builder
+	for rank := 7; rank >= 0; rank-- {
+		empty := 0
+		for file := 0; file < 8; file++ {
+			sq := square(file, rank)
+			piece := p.Board[sq]
+			if piece == chess.NoPiece {
+				empty += 1
+				continue
+			}
+			if empty > 0 {
+				sb.WriteString(strconv.Itoa(empty))
+				empty = 0
+			}
+			sb.WriteString(fenLetter(piece))
+			if withPockets && p.Promoted[sq] {
+				sb.WriteString("~")
+			}
+		}
+		if empty > 0 {
+			sb.WriteString(strconv.Itoa(empty))
+		}
+		if rank > 0 {
+			sb.WriteString("/")
+		}
+	}
+	if withPockets {
+		sb.WriteString("[" + p.PocketString() + "]")
+	}
+
+	castling := ""
+	for _, color := range []chess.Color{chess.White, chess.Black} {
+		for side, file := range p.Castling[color] {
+			if file < 0 {
+				continue
+			}
+			letter := "KQ"[side : side+1]
+			if p.outerRook(color, side) != file {
+				letter = string(rune('A' + file))
+			}
+			if color == chess.Black {
+				letter = strings.ToLower(letter)
+			}
+			castling += letter
+		}
+	}
+	if castling == "" {
+		castling = "-"
+	}
+	enPassant := "-"
+	if p.EnPassant >= 0 {
+		enPassant = squareName(p.EnPassant)
+	}
+	return fmt.Sprintf("%s %s %s %s %d %d", sb.String(), p.Turn.String(), castling, enPassant, p.HalfMove, p.FullMove)
+}
+
+func backRank(color chess.Color) int {
+	if color == chess.Black {
+		return 7
+	}
+	return 0
+}
+
+/*
+ * Parses one letter of the castling field. KQkq mean the outermost rook on
+ * that side of the king, as in X-FEN, and file letters (Shredder-FEN) name
+ * the rook directly.
+ */
+func (p *Position) addCastlingRight(c byte) error {
+	color := chess.White
+	if c >= 'a' {
+		color = chess.Black
+		c -= 'a' - 'A'
+	}
+	rank := backRank(color)
+	king := p.kingSquare(color)
+	if king < 0 || king/8 != rank {
+		return errors.New("Invalid FEN: bad castling rights")
+	}
+	file := -1
+	switch {
+	case c == 'K':
+		file = p.outerRook(color, kingSide)
+	case c == 'Q':
+		file = p.outerRook(color, queenSide)
+	case c >= 'A' && c <= 'H':
+		file = int(c - 'A')
+	}
+	if file < 0 || file == king%8 || p.Board[square(file, rank)] != makePiece(chess.Rook, color) {
+		return errors.New("Invalid FEN: bad castling rights")
+	}
+	side := kingSide
+	if file < king%8 {
+		side = queenSide
+	}
+	p.Castling[color][side] = file
+	if king%8 != 4 || (file != 0 && file != 7) {
+		p.Chess960 = true
+	}
+	return nil
+}
+
+/* File of the rook furthest from the king on the given side, -1 if there is none */
+func (p *Position) outerRook(color chess.Color, side int) int {
+	king := p.kingSquare(color)
+	rank := backRank(color)
+	if king < 0 || king/8 != rank {
+		return -1
+	}
+	rook := makePiece(chess.Rook, color)
+	if side == kingSide {
+		for file := 7; file > king%8; file-- {
+			if p.Board[square(file, rank)] == rook {
+				return file
+			}
+		}
+	} else {
+		for file := 0; file < king%8; file++ {
+			if p.Board[square(file, rank)] == rook {
+				return file
+			}
+		}
+	}
+	return -1
+}
+
+/* Pieces in hand in FEN letters, white first, e.g. "QNpp" */
+func (p *Position) PocketString() string {
+	var sb strings.Builder
+	for _, color := range []chess.Color{chess.White, chess.Black} {
+		for _, t := range pocketTypes {
+			for i := 0; i < p.Pockets[color][t]; i++ {
+				sb.WriteString(fenLetter(makePiece(t, color)))
+			}
+		}
+	}
+	return sb.String()
+}
+
+func (p *Position) copy() *Position {
+	next := *p
+	return &next
+}
+
+func (p *Position) kingSquare(color chess.Color) int {
+	king := makePiece(chess.King, color)
+	for sq, piece := range p.Board {
+		if piece == king {
+			return sq
+		}
+	}
+	return -1
+}
+
+/* Whether any piece of color by attacks sq */
+func (p *Position) attacked(sq int, by chess.Color) bool {
+	file, rank := sq%8, sq/8
+
+	/* Pawns attack diagonally forward, so look one rank behind */
+	pawnRank := rank - 1
+	if by == chess.Black {
+		pawnRank = rank + 1
+	}
+	if pawnRank >= 0 && pawnRank < 8 {
+		for _, df := range []int{-1, 1} {
+			f := file + df
+			if f >= 0 && f < 8 && p.Board[square(f, pawnRank)] == makePiece(chess.Pawn, by) {
+				return true
+			}
+		}
+	}
+	for _, o := range knightOffsets {
+		f, r := file+o[0], rank+o[1]
+		if f >= 0 && f < 8 && r >= 0 && r < 8 && p.Board[square(f, r)] == makePiece(chess.Knight, by) {
+			return true
+		}
+	}
+	for _, o := range kingOffsets {
+		f, r := file+o[0], rank+o[1]
+		if f >= 0 && f < 8 && r >= 0 && r < 8 && p.Board[square(f, r)] == makePiece(chess.King, by) {
+			return true
+		}
+	}
+	if p.slidingAttack(file, rank, rookDirs, by, chess.Rook) {
+		return true
+	}
+	return p.slidingAttack(file, rank, bishopDirs, by, chess.Bishop)
+}
+
+func (p *Position) slidingAttack(file int, rank int, dirs [][2]int, by chess.Color, slider chess.PieceType) bool {
+	for _, d := range dirs {
+		for f, r := file+d[0], rank+d[1]; f >= 0 && f < 8 && r >= 0 && r < 8; f, r = f+d[0], r+d[1] {
+			piece := p.Board[square(f, r)]
+			if piece == chess.NoPiece {
+				continue
+			}
+			if piece.Color() == by && (piece.Type() == slider || piece.Type() == chess.Queen) {
+				return true
+			}
+			break
+		}
+	}
+	return false
+}
+
+func (p *Position) InCheck() bool {
+	return p.kingSquare(p.Turn) >= 0 && p.kingEnPrise(p.Turn)
+}
+
+func adjacent(a int, b int) bool {
+	df, dr := a%8-b%8, a/8-b/8
+	return df >= -1 && df <= 1 && dr >= -1 && dr <= 1
+}
+
+/*
+ * Whether the king of color could be taken, which makes the move that led to
+ * this position illegal if color made it
+ */
+func (p *Position) kingEnPrise(color chess.Color) bool {
+	if p.Rules == AntichessMoves {
+		return false
+	}
+	king := p.kingSquare(color)
+	if p.Rules == AtomicMoves {
+		if king < 0 {
+			/* Blown up */
+			return true
+		}
+		/* Taking a king that touches its own would blow up both */
+		enemy := p.kingSquare(color.Other())
+		if enemy < 0 || adjacent(king, enemy) {
+			return false
+		}
+	}
+	return king >= 0 && p.attacked(king, color.Other())
+}
+
+/*
+ * Neither side can mate: bare kings, a single minor piece, or one bishop each
+ * on squares of the same color
+ */
+func (p *Position) insufficientMaterial() bool {
+	minors := []int{}
+	for sq, piece := range p.Board {
+		switch piece.Type() {
+		case chess.Pawn, chess.Rook, chess.Queen:
+			return false
+		case chess.Bishop, chess.Knight:
+			minors = append(minors, sq)
+		}
+	}
+	if len(minors) <= 1 {
+		return true
+	}
+	if len(minors) == 2 {
+		a, b := p.Board[minors[0]], p.Board[minors[1]]
+		sameShade := (minors[0]/8+minors[0]%8)%2 == (minors[1]/8+minors[1]%8)%2
+		return a.Type() == chess.Bishop && b.Type() == chess.Bishop && a.Color() != b.Color() && sameShade
+	}
+	return false
+}
+
+/* Whether color has anything besides its king */
+func (p *Position) hasPieces(color chess.Color) bool {
+	for _, piece := range p.Board {
+		if piece.Color() == color && piece.Type() != chess.King {
+			return true
+		}
+	}
+	return false
+}
+
+/* Moves that follow piece movement rules, ignoring whether the king is left in check */
+func (p *Position) pseudoMoves() []Move {
+	moves := []Move{}
+	us := p.Turn
+	for sq, piece := range p.Board {
+		if piece == chess.NoPiece || piece.Color() != us {
+			continue
+		}
+		file, rank := sq%8, sq/8
+		switch piece.Type() {
+		case chess.Pawn:
+			moves = p.pawnMoves(moves, sq)
+		case chess.Knight:
+			moves = p.stepMoves(moves, sq, knightOffsets)
+		case chess.King:
+			if p.Rules == AtomicMoves {
+				moves = p.quietMoves(moves, sq, kingOffsets)
+			} else {
+				moves = p.stepMoves(moves, sq, kingOffsets)
+			}
+			moves = p.castlingMoves(moves, sq)
+		case chess.Rook:
+			moves = p.slideMoves(moves, file, rank, rookDirs)
+		case chess.Bishop:
+			moves = p.slideMoves(moves, file, rank, bishopDirs)
+		case chess.Queen:
+			moves = p.slideMoves(moves, file, rank, rookDirs)
+			moves = p.slideMoves(moves, file, rank, bishopDirs)
+		}
+	}
+	return p.dropMoves(moves)
+}
+
+func (p *Position) pawnMoves(moves []Move, sq int) []Move {
+	file, rank := sq%8, sq/8
+	dir, startRank, lastRank := 1, 1, 7
+	if p.Turn == chess.Black {
+		dir, startRank, lastRank = -1, 6, 0
+	}
+	promotions := []chess.PieceType{chess.Queen, chess.Rook, chess.Bishop, chess.Knight}
+	if p.Rules == AntichessMoves {
+		promotions = append(promotions, chess.King)
+	}
+	addPawnMove := func(to int) {
+		if to/8 == lastRank {
+			for _, promo := range promotions {
+				moves = append(moves, Move{From: sq, To: to, Promo: promo})
+			}
+		} else {
+			moves = append(moves, Move{From: sq, To: to})
+		}
+	}
+	if rank+dir < 0 || rank+dir > 7 {
+		return moves
+	}
+	forward := square(file, rank+dir)
+	if p.Board[forward] == chess.NoPiece {
+		addPawnMove(forward)
+		double := square(file, rank+2*dir)
+		hordeStart := p.Rules == HordeMoves && p.Turn == chess.White && rank == 0
+		if (rank == startRank || hordeStart) && p.Board[double] == chess.NoPiece {
+			moves = append(moves, Move{From: sq, To: double})
+		}
+	}
+	for _, df := range []int{-1, 1} {
+		f := file + df
+		if f < 0 || f > 7 {
+			continue
+		}
+		to := square(f, rank+dir)
+		target := p.Board[to]
+		if (target != chess.NoPiece && target.Color() != p.Turn) || to == p.EnPassant {
+			addPawnMove(to)
+		}
+	}
+	return moves
+}
+
+func (p *Position) stepMoves(moves []Move, sq int, offsets [][2]int) []Move {
+	file, rank := sq%8, sq/8
+	for _, o := range offsets {
+		f, r := file+o[0], rank+o[1]
+		if f < 0 || f > 7 || r < 0 || r > 7 {
+			continue
+		}
+		to := square(f, r)
+		if target := p.Board[to]; target == chess.NoPiece || target.Color() != p.Turn {
+			moves = append(moves, Move{From: sq, To: to})
+		}
+	}
+	return moves
+}
+
+/* Steps onto empty squares only */
+func (p *Position) quietMoves(moves []Move, sq int, offsets [][2]int) []Move {
+	for _, m := range p.stepMoves(nil, sq, offsets) {
+		if p.Board[m.To] == chess.NoPiece {
+			moves = append(moves, m)
+		}
+	}
+	return moves
+}
+
+func (p *Position) slideMoves(moves []Move, file int, rank int, dirs [][2]int) []Move {
+	from := square(file, rank)
+	for _, d := range dirs {
+		for f, r := file+d[0], rank+d[1]; f >= 0 && f < 8 && r >= 0 && r < 8; f, r = f+d[0], r+d[1] {
+			to := square(f, r)
+			target := p.Board[to]
+			if target == chess.NoPiece {
+				moves = append(moves, Move{From: from, To: to})
+				continue
+			}
+			if target.Color() != p.Turn {
+				moves = append(moves, Move{From: from, To: to})
+			}
+			break
+		}
+	}
+	return moves
+}
+
+/* Files the king and rook end up on when castling to side */
+func castlingFiles(side int) (int, int) {
+	if side == kingSide {
+		return 6, 5
+	}
+	return 2, 3
+}
+
+/*
+ * Castling moves of the king on sq. This works for any start position: every
+ * square the king and rook pass over or land on has to be empty apart from
+ * the two of them, and none of the king's squares may be attacked.
+ */
+func (p *Position) castlingMoves(moves []Move, sq int) []Move {
+	us, them := p.Turn, p.Turn.Other()
+	rank := backRank(us)
+	if sq/8 != rank || p.attacked(sq, them) {
+		return moves
+	}
+	rook := makePiece(chess.Rook, us)
+	for side, rookFile := range p.Castling[us] {
+		rookSq := square(rookFile, rank)
+		if rookFile < 0 || p.Board[rookSq] != rook {
+			continue
+		}
+		kingTo, rookTo := castlingFiles(side)
+		/* The castling pieces themselves neither block nor shield anything */
+		without := p.copy()
+		without.Board[sq] = chess.NoPiece
+		without.Board[rookSq] = chess.NoPiece
+		ok := true
+		for _, span := range [][2]int{{sq % 8, kingTo}, {rookFile, rookTo}} {
+			lo, hi := span[0], span[1]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			for file := lo; file <= hi; file++ {
+				if without.Board[square(file, rank)] != chess.NoPiece {
+					ok = false
+				}
+			}
+		}
+		lo, hi := sq%8, kingTo
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		for file := lo; ok && file <= hi; file++ {
+			if without.attacked(square(file, rank), them) {
+				ok = false
+			}
+		}
+		if ok {
+			moves = append(moves, Move{From: sq, To: rookSq})
+		}
+	}
+	return moves
+}
+
+/* Drops of pieces in hand onto empty squares. Pawns may not go on the first or last rank */
+func (p *Position) dropMoves(moves []Move) []Move {
+	for _, t := range pocketTypes {
+		if p.Pockets[p.Turn][t] == 0 {
+			continue
+		}
+		for sq := 0; sq < 64; sq++ {
+			if p.Board[sq] != chess.NoPiece {
+				continue
+			}
+			if t == chess.Pawn && (sq/8 == 0 || sq/8 == 7) {
+				continue
+			}
+			moves = append(moves, Move{From: -1, To: sq, Drop: t})
+		}
+	}
+	return moves
+}
+
+func (p *Position) LegalMoves() []Move {
+	legal := []Move{}
+	captures := []Move{}
+	for _, m := range p.pseudoMoves() {
+		next := p.Play(m)
+		if next.kingEnPrise(p.Turn) {
+			continue
+		}
+		if p.Rules == RacingKingsMoves && next.InCheck() {
+			continue
+		}
+		legal = append(legal, m)
+		if p.isCapture(m) {
+			captures = append(captures, m)
+		}
+	}
+	if p.Rules == AntichessMoves && len(captures) > 0 {
+		return captures
+	}
+	return legal
+}
+
+/* Legal moves of p in UCI */
+func legalMovesUCI(p *Position) []string {
+	moves := []string{}
+	for _, m := range p.LegalMoves() {
+		moves = append(moves, p.UCI(m))
+	}
+	return moves
+}
+
+func (p *Position) IsLegal(m Move) bool {
+	for _, legal := range p.LegalMoves() {
+		if legal == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Position) isCastling(m Move) bool {
+	if m.Drop != chess.NoPieceType || p.Board[m.From].Type() != chess.King {
+		return false
+	}
+	return p.Board[m.To] == makePiece(chess.Rook, p.Board[m.From].Color())
+}
+
+/* The square the king lands on when m is a castling move */
+func castlingKingSquare(m Move) int {
+	side := kingSide
+	if m.To < m.From {
+		side = queenSide
+	}
+	kingTo, _ := castlingFiles(side)
+	return square(kingTo, m.From/8)
+}
+
+func (p *Position) isCapture(m Move) bool {
+	if m.Drop != chess.NoPieceType || p.isCastling(m) {
+		return false
+	}
+	return p.Board[m.To] != chess.NoPiece || p.isEnPassant(m)
+}
+
+func (p *Position) isEnPassant(m Move) bool {
+	return m.Drop == chess.NoPieceType && p.Board[m.From].Type() == chess.Pawn && m.To == p.EnPassant && m.From%8 != m.To%8
+}
+
+/*
+ * The piece m captures, if any, and whether it was promoted. Pockets are not
+ * touched by Play since where captured pieces go depends on the mode.
+ */
+func (p *Position) Captured(m Move) (chess.Piece, bool) {
+	if m.Drop != chess.NoPieceType {
+		return chess.NoPiece, false
+	}
+	if p.isEnPassant(m) {
+		return makePiece(chess.Pawn, p.Turn.Other()), false
+	}
+	return p.Board[m.To], p.Promoted[m.To]
+}
+
+/* Returns the position after m. m is assumed to be at least pseudo legal */
+func (p *Position) Play(m Move) *Position {
+	next := p.copy()
+	us := p.Turn
+	next.EnPassant = -1
+	next.HalfMove += 1
+	if us == chess.Black {
+		next.FullMove += 1
+	}
+	next.Turn = us.Other()
+
+	if m.Drop != chess.NoPieceType {
+		next.Board[m.To] = makePiece(m.Drop, us)
+		next.Promoted[m.To] = false
+		next.Pockets[us][m.Drop] -= 1
+		return next
+	}
+
+	piece := p.Board[m.From]
+	if p.isCastling(m) {
+		side := kingSide
+		if m.To < m.From {
+			side = queenSide
+		}
+		kingTo, rookTo := castlingFiles(side)
+		rank := m.From / 8
+		next.Board[m.From] = chess.NoPiece
+		next.Board[m.To] = chess.NoPiece
+		next.Promoted[m.From] = false
+		next.Promoted[m.To] = false
+		next.Board[square(kingTo, rank)] = piece
+		next.Board[square(rookTo, rank)] = makePiece(chess.Rook, us)
+		next.Castling[us] = [2]int{-1, -1}
+		return next
+	}
+	if p.Board[m.To] != chess.NoPiece {
+		next.HalfMove = 0
+	}
+	if p.isEnPassant(m) {
+		captured := square(m.To%8, m.From/8)
+		next.Board[captured] = chess.NoPiece
+		next.Promoted[captured] = false
+	}
+	capture := p.isCapture(m)
+	next.Board[m.From] = chess.NoPiece
+	next.Promoted[m.To] = p.Promoted[m.From]
+	next.Promoted[m.From] = false
+	next.Board[m.To] = piece
+	if piece.Type() == chess.Pawn {
+		next.HalfMove = 0
+		if m.To-m.From == 16 || m.From-m.To == 16 {
+			next.EnPassant = (m.From + m.To) / 2
+		}
+		if m.Promo != chess.NoPieceType {
+			next.Board[m.To] = makePiece(m.Promo, us)
+			next.Promoted[m.To] = true
+		}
+	}
+
+	if capture && p.Rules == AtomicMoves {
+		next.explode(m.To)
+	}
+	if piece.Type() == chess.King {
+		next.Castling[us] = [2]int{-1, -1}
+	}
+	/* Moving a castling rook or capturing one loses that castling right */
+	for _, color := range []chess.Color{chess.White, chess.Black} {
+		for side, file := range next.Castling[color] {
+			if rookSq := square(file, backRank(color)); file >= 0 && (m.From == rookSq || m.To == rookSq || next.Board[rookSq] == chess.NoPiece) {
+				next.Castling[color][side] = -1
+			}
+		}
+		if next.kingSquare(color) < 0 {
+			next.Castling[color] = [2]int{-1, -1}
+		}
+	}
+	return next
+}
+
+/* Removes the capturing piece on sq and every piece but pawns around it */
+func (p *Position) explode(sq int) {
+	p.Board[sq] = chess.NoPiece
+	p.Promoted[sq] = false
+	for _, o := range kingOffsets {
+		f, r := sq%8+o[0], sq/8+o[1]
+		if f < 0 || f > 7 || r < 0 || r > 7 {
+			continue
+		}
+		if around := square(f, r); p.Board[around].Type() != chess.Pawn {
+			p.Board[around] = chess.NoPiece
+			p.Promoted[around] = false
+		}
+	}
+}
+
+func (p *Position) UCI(m Move) string {
+	if m.Drop != chess.NoPieceType {
+		return pieceLetter(m.Drop) + "@" + squareName(m.To)
+	}
+	if p.isCastling(m) && !p.Chess960 {
+		return squareName(m.From) + squareName(castlingKingSquare(m))
+	}
+	return squareName(m.From) + squareName(m.To) + strings.ToLower(pieceLetter(m.Promo))
+}
+
+/* Standard algebraic notation of m. Drops are written like P@e4 */
+func (p *Position) SAN(m Move) string {
+	return p.sanWithoutSuffix(m, p.LegalMoves()) + p.checkSuffix(m)
+}
+
+/*
+ * Long algebraic notation of m, naming both squares like Ng1-f3 or e4xd5.
+ * Castling and drops are written as in SAN.
+ */
+func (p *Position) LAN(m Move) string {
+	return p.lanWithoutSuffix(m, p.LegalMoves()) + p.checkSuffix(m)
+}
+
+/* A move as it is written in each notation */
+type MoveNotation struct {
+	UCI string
+	SAN string
+	LAN string
+}
+
+func (p *Position) Notation(m Move) MoveNotation {
+	legal, suffix := p.LegalMoves(), p.checkSuffix(m)
+	return MoveNotation{
+		UCI: p.UCI(m),
+		SAN: p.sanWithoutSuffix(m, legal) + suffix,
+		LAN: p.lanWithoutSuffix(m, legal) + suffix,
+	}
+}
+
+/* + if m gives check, # if it mates */
+func (p *Position) checkSuffix(m Move) string {
+	next := p.Play(m)
+	if !next.InCheck() {
+		return ""
+	}
+	if len(next.LegalMoves()) == 0 {
+		return "#"
+	}
+	return "+"
+}
+
+func (p *Position) lanWithoutSuffix(m Move, legal []Move) string {
+	if m.Drop != chess.NoPieceType || p.isCastling(m) {
+		return p.sanWithoutSuffix(m, legal)
+	}
+	lan := ""
+	if piece := p.Board[m.From]; piece.Type() != chess.Pawn {
+		lan = pieceLetter(piece.Type())
+	}
+	lan += squareName(m.From)
+	if p.isCapture(m) {
+		lan += "x"
+	} else {
+		lan += "-"
+	}
+	lan += squareName(m.To)
+	if m.Promo != chess.NoPieceType {
+		lan += "=" + pieceLetter(m.Promo)
+	}
+	return lan
+}
+
+/* SAN of m without check marks, telling it apart from the other moves in legal */
+func (p *Position) sanWithoutSuffix(m Move, legal []Move) string {
+	if m.Drop != chess.NoPieceType {
+		return pieceLetter(m.Drop) + "@" + squareName(m.To)
+	}
+	if p.isCastling(m) {
+		if m.To > m.From {
+			return "O-O"
+		}
+		return "O-O-O"
+	}
+	piece := p.Board[m.From]
+	capture := p.isCapture(m)
+	san := ""
+	if piece.Type() == chess.Pawn {
+		if capture {
+			san = squareName(m.From)[:1] + "x"
+		}
+		san += squareName(m.To)
+		if m.Promo != chess.NoPieceType {
+			san += "=" + pieceLetter(m.Promo)
+		}
+		return san
+	}
+
+	/* Disambiguate between pieces of the same type that can reach the same square */
+	sameFile, sameRank, ambiguous := false, false, false
+	for _, other := range legal {
+		if other.Drop != chess.NoPieceType || other.From == m.From || other.To != m.To || p.Board[other.From] != piece {
+			continue
+		}
+		ambiguous = true
+		if other.From%8 == m.From%8 {
+			sameFile = true
+		}
+		if other.From/8 == m.From/8 {
+			sameRank = true
+		}
+	}
+	san = pieceLetter(piece.Type())
+	from := squareName(m.From)
+	if ambiguous {
+		if !sameFile {
+			san += from[:1]
+		} else if !sameRank {
+			san += from[1:]
+		} else {
+			san += from
+		}
+	}
+	if capture {
+		san += "x"
+	}
+	return san + squareName(m.To)
+}
+
+/* Whether legal holds a move from from to to */
+func movesTo(legal []Move, from, to int) bool {
+	for _, m := range legal {
+		if m.Drop == chess.NoPieceType && m.From == from && m.To == to {
+			return true
+		}
+	}
+	return false
+}
+
+/* Parses a move given in SAN, LAN or UCI notation */
+func (p *Position) ParseMove(s string) (Move, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "+#!?")
+	s = strings.ReplaceAll(s, "0", "O")
+	if strings.HasPrefix(s, "@") {
+		s = "P" + s
+	}
+	/* The legal moves are generated once and shared by every notation */
+	legal := p.LegalMoves()
+	for _, m := range legal {
+		san := p.sanWithoutSuffix(m, legal)
+		if s == san || strings.ToLower(s) == strings.ToLower(p.UCI(m)) {
+			return m, nil
+		}
+		/* Long algebraic notation, also without the - between the squares */
+		if lan := p.lanWithoutSuffix(m, legal); s == lan || s == strings.Replace(lan, "-", "", 1) {
+			return m, nil
+		}
+		/* Castling may always be given as the king taking its own rook */
+		if p.isCastling(m) && strings.ToLower(s) == squareName(m.From)+squareName(m.To) {
+			return m, nil
+		}
+		/*
+		 * Chess960 castling may also be given as the king moving to its
+		 * square, like e1g1, unless an ordinary king move goes there too
+		 */
+		if p.Chess960 && p.isCastling(m) {
+			to := castlingKingSquare(m)
+			if to != m.From && strings.ToLower(s) == squareName(m.From)+squareName(to) && !movesTo(legal, m.From, to) {
+				return m, nil
+			}
+		}
+		/* Pawn promotions are sometimes written without the = */
+		if m.Promo != chess.NoPieceType && s == strings.Replace(san, "=", "", 1) {
+			return m, nil
+		}
+	}
+	return Move{}, fmt.Errorf("Invalid move %s", s)
+}
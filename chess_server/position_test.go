@@ -0,0 +1,293 @@
+package chess_server
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/notnil/chess"
+)
+
+/* Number of leaf positions depth half moves from p */
+func perft(p *Position, depth int) int {
+	if depth == 0 {
+		return 1
+	}
+	nodes := 0
+	for _, m := range p.LegalMoves() {
+		nodes += perft(p.Play(m), depth-1)
+	}
+	return nodes
+}
+
+type perftCase struct {
+	fen   string
+	rules MoveRules
+	nodes []int
+}
+
+func runPerft(t *testing.T, cases []perftCase) {
+	for _, c := range cases {
+		p, err := ParsePosition(c.fen)
+		if err != nil {
+			t.Fatalf("%s: %s", c.fen, err)
+		}
+		p.Rules = c.rules
+		for depth, want := range c.nodes {
+			if got := perft(p, depth+1); got != want {
+				t.Errorf("%s: perft(%d) = %d, want %d", c.fen, depth+1, got, want)
+			}
+		}
+	}
+}
+
+/* Reference counts from https://www.chessprogramming.org/Perft_Results */
+func TestPerft(t *testing.T) {
+	runPerft(t, []perftCase{
+		{fen: StartingFEN, nodes: []int{20, 400, 8902, 197281}},
+		{fen: "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", nodes: []int{48, 2039, 97862}},
+		{fen: "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", nodes: []int{14, 191, 2812, 43238}},
+		{fen: "r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", nodes: []int{6, 264, 9467}},
+		{fen: "rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8", nodes: []int{44, 1486, 62379}},
+	})
+}
+
+/* Random games checked move by move against notnil/chess */
+func TestPositionMatchesNotnil(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 4; i++ {
+		game := chess.NewGame()
+		pos := NewPosition()
+		for ply := 0; ply < 120 && game.Outcome() == chess.NoOutcome; ply++ {
+			moves := game.ValidMoves()
+			if len(moves) != len(pos.LegalMoves()) {
+				t.Fatalf("%s: %d legal moves, want %d", game.FEN(), len(pos.LegalMoves()), len(moves))
+			}
+			m := moves[r.Intn(len(moves))]
+			san := chess.AlgebraicNotation{}.Encode(game.Position(), m)
+			parsed, err := pos.ParseMove(san)
+			if err != nil {
+				t.Fatalf("%s: %s", game.FEN(), err)
+			}
+			if got := pos.SAN(parsed); got != san {
+				t.Fatalf("%s: SAN %s, want %s", game.FEN(), got, san)
+			}
+			game.Move(m)
+			pos = pos.Play(parsed)
+			/* notnil/chess only gives the en passant square when a capture is possible */
+			if got, want := strings.Fields(pos.FEN(false))[:3], strings.Fields(game.FEN())[:3]; strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Fatalf("after %s: %s, want %s", san, pos.FEN(false), game.FEN())
+			}
+		}
+	}
+}
+
+func TestFENRoundTrip(t *testing.T) {
+	cases := []struct {
+		fen         string
+		withPockets bool
+	}{
+		{StartingFEN, false},
+		{"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", false},
+		{"rnbqkbnr/ppp1pppp/8/3pP3/8/8/PPPP1PPP/RNBQKBNR w KQkq d6 0 3", false},
+		{"r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R[Pn] w KQkq - 2 3", true},
+		{"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR[] w KQkq - 0 1", true},
+	}
+	for _, c := range cases {
+		pos, err := ParsePosition(c.fen)
+		if err != nil {
+			t.Fatalf("%s: %s", c.fen, err)
+		}
+		if got := pos.FEN(c.withPockets); got != c.fen {
+			t.Errorf("%s came back as %s", c.fen, got)
+		}
+	}
+}
+
+func TestParseMoveNotations(t *testing.T) {
+	pos, err := ParsePosition("r3k3/1P6/8/8/8/8/4P3/R3K2R w KQq - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		move string
+		uci  string
+	}{
+		{"e1g1", "e1g1"},
+		{"O-O", "e1g1"},
+		{"0-0-0", "e1c1"},
+		{"e1h1", "e1g1"},
+		{"e2e4", "e2e4"},
+		{"e4", "e2e4"},
+		{"e2-e4", "e2e4"},
+		{"Ra1-a7", "a1a7"},
+		{"Ra1a7", "a1a7"},
+		{"Ra7", "a1a7"},
+		{"bxa8=Q+", "b7a8q"},
+		{"b7xa8=Q", "b7a8q"},
+		{"b7a8n", "b7a8n"},
+		{"b8Q", "b7b8q"},
+	}
+	for _, c := range cases {
+		m, err := pos.ParseMove(c.move)
+		if err != nil {
+			t.Errorf("%s: %s", c.move, err)
+			continue
+		}
+		if got := pos.UCI(m); got != c.uci {
+			t.Errorf("%s read as %s, want %s", c.move, got, c.uci)
+		}
+	}
+	for _, move := range []string{"e5", "Ke3", "a8=Q", "e1e3", "Nf3"} {
+		if _, err := pos.ParseMove(move); err == nil {
+			t.Errorf("illegal move %s accepted", move)
+		}
+	}
+}
+
+func TestNotation(t *testing.T) {
+	pos, err := ParsePosition("4k3/1P6/8/8/8/8/8/R3K3 w Q - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		move string
+		want MoveNotation
+	}{
+		{"b8=Q", MoveNotation{UCI: "b7b8q", SAN: "b8=Q+", LAN: "b7-b8=Q+"}},
+		{"O-O-O", MoveNotation{UCI: "e1c1", SAN: "O-O-O", LAN: "O-O-O"}},
+		{"Ra8", MoveNotation{UCI: "a1a8", SAN: "Ra8+", LAN: "Ra1-a8+"}},
+	}
+	for _, c := range cases {
+		m, err := pos.ParseMove(c.move)
+		if err != nil {
+			t.Fatalf("%s: %s", c.move, err)
+		}
+		if got := pos.Notation(m); got != c.want {
+			t.Errorf("%s: %+v, want %+v", c.move, got, c.want)
+		}
+	}
+}
+
+func TestDrops(t *testing.T) {
+	pos, err := ParsePosition("4k3/8/8/8/8/8/8/4K3[Pn] w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drops := 0
+	for _, m := range pos.LegalMoves() {
+		if m.Drop == chess.NoPieceType {
+			continue
+		}
+		drops += 1
+		if m.Drop != chess.Pawn {
+			t.Errorf("white dropped a %s", pieceLetter(m.Drop))
+		}
+		if rank := m.To / 8; rank == 0 || rank == 7 {
+			t.Errorf("pawn dropped on %s", squareName(m.To))
+		}
+	}
+	/* Every empty square of the second to seventh rank */
+	if drops != 48 {
+		t.Errorf("%d pawn drops, want 48", drops)
+	}
+	m, err := pos.ParseMove("P@d7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := pos.Play(m)
+	if next.Pockets[chess.White][chess.Pawn] != 0 || !next.InCheck() {
+		t.Errorf("after P@d7: %s", next.FEN(true))
+	}
+}
+
+func TestBughouseMated(t *testing.T) {
+	cases := []struct {
+		fen   string
+		mated bool
+	}{
+		/* Back rank mate a drop on f8 or g8 could block */
+		{"6k1/5ppp/8/8/8/8/8/R5K1 b - - 0 1", false},
+		/* Smothered mate, nothing can be dropped in between */
+		{"6rk/5Npp/8/8/8/8/8/6K1 b - - 0 1", true},
+		/* Not in check */
+		{"7k/8/6Q1/8/8/8/8/6K1 b - - 0 1", false},
+	}
+	for _, c := range cases {
+		pos, err := ParsePosition(c.fen)
+		if err != nil {
+			t.Fatalf("%s: %s", c.fen, err)
+		}
+		if got := bughouseMated(pos); got != c.mated {
+			t.Errorf("%s: mated %t, want %t", c.fen, got, c.mated)
+		}
+	}
+}
+
+func TestCapturedPromotedPiece(t *testing.T) {
+	pos, err := ParsePosition("r3k3/Q~7/8/8/8/8/8/4K3 b - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := pos.ParseMove("Rxa7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if piece, promoted := pos.Captured(m); piece != chess.WhiteQueen || !promoted {
+		t.Errorf("Rxa7 captures %s, promoted %t", fenLetter(piece), promoted)
+	}
+	/* Promoting marks the new piece */
+	pos, err = ParsePosition("4k3/P7/8/8/8/8/8/4K3 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = pos.ParseMove("a8=Q+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := pos.Play(m); !next.Promoted[square(0, 7)] {
+		t.Errorf("a8=Q not marked as promoted in %s", next.FEN(true))
+	}
+}
+
+func TestValidateCustomStart(t *testing.T) {
+	tests := []struct {
+		mode  string
+		fen   string
+		valid bool
+	}{
+		{ModeStandard, "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", true},
+		{ModeStandard, "8/8/8/8/8/8/4P3/4K3 w - - 0 1", false},
+		{ModeStandard, "4k3/8/8/8/8/8/4P3/3KK3 w - - 0 1", false},
+		{ModeStandard, "4k2P/8/8/8/8/8/8/4K3 w - - 0 1", false},
+		{ModeStandard, "4k3/8/8/8/8/8/8/4K2P w - - 0 1", false},
+		/* Black is in check with white to move */
+		{ModeStandard, "4k3/8/8/8/8/8/8/4K2R w - - 0 1", true},
+		{ModeStandard, "4k2R/8/8/8/8/8/8/4K3 w - - 0 1", false},
+		{ModeStandard, "4k3/8/8/8/4P3/8/8/4K3 b - e3 0 1", true},
+		{ModeStandard, "4k3/8/8/8/8/4P3/8/4K3 b - e3 0 1", false},
+		{ModeStandard, "4k3/8/8/8/8/8/PPPPPPPP/4K3 w - - 0 1", true},
+		{ModeStandard, "4k3/8/8/8/7P/8/PPPPPPPP/4K3 w - - 0 1", false},
+		/* Eight pawns leave no room for a second queen */
+		{ModeStandard, "4k3/8/8/8/8/8/PPPPPPPP/QQ2K3 w - - 0 1", false},
+		{ModeStandard, "4k3/8/8/8/8/8/PPPPPPP1/QQ2K3 w - - 0 1", true},
+		{ModeStandard, "4k3/8/8/8/8/NNNNNNNN/8/NNN1K3 w - - 0 1", false},
+		{ModeStandard, "4k3/8/8/8/8/NNNNNNNN/8/NN2K3 w - - 0 1", true},
+		{ModeRacingKings, "8/8/8/8/8/8/krbnNBRK/qrbnNBRQ w - - 0 1", true},
+		{ModeRacingKings, "8/8/8/8/8/8/krbnNBRK/qrbnNBRQ b - - 0 1", true},
+		{ModeRacingKings, "8/8/8/8/8/1Q6/krbnNBRK/1rbnNBRQ b - - 0 1", false},
+		{ModeHorde, HordeFEN, true},
+		{ModeHorde, "rnbqkbnr/pppppppp/8/1p6/8/8/PPPPPPPP/PPPPPPPP b kq - 0 1", false},
+		{ModeAntichess, "8/8/8/8/8/8/PPPPPPPP/8 w - - 0 1", true},
+		{ModeAntichess, "k7/8/8/8/8/8/PPPPPPPP/KK6 w - - 0 1", false},
+		/* Crazyhouse pawns can be captured and dropped by the other side */
+		{ModeCrazyhouse, "4k3/8/8/8/8/P7/PPPPPPPP/4K3[P] w - - 0 1", true},
+		{ModeCrazyhouse, "4k3/pppppppp/8/8/8/P7/PPPPPPPP/4K3[P] w - - 0 1", false},
+	}
+	for _, test := range tests {
+		_, err := NewVariant(test.mode, GameNewUpdate{Mode: test.mode, FEN: test.fen}, nil)
+		if (err == nil) != test.valid {
+			t.Errorf("%s %s: valid %t (%v)", test.mode, test.fen, err == nil, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package chess_server
+
+import (
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeRacingKings, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		return NewRacingKingsBoard(options)
+	})
+}
+
+const RacingKingsFEN = "8/8/8/8/8/8/krbnNBRK/qrbnNBRQ w - - 0 1"
+
+/*
+ * RacingKingsBoard is the board of a racing kings game. Checks are not
+ * allowed (see RacingKingsMoves) and the first king to reach the eighth rank
+ * wins. If white gets there first black has one move to draw by getting
+ * there as well.
+ */
+type RacingKingsBoard struct {
+	positionGame
+}
+
+func NewRacingKingsBoard(options GameNewUpdate) (*RacingKingsBoard, error) {
+	start, err := startingPosition(options, RacingKingsFEN, RacingKingsMoves)
+	if err != nil {
+		return nil, err
+	}
+	return &RacingKingsBoard{newPositionGame(start)}, nil
+}
+
+func (b *RacingKingsBoard) FEN() string {
+	return b.Position.FEN(false)
+}
+
+func (b *RacingKingsBoard) ApplyMove(move string) error {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return err
+	}
+	b.play(b.Position.Play(m))
+	return nil
+}
+
+func (b *RacingKingsBoard) finished(color chess.Color) bool {
+	return b.Position.kingSquare(color)/8 == 7
+}
+
+/* Whether black can still answer white reaching the eighth rank */
+func (b *RacingKingsBoard) blackCanFollow() bool {
+	pos := b.Position
+	if pos.Turn != chess.Black {
+		return false
+	}
+	for _, m := range pos.LegalMoves() {
+		if pos.Board[m.From] == chess.BlackKing && m.To/8 == 7 {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *RacingKingsBoard) Outcome() (chess.Outcome, string) {
+	if b.Decided != chess.NoOutcome {
+		return b.Decided, b.DecidedBy
+	}
+	white, black := b.finished(chess.White), b.finished(chess.Black)
+	switch {
+	case white && black:
+		return chess.Draw, "king_reached_eighth_rank"
+	case black:
+		return chess.BlackWon, "king_reached_eighth_rank"
+	case white && !b.blackCanFollow():
+		return chess.WhiteWon, "king_reached_eighth_rank"
+	case white:
+		return chess.NoOutcome, ""
+	}
+	if outcome, method := b.mateOutcome(); outcome != chess.NoOutcome {
+		return outcome, method
+	}
+	return b.automaticDraw()
+}
+
+/* A king can always still win the race */
+func (b *RacingKingsBoard) HasMatingMaterial(color chess.Color) bool {
+	return true
+}
+
+func (b *RacingKingsBoard) AddSyncState(update *GameSyncUpdate) {
+}
+
+func (b *RacingKingsBoard) AddMoveState(update *GameMoveUpdate) {
+}
+
+func (b *RacingKingsBoard) Setup(options *GameNewUpdate) {
+}
@@ -0,0 +1,309 @@
+package chess_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+/* Players whose deviation is above this have not played enough for a reliable rating */
+const ProvisionalDeviation = 110
+
+/* Names players are rated under: letters, digits, '_' and '-' */
+var userPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func ValidUser(user string) bool {
+	return userPattern.MatchString(user)
+}
+
+/*
+ * Speed category of a time control, from the estimated duration of a game of
+ * 40 moves
+ */
+func RatingCategory(tc TimeControl) string {
+	if !tc.Timed() {
+		return "untimed"
+	}
+	estimate := tc.Base + 40*tc.Increment
+	switch {
+	case estimate < 30*time.Second:
+		return "ultrabullet"
+	case estimate < 3*time.Minute:
+		return "bullet"
+	case estimate < 8*time.Minute:
+		return "blitz"
+	case estimate < 25*time.Minute:
+		return "rapid"
+	default:
+		return "classical"
+	}
+}
+
+/* Players have a separate rating for every mode and speed, e.g. "atomic/blitz" */
+func RatingPool(mode string, tc TimeControl) string {
+	return mode + "/" + RatingCategory(tc)
+}
+
+/* A rating as shown to players */
+type RatingUpdate struct {
+	Rating      int     `json:"rating"`
+	Deviation   int     `json:"deviation"`
+	Volatility  float64 `json:"volatility"`
+	Games       int     `json:"games"`
+	Provisional bool    `json:"provisional"`
+}
+
+/* How a game changed a player's rating */
+type RatingChange struct {
+	User        string `json:"user"`
+	Rating      int    `json:"rating"`
+	Change      int    `json:"change"`
+	Deviation   int    `json:"deviation"`
+	Provisional bool   `json:"provisional"`
+}
+
+/* A player's rating in a pool after a game */
+type RatingHistoryEntry struct {
+	GameId    uint64    `json:"game_id"`
+	Time      time.Time `json:"time"`
+	Rating    int       `json:"rating"`
+	Deviation int       `json:"deviation"`
+	Change    int       `json:"change"`
+}
+
+type PlayerRating struct {
+	Glicko
+	Games   int                  `json:"games"`
+	History []RatingHistoryEntry `json:"history"`
+}
+
+func (r *PlayerRating) Update() RatingUpdate {
+	return RatingUpdate{
+		Rating:      int(math.Round(r.Rating)),
+		Deviation:   int(math.Round(r.Deviation)),
+		Volatility:  r.Volatility,
+		Games:       r.Games,
+		Provisional: r.Deviation > ProvisionalDeviation,
+	}
+}
+
+/* A player's ratings and their history, by pool */
+type PlayerRatingsUpdate struct {
+	User    string                          `json:"user"`
+	Ratings map[string]RatingUpdate         `json:"ratings"`
+	History map[string][]RatingHistoryEntry `json:"history"`
+}
+
+type RatingLookupRequest struct {
+	User string
+	Pool string
+}
+
+/* Reported by a game between two rated players when it ends */
+type RatingGameRequest struct {
+	GameId  uint64
+	Pool    string
+	White   string
+	Black   string
+	Outcome chess.Outcome
+}
+
+type RatingHistoryRequest struct {
+	User string
+}
+
+type RatingRequest struct {
+	Update   interface{}
+	Response chan<- interface{}
+}
+
+type RatingResponse struct {
+	Rating  RatingUpdate
+	Changes [2]RatingChange
+	Ratings PlayerRatingsUpdate
+	Error   error
+}
+
+/*
+ * RatingController keeps the Glicko-2 ratings of every player, per pool.
+ * Games report their results to it as they end.
+ */
+type RatingController struct {
+	Requests chan RatingRequest
+	/* Ratings by user and pool */
+	Players map[string]map[string]*PlayerRating
+	/* JSON file the ratings are kept in, none if empty */
+	Path string
+}
+
+func (r *RatingController) Init() {
+	r.Requests = make(chan RatingRequest)
+	r.Players = make(map[string]map[string]*PlayerRating)
+}
+
+/*
+ * Loads the ratings in path and keeps them there from now on, starting with
+ * none if the file does not exist yet. Call before Run.
+ */
+func (r *RatingController) Load(path string) error {
+	r.Path = path
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	players := make(map[string]map[string]*PlayerRating)
+	if err := json.Unmarshal(data, &players); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	r.Players = players
+	return nil
+}
+
+/* Writes every rating to a temporary file and moves it over the old one */
+func (r *RatingController) save() error {
+	if r.Path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.Players, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.Path)
+}
+
+func (r *RatingController) Run() {
+	for {
+		request := <-r.Requests
+		var response RatingResponse
+		switch update := request.Update.(type) {
+		case RatingLookupRequest:
+			response.Rating = r.rating(update.User, update.Pool).Update()
+		case RatingGameRequest:
+			response.Changes, response.Error = r.rateGame(update)
+		case RatingHistoryRequest:
+			response.Ratings = r.history(update.User)
+		}
+		request.Response <- response
+	}
+}
+
+func (r *RatingController) request(update interface{}) RatingResponse {
+	response := make(chan interface{})
+	r.Requests <- RatingRequest{Update: update, Response: response}
+	return (<-response).(RatingResponse)
+}
+
+/* Current rating of user in pool, the initial one if they have not played there */
+func (r *RatingController) Rating(user string, pool string) RatingUpdate {
+	return r.request(RatingLookupRequest{User: user, Pool: pool}).Rating
+}
+
+/* Rates a finished game and returns the changes for white and black */
+func (r *RatingController) RateGame(game RatingGameRequest) ([2]RatingChange, error) {
+	response := r.request(game)
+	return response.Changes, response.Error
+}
+
+func (r *RatingController) History(user string) PlayerRatingsUpdate {
+	return r.request(RatingHistoryRequest{User: user}).Ratings
+}
+
+func (r *RatingController) rating(user string, pool string) *PlayerRating {
+	pools, ok := r.Players[user]
+	if !ok {
+		pools = make(map[string]*PlayerRating)
+		r.Players[user] = pools
+	}
+	rating, ok := pools[pool]
+	if !ok {
+		rating = &PlayerRating{Glicko: NewGlicko()}
+		pools[pool] = rating
+	}
+	return rating
+}
+
+func (r *RatingController) rateGame(game RatingGameRequest) ([2]RatingChange, error) {
+	var changes [2]RatingChange
+	if game.White == game.Black {
+		return changes, errors.New("Players can not be rated against themselves")
+	}
+	var whiteScore float64
+	switch game.Outcome {
+	case chess.WhiteWon:
+		whiteScore = 1
+	case chess.BlackWon:
+		whiteScore = 0
+	case chess.Draw:
+		whiteScore = 0.5
+	default:
+		return changes, errors.New("Game is not over")
+	}
+	white := r.rating(game.White, game.Pool)
+	black := r.rating(game.Black, game.Pool)
+	/* Put back if the new ratings can not be saved */
+	whiteBefore, blackBefore := *white, *black
+	/* Both updates use the ratings from before the game */
+	newWhite := white.Glicko.Update([]GlickoResult{{Opponent: black.Glicko, Score: whiteScore}})
+	newBlack := black.Glicko.Update([]GlickoResult{{Opponent: white.Glicko, Score: 1 - whiteScore}})
+	now := time.Now()
+	for i, player := range []struct {
+		user   string
+		rating *PlayerRating
+		next   Glicko
+	}{{game.White, white, newWhite}, {game.Black, black, newBlack}} {
+		before := int(math.Round(player.rating.Rating))
+		player.rating.Glicko = player.next
+		player.rating.Games += 1
+		update := player.rating.Update()
+		changes[i] = RatingChange{
+			User:        player.user,
+			Rating:      update.Rating,
+			Change:      update.Rating - before,
+			Deviation:   update.Deviation,
+			Provisional: update.Provisional,
+		}
+		player.rating.History = append(player.rating.History, RatingHistoryEntry{
+			GameId:    game.GameId,
+			Time:      now,
+			Rating:    update.Rating,
+			Deviation: update.Deviation,
+			Change:    changes[i].Change,
+		})
+	}
+	if err := r.save(); err != nil {
+		*white, *black = whiteBefore, blackBefore
+		return [2]RatingChange{}, err
+	}
+	return changes, nil
+}
+
+func (r *RatingController) history(user string) PlayerRatingsUpdate {
+	ratings := PlayerRatingsUpdate{
+		User:    user,
+		Ratings: make(map[string]RatingUpdate),
+		History: make(map[string][]RatingHistoryEntry),
+	}
+	for pool, rating := range r.Players[user] {
+		if rating.Games == 0 {
+			continue
+		}
+		ratings.Ratings[pool] = rating.Update()
+		ratings.History[pool] = append([]RatingHistoryEntry{}, rating.History...)
+	}
+	return ratings
+}
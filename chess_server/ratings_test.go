@@ -0,0 +1,52 @@
+package chess_server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/notnil/chess"
+)
+
+func TestRatingsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	var ratings RatingController
+	ratings.Init()
+	if err := ratings.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := ratings.rateGame(RatingGameRequest{GameId: 1, Pool: "standard/blitz", White: "alice", Black: "bob", Outcome: chess.WhiteWon})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[0].Change <= 0 || changes[1].Change >= 0 {
+		t.Errorf("changes %+v after a white win", changes)
+	}
+	var restarted RatingController
+	restarted.Init()
+	if err := restarted.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if got, want := restarted.history(user), ratings.history(user); !reflect.DeepEqual(got.Ratings, want.Ratings) || len(got.History["standard/blitz"]) != 1 {
+			t.Errorf("%s: %+v after a restart, want %+v", user, got, want)
+		}
+	}
+}
+
+func TestRatingsKeptWhenNotSaved(t *testing.T) {
+	var ratings RatingController
+	ratings.Init()
+	/* A directory in the way of the file makes the save fail */
+	ratings.Path = t.TempDir()
+	if err := os.Mkdir(ratings.Path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ratings.rateGame(RatingGameRequest{GameId: 1, Pool: "standard/blitz", White: "alice", Black: "bob", Outcome: chess.Draw}); err == nil {
+		t.Fatal("rated a game that could not be saved")
+	}
+	if rating := ratings.rating("alice", "standard/blitz"); rating.Games != 0 || len(rating.History) != 0 || rating.Glicko != NewGlicko() {
+		t.Errorf("unsaved game changed the rating to %+v", rating)
+	}
+}
@@ -0,0 +1,240 @@
+package chess_server
+
+import (
+	"errors"
+
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeStandard, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		game, err := newStandardGame(options)
+		if err != nil {
+			return nil, err
+		}
+		return &StandardVariant{Game: game}, nil
+	})
+	RegisterVariant(ModeRandomOpening, newRandomOpening)
+}
+
+/* Regular chess, played on notnil/chess */
+type StandardVariant struct {
+	Game *chess.Game
+	/* Opening the game started from and the number of half moves it took */
+	Opening  *Opening
+	StartPly int
+	/* The last move read, since a move is validated, written out and applied in turn */
+	decoded decodedMove
+}
+
+type decodedMove struct {
+	FEN      string
+	Move     string
+	Decoded  *chess.Move
+	Position *Position
+	Parsed   Move
+}
+
+/* A game from the initial position, or from the custom start position in options */
+func newStandardGame(options GameNewUpdate) (*chess.Game, error) {
+	if options.FEN == "" {
+		return chess.NewGame(), nil
+	}
+	start, err := startingPosition(options, StartingFEN, StandardMoves)
+	if err != nil {
+		return nil, err
+	}
+	fen, err := chess.FEN(start.FEN(false))
+	if err != nil {
+		return nil, err
+	}
+	return chess.NewGame(fen), nil
+}
+
+/*
+ * Regular chess from the given opening, or one picked from the pool. Custom
+ * games are played from their own position instead.
+ */
+func newRandomOpening(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+	if options.FEN != "" {
+		game, err := newStandardGame(options)
+		if err != nil {
+			return nil, err
+		}
+		return &StandardVariant{Game: game}, nil
+	}
+	opening := options.Opening
+	if opening == nil && openings != nil {
+		opening = openings.Random()
+	}
+	variant := &StandardVariant{Game: chess.NewGame()}
+	if opening == nil {
+		return variant, nil
+	}
+	/* The pool was validated when it was loaded */
+	game, err := opening.Game()
+	if err != nil {
+		return nil, err
+	}
+	variant.Game = game
+	variant.Opening = opening
+	variant.StartPly = len(game.Moves())
+	return variant, nil
+}
+
+func (v *StandardVariant) FEN() string {
+	return v.Game.FEN()
+}
+
+func (v *StandardVariant) Turn() chess.Color {
+	return v.Game.Position().Turn()
+}
+
+/*
+ * notnil/chess reads one notation at a time, so moves are read by the
+ * Position engine, which takes any of them, and handed over in UCI
+ */
+func (v *StandardVariant) decode(move string) (*chess.Move, *Position, Move, error) {
+	fen := v.FEN()
+	if last := v.decoded; last.Decoded != nil && last.FEN == fen && last.Move == move {
+		return last.Decoded, last.Position, last.Parsed, nil
+	}
+	pos, err := ParsePosition(fen)
+	if err != nil {
+		return nil, nil, Move{}, err
+	}
+	m, err := pos.ParseMove(move)
+	if err != nil {
+		return nil, nil, Move{}, err
+	}
+	decoded, err := chess.UCINotation{}.Decode(v.Game.Position(), pos.UCI(m))
+	if err != nil {
+		return nil, nil, Move{}, err
+	}
+	v.decoded = decodedMove{FEN: fen, Move: move, Decoded: decoded, Position: pos, Parsed: m}
+	return decoded, pos, m, nil
+}
+
+func (v *StandardVariant) ValidateMove(move string) error {
+	_, _, _, err := v.decode(move)
+	return err
+}
+
+func (v *StandardVariant) LegalMoves() []string {
+	pos := v.Game.Position()
+	moves := []string{}
+	for _, m := range v.Game.ValidMoves() {
+		moves = append(moves, chess.UCINotation{}.Encode(pos, m))
+	}
+	return moves
+}
+
+/* notnil/chess only tags moves that give check, which misses custom start positions */
+func (v *StandardVariant) InCheck() bool {
+	pos, err := ParsePosition(v.FEN())
+	return err == nil && pos.InCheck()
+}
+
+func (v *StandardVariant) Notation(move string) (MoveNotation, error) {
+	_, pos, parsed, err := v.decode(move)
+	if err != nil {
+		return MoveNotation{}, err
+	}
+	return pos.Notation(parsed), nil
+}
+
+func (v *StandardVariant) ApplyMove(move string) error {
+	m, _, _, err := v.decode(move)
+	if err != nil {
+		return err
+	}
+	return v.Game.Move(m)
+}
+
+func (v *StandardVariant) Outcome() (chess.Outcome, string) {
+	return v.Game.Outcome(), methodString(v.Game.Method())
+}
+
+func (v *StandardVariant) Resign(color chess.Color) {
+	v.Game.Resign(color)
+}
+
+func (v *StandardVariant) Draw() {
+	/* Unlike Resign, notnil/chess would overwrite a finished game's result */
+	if v.Game.Outcome() != chess.NoOutcome {
+		return
+	}
+	/* A draw offer is always eligible, so this can not fail */
+	v.Game.Draw(chess.DrawOffer)
+}
+
+func methodString(method chess.Method) string {
+	switch method {
+	case chess.Checkmate:
+		return "checkmate"
+	case chess.Resignation:
+		return "resignation"
+	case chess.DrawOffer:
+		return "agreement"
+	case chess.Stalemate:
+		return "stalemate"
+	case chess.ThreefoldRepetition:
+		return "threefold_repetition"
+	case chess.FivefoldRepetition:
+		return "fivefold_repetition"
+	case chess.FiftyMoveRule:
+		return "fifty_move_rule"
+	case chess.SeventyFiveMoveRule:
+		return "seventy_five_move_rule"
+	case chess.InsufficientMaterial:
+		return "insufficient_material"
+	default:
+		return ""
+	}
+}
+
+func (v *StandardVariant) HasMatingMaterial(color chess.Color) bool {
+	pieces := []chess.Piece{}
+	for _, piece := range v.Game.Position().Board().SquareMap() {
+		pieces = append(pieces, piece)
+	}
+	return hasMatingMaterial(pieces, color)
+}
+
+/* Moves of the opening were not made by the players and can not be taken back */
+func (v *StandardVariant) Plies() (int, chess.Color) {
+	return len(v.Game.Moves()) - v.StartPly, v.Game.Positions()[v.StartPly].Turn()
+}
+
+/* Replays the game without its last plies half moves */
+func (v *StandardVariant) Rewind(plies int) error {
+	moves := v.Game.Moves()
+	positions := v.Game.Positions()
+	if plies > len(moves) {
+		return errors.New("Not enough moves to take back")
+	}
+	start, err := chess.FEN(positions[0].String())
+	if err != nil {
+		return err
+	}
+	game := chess.NewGame(start)
+	for _, move := range moves[:len(moves)-plies] {
+		if err := game.Move(move); err != nil {
+			return err
+		}
+	}
+	v.Game = game
+	return nil
+}
+
+func (v *StandardVariant) AddSyncState(update *GameSyncUpdate) {
+	update.Opening = v.Opening.Update()
+}
+
+func (v *StandardVariant) AddMoveState(update *GameMoveUpdate) {
+}
+
+/* Rematches are played from the same opening */
+func (v *StandardVariant) Setup(options *GameNewUpdate) {
+	options.Opening = v.Opening
+}
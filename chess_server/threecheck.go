@@ -0,0 +1,88 @@
+package chess_server
+
+import (
+	"github.com/notnil/chess"
+)
+
+func init() {
+	RegisterVariant(ModeThreeCheck, func(options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+		return NewThreeCheckBoard(options)
+	})
+}
+
+/* Checks needed to win a three-check game */
+const ChecksToWin = 3
+
+/* Regular chess where giving check for the third time also wins */
+type ThreeCheckBoard struct {
+	positionGame
+}
+
+func NewThreeCheckBoard(options GameNewUpdate) (*ThreeCheckBoard, error) {
+	start, err := startingPosition(options, StartingFEN, StandardMoves)
+	if err != nil {
+		return nil, err
+	}
+	return &ThreeCheckBoard{newPositionGame(start)}, nil
+}
+
+/* Regular FEN followed by the checks each side has given, e.g. +1+0 */
+func (b *ThreeCheckBoard) FEN() string {
+	return b.Position.FEN(false) + " " + b.Position.ChecksField()
+}
+
+func (b *ThreeCheckBoard) ApplyMove(move string) error {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return err
+	}
+	next := b.Position.Play(m)
+	if next.InCheck() {
+		next.Checks[b.Position.Turn] += 1
+	}
+	b.play(next)
+	return nil
+}
+
+func (b *ThreeCheckBoard) Outcome() (chess.Outcome, string) {
+	if b.Decided != chess.NoOutcome {
+		return b.Decided, b.DecidedBy
+	}
+	if outcome, method := b.mateOutcome(); outcome != chess.NoOutcome {
+		return outcome, method
+	}
+	if b.Position.Checks[chess.White] >= ChecksToWin {
+		return chess.WhiteWon, "three_check"
+	}
+	if b.Position.Checks[chess.Black] >= ChecksToWin {
+		return chess.BlackWon, "three_check"
+	}
+	/* Any piece but the king can still give checks */
+	if !b.HasMatingMaterial(chess.White) && !b.HasMatingMaterial(chess.Black) {
+		return chess.Draw, "insufficient_material"
+	}
+	return b.automaticDraw()
+}
+
+func (b *ThreeCheckBoard) HasMatingMaterial(color chess.Color) bool {
+	return b.Position.hasPieces(color)
+}
+
+/* Checks given so far, keyed by color */
+func (b *ThreeCheckBoard) checks() map[string]int {
+	return map[string]int{
+		chess.White.String(): b.Position.Checks[chess.White],
+		chess.Black.String(): b.Position.Checks[chess.Black],
+	}
+}
+
+func (b *ThreeCheckBoard) AddSyncState(update *GameSyncUpdate) {
+	update.Checks = b.checks()
+}
+
+func (b *ThreeCheckBoard) AddMoveState(update *GameMoveUpdate) {
+	update.Checks = b.checks()
+}
+
+func (b *ThreeCheckBoard) Setup(options *GameNewUpdate) {
+}
@@ -0,0 +1,244 @@
+package chess_server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+/*
+ * Variant holds the rules and the state of the board of a single board game.
+ * ChessGame takes care of players, clocks and offers and asks the variant
+ * about everything that depends on the rules.
+ */
+type Variant interface {
+	/* FEN of the current position */
+	FEN() string
+	/* Side to move */
+	Turn() chess.Color
+	/* Checks that a move given in SAN, LAN or UCI is legal in the current position */
+	ValidateMove(move string) error
+	/* Every legal move in the current position, in UCI */
+	LegalMoves() []string
+	/* Whether the side to move is in check */
+	InCheck() bool
+	/* Plays a legal move */
+	ApplyMove(move string) error
+	/* A legal move in every notation */
+	Notation(move string) (MoveNotation, error)
+	/* Result by the rules of the variant and how it came about, chess.NoOutcome while the game goes on */
+	Outcome() (chess.Outcome, string)
+	/* Ends the game with color giving up */
+	Resign(color chess.Color)
+	/* Ends the game in a draw the players agreed to */
+	Draw()
+	/* Whether color could still win, used when the opponent runs out of time */
+	HasMatingMaterial(color chess.Color) bool
+	/* Number of half moves the players have made and the color that made the first one */
+	Plies() (int, chess.Color)
+	/* Takes back the last plies half moves */
+	Rewind(plies int) error
+	/* Adds variant specific state, e.g. pockets, to sync and move messages */
+	AddSyncState(update *GameSyncUpdate)
+	AddMoveState(update *GameMoveUpdate)
+	/* Fills in what a rematch needs to start from the same position */
+	Setup(options *GameNewUpdate)
+}
+
+/* Sets up a new game of a variant */
+type VariantFactory func(options GameNewUpdate, openings *OpeningPool) (Variant, error)
+
+var variants = map[string]VariantFactory{}
+
+/*
+ * Makes a two player variant available as a game mode. Meant to be called
+ * from init functions.
+ */
+func RegisterVariant(mode string, factory VariantFactory) {
+	variants[mode] = factory
+	ModeSeats[mode] = 2
+}
+
+func NewVariant(mode string, options GameNewUpdate, openings *OpeningPool) (Variant, error) {
+	factory, ok := variants[mode]
+	if !ok {
+		return nil, fmt.Errorf("Unknown variant %s", mode)
+	}
+	return factory(options, openings)
+}
+
+/*
+ * Whether color has anything more than a bare king or a king and a single
+ * minor piece, i.e. could still deliver mate after the opponent flags
+ */
+func hasMatingMaterial(pieces []chess.Piece, color chess.Color) bool {
+	minors := 0
+	for _, piece := range pieces {
+		if piece.Color() != color {
+			continue
+		}
+		switch piece.Type() {
+		case chess.Pawn, chess.Rook, chess.Queen:
+			return true
+		case chess.Bishop, chess.Knight:
+			minors += 1
+		}
+	}
+	return minors > 1
+}
+
+/*
+ * Move history of variants played on the Position engine. Variants embed it
+ * and add their own move and outcome rules.
+ */
+type positionGame struct {
+	Position *Position
+	/* Every position of the game so far, oldest first */
+	History []*Position
+	/* Result the players decided themselves, by resigning or agreeing to a draw */
+	Decided   chess.Outcome
+	DecidedBy string
+}
+
+func newPositionGame(start *Position) positionGame {
+	return positionGame{
+		Position: start,
+		History:  []*Position{start},
+		Decided:  chess.NoOutcome,
+	}
+}
+
+func (b *positionGame) Turn() chess.Color {
+	return b.Position.Turn
+}
+
+func (b *positionGame) ValidateMove(move string) error {
+	_, err := b.Position.ParseMove(move)
+	return err
+}
+
+func (b *positionGame) LegalMoves() []string {
+	return legalMovesUCI(b.Position)
+}
+
+func (b *positionGame) InCheck() bool {
+	return b.Position.InCheck()
+}
+
+func (b *positionGame) Notation(move string) (MoveNotation, error) {
+	m, err := b.Position.ParseMove(move)
+	if err != nil {
+		return MoveNotation{}, err
+	}
+	return b.Position.Notation(m), nil
+}
+
+func (b *positionGame) play(next *Position) {
+	b.Position = next
+	b.History = append(b.History, next)
+}
+
+func (b *positionGame) Plies() (int, chess.Color) {
+	return len(b.History) - 1, b.History[0].Turn
+}
+
+func (b *positionGame) Rewind(plies int) error {
+	if plies >= len(b.History) {
+		return errors.New("Not enough moves to take back")
+	}
+	b.History = b.History[:len(b.History)-plies]
+	b.Position = b.History[len(b.History)-1]
+	return nil
+}
+
+func (b *positionGame) Resign(color chess.Color) {
+	if b.Decided != chess.NoOutcome {
+		return
+	}
+	if color == chess.White {
+		b.Decided = chess.BlackWon
+	} else {
+		b.Decided = chess.WhiteWon
+	}
+	b.DecidedBy = "resignation"
+}
+
+func (b *positionGame) Draw() {
+	if b.Decided != chess.NoOutcome {
+		return
+	}
+	b.Decided = chess.Draw
+	b.DecidedBy = "agreement"
+}
+
+/* Checkmate and stalemate, with drops counting as moves */
+func (b *positionGame) mateOutcome() (chess.Outcome, string) {
+	if len(b.Position.LegalMoves()) > 0 {
+		return chess.NoOutcome, ""
+	}
+	if !b.Position.InCheck() {
+		return chess.Draw, "stalemate"
+	}
+	if b.Position.Turn == chess.White {
+		return chess.BlackWon, "checkmate"
+	}
+	return chess.WhiteWon, "checkmate"
+}
+
+/* Draws that need no claim: fivefold repetition and the seventy-five move rule */
+func (b *positionGame) automaticDraw() (chess.Outcome, string) {
+	if b.repetitions() >= 5 {
+		return chess.Draw, "fivefold_repetition"
+	}
+	if b.Position.HalfMove >= 150 {
+		return chess.Draw, "seventy_five_move_rule"
+	}
+	return chess.NoOutcome, ""
+}
+
+/*
+ * Identifies a position for repetition purposes: everything but the move
+ * counters, plus the three-check counts
+ */
+func repetitionKey(pos *Position) string {
+	fields := strings.Fields(pos.FEN(true))
+	return strings.Join(append(fields[:4], pos.ChecksField()), " ")
+}
+
+/* How many times the current position has occurred, including now */
+func (b *positionGame) repetitions() int {
+	key := repetitionKey(b.Position)
+	repetitions := 0
+	for _, pos := range b.History {
+		if repetitionKey(pos) == key {
+			repetitions += 1
+		}
+	}
+	return repetitions
+}
+
+/*
+ * The position a game of a variant played by rules starts from: the FEN
+ * given in options for custom games, checked to be playable, or the
+ * variant's own start position fen
+ */
+func startingPosition(options GameNewUpdate, fen string, rules MoveRules) (*Position, error) {
+	custom := options.FEN != ""
+	if custom {
+		fen = options.FEN
+	}
+	start, err := ParsePosition(fen)
+	if err != nil {
+		return nil, err
+	}
+	start.Rules = rules
+	if custom {
+		/* Crazyhouse pieces change sides when they are captured */
+		if err := start.Validate(options.Mode == ModeCrazyhouse); err != nil {
+			return nil, err
+		}
+	}
+	return start, nil
+}
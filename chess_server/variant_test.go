@@ -0,0 +1,206 @@
+package chess_server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notnil/chess"
+)
+
+/* A game of mode from fen, or the mode's own start position, after moves */
+func playVariant(t *testing.T, mode string, fen string, moves ...string) Variant {
+	t.Helper()
+	variant, err := NewVariant(mode, GameNewUpdate{Mode: mode, FEN: fen}, nil)
+	if err != nil {
+		t.Fatalf("%s %s: %s", mode, fen, err)
+	}
+	for _, move := range moves {
+		if err := variant.ValidateMove(move); err != nil {
+			t.Fatalf("%s %s: %s is illegal in %s", mode, fen, move, variant.FEN())
+		}
+		if err := variant.ApplyMove(move); err != nil {
+			t.Fatalf("%s %s: %s: %s", mode, fen, move, err)
+		}
+	}
+	return variant
+}
+
+type outcomeCase struct {
+	name    string
+	fen     string
+	moves   []string
+	outcome chess.Outcome
+	method  string
+}
+
+func runOutcomes(t *testing.T, mode string, cases []outcomeCase) {
+	for _, c := range cases {
+		variant := playVariant(t, mode, c.fen, c.moves...)
+		outcome, method := variant.Outcome()
+		if outcome != c.outcome || method != c.method {
+			t.Errorf("%s %s: %s by %q, want %s by %q", mode, c.name, outcome, method, c.outcome, c.method)
+		}
+	}
+}
+
+func TestCrazyhouseOutcome(t *testing.T) {
+	runOutcomes(t, ModeCrazyhouse, []outcomeCase{
+		{"scholar's mate", "", []string{"e4", "e5", "Bc4", "Nc6", "Qh5", "Nf6", "Qxf7#"}, chess.WhiteWon, "checkmate"},
+		{"back rank mate", "k7/8/1K6/8/8/8/8/7R w - - 0 1", []string{"Rh8#"}, chess.WhiteWon, "checkmate"},
+		{"check a drop can block", "k7/8/1K6/8/8/8/8/7R[n] w - - 0 1", []string{"Rh8+"}, chess.NoOutcome, ""},
+		{"stalemate", "k7/8/1Q6/8/8/8/8/K7 w - - 0 1", []string{"Kb1"}, chess.Draw, "stalemate"},
+		{"bare kings play on", "k7/8/8/8/8/8/8/K7 w - - 0 1", nil, chess.NoOutcome, ""},
+	})
+}
+
+func TestCrazyhousePockets(t *testing.T) {
+	cases := []struct {
+		name   string
+		fen    string
+		moves  []string
+		pocket string
+	}{
+		{"captures change color", "", []string{"e4", "d5", "exd5"}, "[P]"},
+		{"promoted pieces go back to pawns", "r3k3/Q~7/8/8/8/8/8/4K3 b - - 0 1", []string{"Rxa7"}, "[p]"},
+		{"drops empty the pocket", "", []string{"e4", "d5", "exd5", "Qxd5", "P@e4"}, "[p]"},
+	}
+	for _, c := range cases {
+		variant := playVariant(t, ModeCrazyhouse, c.fen, c.moves...)
+		if fen := variant.FEN(); !strings.Contains(fen, c.pocket+" ") {
+			t.Errorf("%s: %s, want pocket %s", c.name, fen, c.pocket)
+		}
+	}
+	variant := playVariant(t, ModeCrazyhouse, "")
+	if err := variant.ValidateMove("N@f3"); err == nil {
+		t.Error("dropped a piece that is not in the pocket")
+	}
+}
+
+func TestResignAndDraw(t *testing.T) {
+	modes := []string{ModeStandard, ModeCrazyhouse, ModeChess960, ModeThreeCheck, ModeKingOfTheHill, ModeAtomic, ModeAntichess, ModeHorde, ModeRacingKings}
+	for _, mode := range modes {
+		variant := playVariant(t, mode, "")
+		variant.Resign(chess.White)
+		if outcome, method := variant.Outcome(); outcome != chess.BlackWon || method != "resignation" {
+			t.Errorf("%s: white resigned, got %s by %q", mode, outcome, method)
+		}
+		/* The first decision stands */
+		variant.Draw()
+		if outcome, _ := variant.Outcome(); outcome != chess.BlackWon {
+			t.Errorf("%s: draw agreed after resigning, got %s", mode, outcome)
+		}
+		variant = playVariant(t, mode, "")
+		variant.Draw()
+		if outcome, method := variant.Outcome(); outcome != chess.Draw || method != "agreement" {
+			t.Errorf("%s: draw agreed, got %s by %q", mode, outcome, method)
+		}
+	}
+}
+
+func TestThreeCheckOutcome(t *testing.T) {
+	runOutcomes(t, ModeThreeCheck, []outcomeCase{
+		{"second check plays on", "4k3/8/8/8/8/8/8/R3K3 w - - 0 1 +1+0", []string{"Ra8+"}, chess.NoOutcome, ""},
+		{"third check wins", "4k3/8/8/8/8/8/8/R3K3 w - - 0 1 +2+0", []string{"Ra8+"}, chess.WhiteWon, "three_check"},
+		{"third check by black", "r3k3/8/8/8/8/8/8/4K3 b - - 0 1 +0+2", []string{"Ra1+"}, chess.BlackWon, "three_check"},
+		{"checkmate", "k7/8/1K6/8/8/8/8/7R w - - 0 1", []string{"Rh8#"}, chess.WhiteWon, "checkmate"},
+		{"bare kings", "4k3/8/8/8/8/8/8/4K3 w - - 0 1", nil, chess.Draw, "insufficient_material"},
+	})
+}
+
+func TestThreeCheckFEN(t *testing.T) {
+	variant := playVariant(t, ModeThreeCheck, "", "e4", "e5", "Bc4", "Nc6", "Bxf7+")
+	want := "r1bqkbnr/pppp1Bpp/2n5/4p3/4P3/8/PPPP1PPP/RNBQK1NR b KQkq - 0 3 +1+0"
+	if fen := variant.FEN(); fen != want {
+		t.Errorf("FEN %s, want %s", fen, want)
+	}
+	/* The counts survive a round trip */
+	if fen := playVariant(t, ModeThreeCheck, want).FEN(); fen != want {
+		t.Errorf("%s came back as %s", want, fen)
+	}
+	for _, fen := range []string{"4k3/8/8/8/8/8/8/4K3 w - - 0 1 +1", "4k3/8/8/8/8/8/8/4K3 w - - 0 1 +a+0"} {
+		if _, err := ParsePosition(fen); err == nil {
+			t.Errorf("%s accepted", fen)
+		}
+	}
+	/* Positions with different counts are not repetitions of each other */
+	before, _ := ParsePosition("4k3/8/8/8/8/8/8/R3K3 w - - 0 1 +0+0")
+	after, _ := ParsePosition("4k3/8/8/8/8/8/8/R3K3 w - - 4 3 +1+0")
+	if repetitionKey(before) == repetitionKey(after) {
+		t.Errorf("%s repeats %s", after.FEN(false), before.FEN(false))
+	}
+}
+
+func TestKingOfTheHillOutcome(t *testing.T) {
+	runOutcomes(t, ModeKingOfTheHill, []outcomeCase{
+		{"white king reaches the hill", "7k/8/8/8/8/3K4/8/8 w - - 0 1", []string{"Kd4"}, chess.WhiteWon, "king_of_the_hill"},
+		{"black king reaches the hill", "8/8/4k3/8/8/8/8/K7 b - - 0 1", []string{"Ke5"}, chess.BlackWon, "king_of_the_hill"},
+		{"next to the hill", "7k/8/8/8/8/3K4/8/8 w - - 0 1", []string{"Kc4"}, chess.NoOutcome, ""},
+		{"checkmate", "k7/8/1K6/8/8/8/8/7R w - - 0 1", []string{"Rh8#"}, chess.WhiteWon, "checkmate"},
+		{"bare kings play on", "7k/8/8/8/8/8/8/K7 w - - 0 1", nil, chess.NoOutcome, ""},
+	})
+}
+
+func TestAtomicOutcome(t *testing.T) {
+	runOutcomes(t, ModeAtomic, []outcomeCase{
+		{"capture next to the king", "4k3/4q3/8/8/8/8/8/4R1K1 w - - 0 1", []string{"Rxe7"}, chess.WhiteWon, "explosion"},
+		/* Kings may touch, so the queen next to the king is safe */
+		{"checkmate", "k7/8/8/8/8/8/8/1Q4K1 w - - 0 1", []string{"Qb7#"}, chess.WhiteWon, "checkmate"},
+		{"bare kings", "4k3/8/8/8/8/8/8/4K3 w - - 0 1", nil, chess.Draw, "insufficient_material"},
+	})
+	/* A capture that would blow up the capturing side's own king is illegal */
+	variant := playVariant(t, ModeAtomic, "4k3/8/8/8/8/8/3q4/4K3 w - - 0 1")
+	if err := variant.ValidateMove("Kxd2"); err == nil {
+		t.Error("king captured in atomic")
+	}
+}
+
+/* Reference counts from https://www.chessprogramming.org/Atomic_Chess */
+func TestAtomicPerft(t *testing.T) {
+	runPerft(t, []perftCase{
+		{fen: StartingFEN, rules: AtomicMoves, nodes: []int{20, 400, 8902, 197326}},
+	})
+}
+
+func TestAntichessOutcome(t *testing.T) {
+	runOutcomes(t, ModeAntichess, []outcomeCase{
+		{"losing every piece wins", "8/8/8/8/8/2p5/1P6/8 w - - 0 1", []string{"bxc3"}, chess.BlackWon, "all_pieces_lost"},
+		{"having no move wins", "8/8/8/8/8/p7/P7/8 w - - 0 1", nil, chess.WhiteWon, "stalemate"},
+		{"start position plays on", "", []string{"e3", "b5", "Bxb5"}, chess.NoOutcome, ""},
+	})
+	/* Captures are compulsory */
+	variant := playVariant(t, ModeAntichess, "", "e3", "b5")
+	if err := variant.ValidateMove("a3"); err == nil {
+		t.Error("a3 accepted with Bxb5 available")
+	}
+}
+
+func TestHordeOutcome(t *testing.T) {
+	runOutcomes(t, ModeHorde, []outcomeCase{
+		{"capturing the horde", "4k3/8/8/8/8/8/6P1/5q2 b - - 0 1", []string{"Qxg2"}, chess.BlackWon, "horde_captured"},
+		{"checkmating black", "k7/8/KQ6/8/8/8/8/8 w - - 0 1", []string{"Qb7#"}, chess.WhiteWon, "checkmate"},
+		{"start position plays on", "", []string{"e5", "d5"}, chess.NoOutcome, ""},
+	})
+}
+
+func TestRacingKingsOutcome(t *testing.T) {
+	runOutcomes(t, ModeRacingKings, []outcomeCase{
+		{"black reaches the eighth rank", "8/6k1/8/1K6/8/8/8/8 b - - 0 1", []string{"Kg8"}, chess.BlackWon, "king_reached_eighth_rank"},
+		{"white reaches it out of black's reach", "8/1K6/8/8/6k1/8/8/8 w - - 0 1", []string{"Kb8"}, chess.WhiteWon, "king_reached_eighth_rank"},
+		{"black gets a last move", "8/1K4k1/8/8/8/8/8/8 w - - 0 1", []string{"Kb8"}, chess.NoOutcome, ""},
+		{"both kings arrive", "8/1K4k1/8/8/8/8/8/8 w - - 0 1", []string{"Kb8", "Kg8"}, chess.Draw, "king_reached_eighth_rank"},
+	})
+	/* Giving check is not allowed */
+	variant := playVariant(t, ModeRacingKings, "8/8/8/8/8/k7/8/1R5K w - - 0 1")
+	if err := variant.ValidateMove("Ra1"); err == nil {
+		t.Error("Ra1 gives check but was accepted")
+	}
+}
+
+/* Reference counts from https://github.com/niklasf/python-chess variant perft suites */
+func TestVariantPerft(t *testing.T) {
+	runPerft(t, []perftCase{
+		{fen: "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w - - 0 1", rules: AntichessMoves, nodes: []int{20, 400, 8067, 153299}},
+		{fen: "rnbqkbnr/pppppppp/8/1PP2PP1/PPPPPPPP/PPPPPPPP/PPPPPPPP/PPPPPPPP w kq - 0 1", rules: HordeMoves, nodes: []int{8, 128, 1274, 23310}},
+		{fen: "8/8/8/8/8/8/krbnNBRK/qrbnNBRQ w - - 0 1", rules: RacingKingsMoves, nodes: []int{21, 421, 11264, 296242}},
+	})
+}
@@ -0,0 +1,411 @@
+package chess_server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+/* Kinds of records in the game log */
+const (
+	LogGameCreated = "game_created"
+	LogAction      = "action"
+	LogEvent       = "event"
+)
+
+/*
+ * A record of the game log: how a game was set up, then what the players did
+ * and what was broadcast to the game
+ */
+type GameLogRecord struct {
+	Type   string    `json:"type"`
+	GameId uint64    `json:"game_id"`
+	Time   time.Time `json:"time"`
+	/*
+	 * game_created: the options the game was set up with and who may sit
+	 * where, by the hashes of the seat tokens
+	 */
+	Options         *GameNewUpdate    `json:"options,omitempty"`
+	FirstPlayerId   uint64            `json:"first_player_id,omitempty"`
+	SeatTokenHashes map[uint64]string `json:"seat_token_hashes,omitempty"`
+	/*
+	 * action: an update a player sent, numbered after the last event before
+	 * it, with the time the game took it at
+	 * event: something broadcast to the game
+	 */
+	Event *GameEvent `json:"event,omitempty"`
+}
+
+/*
+ * GameLog is a write-ahead log of the games in progress, one JSON line per
+ * record. What a player does is flushed to disk before the game acts on it,
+ * so a crash loses at most the move being made. Games write to it from their
+ * own goroutines, so it has its own lock.
+ */
+type GameLog struct {
+	lock sync.Mutex
+	Path string
+	file *os.File
+}
+
+/*
+ * Opens the log in path for appending and returns the records already in it.
+ * A last line cut off by a crash is ignored.
+ */
+func OpenGameLog(path string) (*GameLog, []GameLogRecord, error) {
+	records, err := readGameLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := &GameLog{Path: path}
+	if err := l.open(); err != nil {
+		return nil, nil, err
+	}
+	return l, records, nil
+}
+
+func readGameLog(path string) ([]GameLogRecord, error) {
+	records := []GameLogRecord{}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	var broken error
+	for scanner.Scan() {
+		line += 1
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if broken != nil {
+			return nil, broken
+		}
+		record := GameLogRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			broken = fmt.Errorf("%s:%d: %s", path, line, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if broken != nil {
+		log.Warnf("Ignoring incomplete record at the end of the game log: %s", broken)
+	}
+	return records, nil
+}
+
+func (l *GameLog) open() error {
+	file, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+/* Writes a record to the end of the log and waits for it to reach the disk */
+func (l *GameLog) Append(record GameLogRecord) error {
+	return l.write(record, true)
+}
+
+/*
+ * Writes a record to the end of the log without waiting for the disk. The
+ * next Append takes it along.
+ */
+func (l *GameLog) Write(record GameLogRecord) error {
+	return l.write(record, false)
+}
+
+func (l *GameLog) write(record GameLogRecord, sync bool) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if !sync {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+/* Replaces the log with just records, e.g. to drop the games that are over */
+func (l *GameLog) Rewrite(records []GameLogRecord) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rewrite(records)
+}
+
+/*
+ * Takes the records of a game out of the log. Called once the game has
+ * stopped, so nothing more is written about it and a restart need not look
+ * at it again.
+ */
+func (l *GameLog) Drop(gameId uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	records, err := readGameLog(l.Path)
+	if err != nil {
+		return err
+	}
+	kept := []GameLogRecord{}
+	for _, record := range records {
+		if record.GameId != gameId {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == len(records) {
+		return nil
+	}
+	return l.rewrite(kept)
+}
+
+/* Like Rewrite, for callers that hold the lock */
+func (l *GameLog) rewrite(records []GameLogRecord) error {
+	tmp := l.Path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err == nil {
+			_, err = writer.Write(append(data, '\n'))
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.Path); err != nil {
+		return err
+	}
+	l.file.Close()
+	return l.open()
+}
+
+/* Writes a record about the game to its log, if it has one */
+func (g *ChessGame) log(record GameLogRecord) {
+	if g.Log == nil {
+		return
+	}
+	if err := g.Log.Append(record); err != nil {
+		log.Errorf("Could not log game %d: %s", g.GameId, err)
+	}
+}
+
+/*
+ * Logs an update a player sent before the game acts on it, with the time
+ * the game acts at. Called from the game's goroutine once the update has
+ * been checked.
+ */
+func (g *ChessGame) logAction(update GameUpdate, T string, now time.Time) {
+	if g.Log == nil {
+		return
+	}
+	action := GameEvent{Seq: g.LastSeq(), Type: T, Time: now, Update: update}
+	g.log(GameLogRecord{Type: LogAction, GameId: g.GameId, Time: now, Event: &action})
+}
+
+/*
+ * Logs a broadcast event. Events follow from the actions logged before
+ * them, so they do not wait for the disk.
+ */
+func (g *ChessGame) logEvent(event GameEvent) {
+	if g.Log == nil {
+		return
+	}
+	record := GameLogRecord{Type: LogEvent, GameId: g.GameId, Time: event.Time, Event: &event}
+	if err := g.Log.Write(record); err != nil {
+		log.Errorf("Could not log game %d: %s", g.GameId, err)
+	}
+}
+
+/* A game being rebuilt from the log */
+type recoveredGame struct {
+	Game    *ChessGame
+	Created GameLogRecord
+	Actions []GameEvent
+	/* Logged events by number */
+	Events map[uint64]GameEvent
+	Over   bool
+	/* Set aside while replaying, so the replay does not rate or archive anything */
+	Ratings *RatingController
+	Archive *GameArchive
+}
+
+/*
+ * events followed by the logged events after them, as far as none is
+ * missing. Events can reach the log out of order, and the last ones may not
+ * have made it.
+ */
+func (r *recoveredGame) loggedEvents(events []GameEvent) []GameEvent {
+	events = append([]GameEvent{}, events...)
+	for seq := uint64(len(events)) + 1; ; seq++ {
+		event, ok := r.Events[seq]
+		if !ok {
+			return events
+		}
+		events = append(events, event)
+	}
+}
+
+/*
+ * Plays the actions of the game again with the times they were taken at,
+ * and returns its events: the logged ones, followed by those of actions
+ * whose events were lost in a crash
+ */
+func (r *recoveredGame) replay() []GameEvent {
+	game := r.Game
+	events := r.loggedEvents(nil)
+	for _, action := range r.Actions {
+		/* Replaying numbers its events after the ones the action followed */
+		before := action.Seq
+		if before > uint64(len(events)) {
+			before = uint64(len(events))
+		}
+		game.EventLog = append([]GameEvent{}, events[:before]...)
+		if err := game.replayAction(action); err != nil {
+			log.Errorf("Could not replay %s of game %d: %s", action.Type, game.GameId, err)
+		}
+		/* Not the time of the replay, which would count as time the server was up */
+		for i := int(before); i < len(game.EventLog); i++ {
+			game.EventLog[i].Time = action.Time
+		}
+		if len(game.EventLog) > len(events) {
+			events = r.loggedEvents(game.EventLog)
+		}
+	}
+	return events
+}
+
+/*
+ * Rebuilds the unfinished games in records by playing their actions again
+ * with the times they were taken at, and starts them. The games keep their
+ * events as they were, so their numbers carry on. The time between the last
+ * record and now is not charged to anyone, and every player gets the
+ * reconnect grace period to come back. Games whose last action ended them
+ * before the result was logged are rated and archived now. Returns the
+ * records of the games that are still going.
+ */
+func (g *ChessGamesController) Recover(records []GameLogRecord, now time.Time) []GameLogRecord {
+	games := make(map[uint64]*recoveredGame)
+	order := []uint64{}
+	var last time.Time
+	for _, record := range records {
+		if record.Time.After(last) {
+			last = record.Time
+		}
+		if record.Type == LogGameCreated {
+			if record.Options == nil {
+				log.Errorf("Game %d in the log has no options", record.GameId)
+				continue
+			}
+			game, err := g.createGame(record.GameId, record.FirstPlayerId, *record.Options, record.Time)
+			if err != nil {
+				log.Errorf("Could not recreate game %d: %s", record.GameId, err)
+				continue
+			}
+			game.SeatTokenHashes = record.SeatTokenHashes
+			games[record.GameId] = &recoveredGame{
+				Game:    game,
+				Created: record,
+				Events:  make(map[uint64]GameEvent),
+				Ratings: game.Ratings,
+				Archive: game.Archive,
+			}
+			game.Ratings, game.Archive = nil, nil
+			order = append(order, record.GameId)
+			continue
+		}
+		recovered, ok := games[record.GameId]
+		if !ok || record.Event == nil {
+			continue
+		}
+		switch record.Type {
+		case LogAction:
+			recovered.Actions = append(recovered.Actions, *record.Event)
+		case LogEvent:
+			if record.Event.Type == "result_update" {
+				recovered.Over = true
+			}
+			recovered.Events[record.Event.Seq] = *record.Event
+		}
+	}
+
+	kept := []GameLogRecord{}
+	for _, gameId := range order {
+		recovered := games[gameId]
+		if recovered.Over {
+			continue
+		}
+		events := recovered.replay()
+		game := recovered.Game
+		game.Ratings, game.Archive, game.Log = recovered.Ratings, recovered.Archive, g.Log
+		game.EventLog = events
+		if game.Bughouse != nil {
+			for _, board := range game.Bughouse.Boards {
+				board.Clock.Pause(now.Sub(last))
+			}
+		} else {
+			game.Clock.Pause(now.Sub(last))
+		}
+		if game.Finished() {
+			/* The last action ended the game, but the crash came before its result was out */
+			game.broadcastResult()
+			continue
+		}
+		seats := game.PlayerSeats()
+		if g.ReconnectGrace > 0 {
+			for _, seat := range seats {
+				game.Disconnected[seat.PlayerId] = now.Add(g.ReconnectGrace)
+			}
+			game.NextCountdown = now.Add(time.Second)
+		}
+		g.Games[gameId] = game
+		if gameId >= g.NextAvailGameId {
+			g.NextAvailGameId = gameId + 1
+		}
+		if next := game.WhitePlayerId + uint64(len(seats)); next > g.NextAvailPlayerId {
+			g.NextAvailPlayerId = next
+		}
+		/* The log keeps the game as it was recovered, events that were lost included */
+		kept = append(kept, recovered.Created)
+		for i := range recovered.Actions {
+			kept = append(kept, GameLogRecord{Type: LogAction, GameId: gameId, Time: recovered.Actions[i].Time, Event: &recovered.Actions[i]})
+		}
+		for i := range events {
+			kept = append(kept, GameLogRecord{Type: LogEvent, GameId: gameId, Time: events[i].Time, Event: &events[i]})
+		}
+		log.Infof("Recovered game %d", gameId)
+		go game.Run()
+	}
+	return kept
+}
@@ -0,0 +1,181 @@
+package chess_server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+/* An action or event as it comes back from the log, with its update as raw JSON */
+func loggedEvent(t *testing.T, seq uint64, T string, at time.Time, update GameUpdate) GameEvent {
+	t.Helper()
+	data, err := json.Marshal(GameEvent{Seq: seq, Type: T, Time: at, Update: update})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event GameEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestReplayActions(t *testing.T) {
+	var controller ChessGamesController
+	controller.Init()
+	options := GameNewUpdate{Mode: ModeStandard, TimeControl: TimeControl{Base: time.Minute}}
+	game, err := controller.createGame(0, 0, options, clockStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	white := GameMoveUpdate{GameId: 0, PlayerId: 0, PlayerColor: "w", Move: "e4"}
+	black := GameMoveUpdate{GameId: 0, PlayerId: 1, PlayerColor: "b", Move: "e5"}
+	blackMoved := clockStart.Add(20 * time.Second)
+	recovered := &recoveredGame{
+		Game: game,
+		Actions: []GameEvent{
+			loggedEvent(t, 2, "move_update", clockStart.Add(5*time.Second), white),
+			loggedEvent(t, 3, "move_update", blackMoved, black),
+		},
+		/* The event of black's move was lost, the one after it was not */
+		Events: map[uint64]GameEvent{
+			1: loggedEvent(t, 1, "player_joined_update", clockStart, GamePlayerJoinedUpdate{GameId: 0, PlayerId: 0}),
+			2: loggedEvent(t, 2, "player_joined_update", clockStart, GamePlayerJoinedUpdate{GameId: 0, PlayerId: 1}),
+			3: loggedEvent(t, 3, "move_update", clockStart.Add(5*time.Second), white),
+			5: loggedEvent(t, 5, "player_left_update", blackMoved.Add(time.Second), GamePlayerLeftUpdate{GameId: 0, PlayerId: 1}),
+		},
+	}
+	events := recovered.replay()
+
+	if fen := game.FEN(); fen != "rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 0 2" {
+		t.Errorf("replayed to %s", fen)
+	}
+	if len(events) != 5 {
+		t.Fatalf("%d events, want 5", len(events))
+	}
+	for i, want := range []string{"player_joined_update", "player_joined_update", "move_update", "move_update", "player_left_update"} {
+		if events[i].Seq != uint64(i+1) || events[i].Type != want {
+			t.Errorf("event %d is %d %s, want %s", i+1, events[i].Seq, events[i].Type, want)
+		}
+	}
+	/* The lost event is made again at the time of its action */
+	if !events[3].Time.Equal(blackMoved) {
+		t.Errorf("replayed event at %s, want %s", events[3].Time, blackMoved)
+	}
+	/* Black is charged exactly the time between the logged moves */
+	if got := game.Clock.Remaining(chess.Black, blackMoved); got != time.Minute-15*time.Second {
+		t.Errorf("black has %s left, want 45s", got)
+	}
+}
+
+func TestRecoverFinishingMove(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := LoadGameArchive(filepath.Join(dir, "games.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ratings RatingController
+	ratings.Init()
+	go ratings.Run()
+	var controller ChessGamesController
+	controller.Init()
+	controller.Archive = archive
+	controller.Ratings = &ratings
+	options := GameNewUpdate{Mode: ModeStandard, TimeControl: TimeControl{Base: time.Minute}, WhiteUser: "alice", BlackUser: "bob"}
+	records := []GameLogRecord{{Type: LogGameCreated, GameId: 0, Time: clockStart, Options: &options}}
+	/* Fool's mate, logged up to the mating move but not its result */
+	for i, move := range []string{"f3", "e5", "g4", "Qh4#"} {
+		update := GameMoveUpdate{GameId: 0, PlayerId: uint64(i % 2), PlayerColor: []string{"w", "b"}[i%2], Move: move}
+		action := loggedEvent(t, uint64(i), "move_update", clockStart.Add(time.Duration(i+1)*time.Second), update)
+		records = append(records, GameLogRecord{Type: LogAction, GameId: 0, Time: action.Time, Event: &action})
+	}
+	kept := controller.Recover(records, clockStart.Add(time.Hour))
+
+	if len(kept) != 0 || len(controller.Games) != 0 {
+		t.Fatalf("finished game kept: %d records, %d games", len(kept), len(controller.Games))
+	}
+	archived, ok := archive.Game(0)
+	if !ok {
+		t.Fatal("finished game not archived")
+	}
+	if archived.Result != "0-1" || len(archived.Moves) != 4 {
+		t.Errorf("archived %s after %d moves, want 0-1 after 4", archived.Result, len(archived.Moves))
+	}
+	if rating := ratings.Rating("bob", RatingPool(ModeStandard, options.TimeControl)); rating.Games != 1 {
+		t.Errorf("bob has %d rated games, want 1", rating.Games)
+	}
+}
+
+func TestGameLogSeatTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "games.wal")
+	log, _, err := OpenGameLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var controller ChessGamesController
+	controller.Init()
+	controller.Log = log
+	game, err := controller.addNewGame(GameNewUpdate{Mode: ModeStandard, TimeControl: TimeControl{Base: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := game.SeatTokens[game.WhitePlayerId]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) || !strings.Contains(string(data), hashToken(token)) {
+		t.Errorf("log holds %s", data)
+	}
+
+	/* After a restart the hashes still let the player back in */
+	_, records, err := OpenGameLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restarted ChessGamesController
+	restarted.Init()
+	restarted.Recover(records, time.Now())
+	join := GamePlayerJoinedUpdate{GameId: game.GameId, PlayerId: game.WhitePlayerId, Token: hashToken(token)}
+	if _, _, err := restarted.playerJoin(join); err == nil {
+		t.Error("joined with the hash of the token")
+	}
+	join.Token = token
+	if _, _, err := restarted.playerJoin(join); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGameLogDrop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "games.wal")
+	log, _, err := OpenGameLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := GameNewUpdate{Mode: ModeStandard}
+	for _, gameId := range []uint64{0, 1, 0} {
+		if err := log.Append(GameLogRecord{Type: LogGameCreated, GameId: gameId, Time: clockStart, Options: &options}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var controller ChessGamesController
+	controller.Init()
+	controller.Log = log
+	controller.deleteGame(0)
+	/* The log is still open for the games that are left */
+	if err := log.Append(GameLogRecord{Type: LogGameCreated, GameId: 2, Time: clockStart, Options: &options}); err != nil {
+		t.Fatal(err)
+	}
+	_, records, err := OpenGameLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].GameId != 1 || records[1].GameId != 2 {
+		t.Errorf("log holds %+v, want games 1 and 2", records)
+	}
+}
@@ -17,6 +17,8 @@ const (
 type WSMessage struct {
 	T      string          `json:"type"`
 	Update json.RawMessage `json:"update"`
+	/* Number of the event carried, for updates that are game events */
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 type WSController struct {
@@ -34,6 +36,11 @@ func (c *WSController) ReadUnmarshal() (GameUpdate, string, error) {
 	if err := c.Ws.ReadJSON(&msg); err != nil {
 		return nil, "", err
 	}
+	return UnmarshalUpdate(msg)
+}
+
+/* The update in msg as the type its name stands for */
+func UnmarshalUpdate(msg WSMessage) (GameUpdate, string, error) {
 	switch msg.T {
 	case "move_update":
 		var moveUpdate GameMoveUpdate
@@ -53,40 +60,195 @@ func (c *WSController) ReadUnmarshal() (GameUpdate, string, error) {
 			return nil, "", err
 		}
 		return spectatorJoinUpdate, msg.T, nil
+	case "resign":
+		var resignUpdate GameResignUpdate
+		if err := json.Unmarshal(msg.Update, &resignUpdate); err != nil {
+			return nil, "", err
+		}
+		return resignUpdate, msg.T, nil
+	case "offer_draw":
+		var drawOfferUpdate GameDrawOfferUpdate
+		if err := json.Unmarshal(msg.Update, &drawOfferUpdate); err != nil {
+			return nil, "", err
+		}
+		return drawOfferUpdate, msg.T, nil
+	case "accept_draw":
+		var drawAcceptUpdate GameDrawAcceptUpdate
+		if err := json.Unmarshal(msg.Update, &drawAcceptUpdate); err != nil {
+			return nil, "", err
+		}
+		return drawAcceptUpdate, msg.T, nil
+	case "decline_draw":
+		var drawDeclineUpdate GameDrawDeclineUpdate
+		if err := json.Unmarshal(msg.Update, &drawDeclineUpdate); err != nil {
+			return nil, "", err
+		}
+		return drawDeclineUpdate, msg.T, nil
+	case "takeback_request":
+		var takebackRequestUpdate GameTakebackRequestUpdate
+		if err := json.Unmarshal(msg.Update, &takebackRequestUpdate); err != nil {
+			return nil, "", err
+		}
+		return takebackRequestUpdate, msg.T, nil
+	case "accept_takeback":
+		var takebackAcceptUpdate GameTakebackAcceptUpdate
+		if err := json.Unmarshal(msg.Update, &takebackAcceptUpdate); err != nil {
+			return nil, "", err
+		}
+		return takebackAcceptUpdate, msg.T, nil
+	case "decline_takeback":
+		var takebackDeclineUpdate GameTakebackDeclineUpdate
+		if err := json.Unmarshal(msg.Update, &takebackDeclineUpdate); err != nil {
+			return nil, "", err
+		}
+		return takebackDeclineUpdate, msg.T, nil
+	case "rematch_offer":
+		var rematchOfferUpdate GameRematchOfferUpdate
+		if err := json.Unmarshal(msg.Update, &rematchOfferUpdate); err != nil {
+			return nil, "", err
+		}
+		return rematchOfferUpdate, msg.T, nil
+	case "accept_rematch":
+		var rematchAcceptUpdate GameRematchAcceptUpdate
+		if err := json.Unmarshal(msg.Update, &rematchAcceptUpdate); err != nil {
+			return nil, "", err
+		}
+		return rematchAcceptUpdate, msg.T, nil
+	case "decline_rematch":
+		var rematchDeclineUpdate GameRematchDeclineUpdate
+		if err := json.Unmarshal(msg.Update, &rematchDeclineUpdate); err != nil {
+			return nil, "", err
+		}
+		return rematchDeclineUpdate, msg.T, nil
+	case "events_since":
+		var eventsSinceUpdate GameEventsSinceUpdate
+		if err := json.Unmarshal(msg.Update, &eventsSinceUpdate); err != nil {
+			return nil, "", err
+		}
+		return eventsSinceUpdate, msg.T, nil
+	case "challenge_watch":
+		var challengeWatchUpdate ChallengeWatchUpdate
+		if err := json.Unmarshal(msg.Update, &challengeWatchUpdate); err != nil {
+			return nil, "", err
+		}
+		return challengeWatchUpdate, msg.T, nil
+	case "find_match":
+		var findMatchRequest FindMatchRequest
+		if err := json.Unmarshal(msg.Update, &findMatchRequest); err != nil {
+			return nil, "", err
+		}
+		return findMatchRequest, msg.T, nil
+	case "cancel_match":
+		return MatchCancelRequest{}, msg.T, nil
+	case "seek_create":
+		var seekCreateUpdate SeekCreateUpdate
+		if err := json.Unmarshal(msg.Update, &seekCreateUpdate); err != nil {
+			return nil, "", err
+		}
+		return seekCreateUpdate, msg.T, nil
+	case "seek_cancel":
+		var seekCancelUpdate SeekCancelUpdate
+		if err := json.Unmarshal(msg.Update, &seekCancelUpdate); err != nil {
+			return nil, "", err
+		}
+		return seekCancelUpdate, msg.T, nil
+	case "seek_accept":
+		var seekAcceptUpdate SeekAcceptUpdate
+		if err := json.Unmarshal(msg.Update, &seekAcceptUpdate); err != nil {
+			return nil, "", err
+		}
+		return seekAcceptUpdate, msg.T, nil
 	default:
 		return nil, "", errors.New("Unrecognized websocket message")
 	}
 }
 
-func (c *WSController) WriteMarshal(update interface{}) error {
-	updateData, err := json.Marshal(update)
-	if err != nil {
-		return err
-	}
-	msg := WSMessage{
-		Update: updateData,
-	}
-
+/* Name of the message type update is sent as */
+func messageType(update interface{}) (string, error) {
 	switch update.(type) {
 	case GameMoveUpdate:
-		msg.T = "move_update"
+		return "move_update", nil
 	case GameSyncUpdate:
-		msg.T = "snapshot_update"
+		return "snapshot_update", nil
 	case GameResultUpdate:
-		msg.T = "result_update"
+		return "result_update", nil
 	case GameSpectatorJoinedUpdate:
-		msg.T = "spectator_joined_update"
+		return "spectator_joined_update", nil
 	case GameSpectatorLeftUpdate:
-		msg.T = "spectator_left_update"
+		return "spectator_left_update", nil
 	case GamePlayerJoinedUpdate:
-		msg.T = "player_joined_update"
+		return "player_joined_update", nil
 	case GamePlayerLeftUpdate:
-		msg.T = "player_left_update"
+		return "player_left_update", nil
+	case GameReconnectUpdate:
+		return "reconnect_countdown", nil
+	case GameResignUpdate:
+		return "resign", nil
+	case GameDrawOfferUpdate:
+		return "offer_draw", nil
+	case GameDrawAcceptUpdate:
+		return "accept_draw", nil
+	case GameDrawDeclineUpdate:
+		return "decline_draw", nil
+	case GameTakebackRequestUpdate:
+		return "takeback_request", nil
+	case GameTakebackAcceptUpdate:
+		return "accept_takeback", nil
+	case GameTakebackDeclineUpdate:
+		return "decline_takeback", nil
+	case GameRematchOfferUpdate:
+		return "rematch_offer", nil
+	case GameRematchAcceptUpdate:
+		return "accept_rematch", nil
+	case GameRematchDeclineUpdate:
+		return "decline_rematch", nil
+	case GameRematchUpdate:
+		return "rematch_update", nil
+	case MatchFoundResponse:
+		return "match_found", nil
+	case MatchTimeoutResponse:
+		return "match_timeout", nil
+	case MatchErrorResponse:
+		return "match_error", nil
+	case QueueUpdate:
+		return "queue_update", nil
+	case ChallengeAcceptedUpdate:
+		return "challenge_accepted", nil
+	case ChallengeClosedUpdate:
+		return "challenge_closed", nil
+	case LobbySnapshotUpdate:
+		return "lobby_snapshot", nil
+	case SeekAddedUpdate:
+		return "seek_added", nil
+	case SeekRemovedUpdate:
+		return "seek_removed", nil
+	case LobbyErrorUpdate:
+		return "lobby_error", nil
 	default:
-		return errors.New("Unsupported game update type")
+		return "", errors.New("Unsupported game update type")
+	}
+}
+
+func (c *WSController) WriteMarshal(update interface{}) error {
+	/* Events go out as the update they hold, numbered */
+	if event, ok := update.(GameEvent); ok {
+		updateData, err := json.Marshal(event.Update)
+		if err != nil {
+			return err
+		}
+		c.Ws.SetWriteDeadline(time.Now().Add(writeWait))
+		return c.Ws.WriteJSON(WSMessage{T: event.Type, Update: updateData, Seq: event.Seq})
+	}
+	T, err := messageType(update)
+	if err != nil {
+		return err
+	}
+	updateData, err := json.Marshal(update)
+	if err != nil {
+		return err
 	}
 	c.Ws.SetWriteDeadline(time.Now().Add(writeWait))
-	return c.Ws.WriteJSON(msg)
+	return c.Ws.WriteJSON(WSMessage{T: T, Update: updateData})
 }
 
 /* Closing ws *should* signal to the reader to return */
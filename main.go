@@ -1,6 +1,10 @@
 package main
 
 import (
+	"flag"
+	"os"
+	"time"
+
 	chess_server "github.com/SrsBusiness/chess_server/chess_server"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -8,11 +12,45 @@ import (
 )
 
 func main() {
+	openings := flag.String("openings", "openings.tsv", "opening pool for random opening games")
+	matchTimeout := flag.Duration("match-timeout", 2*time.Minute, "how long find_match waits for an opponent")
+	reconnectGrace := flag.Duration("reconnect-grace", chess_server.DefaultReconnectGrace, "how long players who drop out of a game have to come back, 0 to wait forever")
+	archive := flag.String("archive", "games.jsonl", "file finished games are kept in")
+	gameLog := flag.String("game-log", "games.wal", "file live games are logged to so they survive a restart")
+	accounts := flag.String("accounts", "accounts.json", "file registered accounts are kept in")
+	ratings := flag.String("ratings", "ratings.json", "file players' ratings are kept in")
+	sessionKey := flag.String("session-key", os.Getenv("CHESS_SESSION_KEY"), "key session tokens are signed with, random if empty")
+	flag.Parse()
+
 	// Start Backend
 	var server chess_server.ChessServer
 	server.Init()
+	server.MatchMakingController.MatchTimeout = *matchTimeout
+	server.ChessGamesController.ReconnectGrace = *reconnectGrace
+	if err := server.LoadOpenings(*openings); err != nil {
+		log.Warnf("Could not load opening pool, random opening games will start from the initial position: %s", err)
+	}
+	if err := server.LoadArchive(*archive); err != nil {
+		log.Fatalf("Could not load the game archive: %s", err)
+	}
+	if err := server.LoadRatings(*ratings); err != nil {
+		log.Fatalf("Could not load ratings: %s", err)
+	}
+	if err := server.LoadGameLog(*gameLog); err != nil {
+		log.Fatalf("Could not recover games from the game log: %s", err)
+	}
+	if err := server.LoadAccounts(*accounts); err != nil {
+		log.Fatalf("Could not load accounts: %s", err)
+	}
+	if *sessionKey == "" {
+		log.Warn("No session key given, sessions will not survive a restart")
+	}
+	if err := server.SetSessionKey(*sessionKey); err != nil {
+		log.Fatalf("Could not create a session key: %s", err)
+	}
 	go server.MatchMakingController.Run()
 	go server.ChessGamesController.Run()
+	go server.Ratings.Run()
 
 	// Echo instance
 	e := echo.New()
@@ -28,7 +66,20 @@ func main() {
 	e.Use(middleware.Recover())
 
 	// Routes
+	e.POST("/register", chess_server.Register)
+	e.POST("/login", chess_server.Login)
 	e.GET("/find_match", chess_server.FindMatch)
+	e.GET("/matchmaking", server.WSHandler(server.MatchLoop))
+	e.POST("/create_game", chess_server.CreateGame)
+	e.POST("/challenge", chess_server.CreateChallenge)
+	e.POST("/challenge/:token", chess_server.AcceptChallenge)
+	e.DELETE("/challenge/:token", chess_server.CancelChallenge)
+	e.GET("/watch_challenge", server.WSHandler(server.ChallengeLoop))
+	e.GET("/lobby", server.WSHandler(server.LobbyLoop))
+	e.GET("/ratings/:user", chess_server.GetRatings)
+	e.GET("/games/:file", chess_server.GetGamePGN)
+	e.GET("/games/user/:user", chess_server.GetUserGamesPGN)
+	e.GET("/games/:id/events", chess_server.GetGameEvents)
 	e.GET("/play", server.WSHandler(server.PlayerLoop))
 	e.GET("/spectate", server.WSHandler(server.SpectateLoop))
 